@@ -0,0 +1,365 @@
+// Package conformance tests that an implementation of db.DB honors the
+// invariants documented on db.DB. Each implementation's tests call Run with a
+// factory for empty DBs.
+package conformance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minorhacks/bazel_remote_query/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Factory returns a new, empty DB and a function that releases the resources
+// backing it. Factories may skip t if the DB can't be run in the test
+// environment.
+type Factory func(t *testing.T) (db.DB, func(), error)
+
+// commitHash is a full commit hash, whose succeeded jobs may be reused.
+const commitHash = "0123456789abcdef0123456789abcdef01234567"
+
+// leaseDuration is how long dequeued jobs are leased for. Tests don't depend on
+// leases expiring.
+const leaseDuration = time.Hour
+
+var tests = []struct {
+	name string
+	run  func(t *testing.T, d db.DB)
+}{
+	{name: "DedupPending", run: testDedupPending},
+	{name: "DedupRunning", run: testDedupRunning},
+	{name: "DedupSucceeded", run: testDedupSucceeded},
+	{name: "ReenqueueAfterFailure", run: testReenqueueAfterFailure},
+	{name: "ReenqueueAfterCancel", run: testReenqueueAfterCancel},
+	{name: "DequeueFIFO", run: testDequeueFIFO},
+	{name: "QueuePosition", run: testQueuePosition},
+	{name: "NoOutstandingJobs", run: testNoOutstandingJobs},
+	{name: "JobNotFound", run: testJobNotFound},
+	{name: "FinishInvalidStatus", run: testFinishInvalidStatus},
+	{name: "FinishLeaseExpired", run: testFinishLeaseExpired},
+	{name: "FinishResolvedCommit", run: testFinishResolvedCommit},
+	{name: "ConcurrentDequeue", run: testConcurrentDequeue},
+}
+
+// FakeSkips lists the tests that db.Fake doesn't pass, to be passed to Run.
+// Fake replays a scripted queue for dispatch and queue tests, so it doesn't
+// deduplicate jobs (the Dedup and ReenqueueAfterFailure tests), order jobs
+// queued at the same time (QueuePosition), or serialize concurrent callers
+// (ConcurrentDequeue). db/memory implements all of the invariants.
+var FakeSkips = []string{
+	"DedupPending",
+	"DedupRunning",
+	"DedupSucceeded",
+	"ReenqueueAfterFailure",
+	"QueuePosition",
+	"ConcurrentDequeue",
+}
+
+// Run runs every conformance test as a subtest of t, each against a new DB
+// returned by newDB. Tests named in skip are skipped, for test doubles that
+// deliberately don't implement some invariants.
+func Run(t *testing.T, newDB Factory, skip ...string) {
+	skipped := map[string]bool{}
+	for _, name := range skip {
+		skipped[name] = true
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if skipped[tc.name] {
+				t.Skip("skipped by caller")
+			}
+			d, cleanup, err := newDB(t)
+			if err != nil {
+				t.Fatalf("failed to create DB: %v", err)
+			}
+			defer cleanup()
+			defer d.Close()
+			tc.run(t, d)
+		})
+	}
+}
+
+func newJob(committish string, query string) *db.QueryJob {
+	return &db.QueryJob{
+		Repository:   "https://github.com/grpc/grpc",
+		CommitHash:   committish,
+		Query:        query,
+		QueryType:    db.QueryTypeQuery,
+		OutputFormat: db.OutputFormatProto,
+	}
+}
+
+func enqueue(t *testing.T, d db.DB, job *db.QueryJob) string {
+	t.Helper()
+	if err := d.EnqueueJob(context.Background(), job); err != nil {
+		t.Fatalf("EnqueueJob() failed: %v", err)
+	}
+	return job.ID
+}
+
+func dequeue(t *testing.T, d db.DB, workerName string) *db.QueryJob {
+	t.Helper()
+	job, err := d.DequeueJob(context.Background(), &db.Worker{Name: workerName}, time.Now().Add(leaseDuration))
+	if err != nil {
+		t.Fatalf("DequeueJob() failed: %v", err)
+	}
+	return job
+}
+
+func assertStatus(t *testing.T, d db.DB, id string, want string) {
+	t.Helper()
+	job, err := d.GetJob(context.Background(), id)
+	if err != nil {
+		t.Fatalf("GetJob(%q) failed: %v", id, err)
+	}
+	assert.Equal(t, want, job.Status, "status of job %s", id)
+}
+
+func testDedupPending(t *testing.T, d db.DB) {
+	id := enqueue(t, d, newJob("main", "deps(//...)"))
+	assert.Equal(t, id, enqueue(t, d, newJob("main", "deps(//...)")))
+	assertStatus(t, d, id, db.StatusPending)
+
+	// Jobs that differ in any part of the deduplication key are distinct
+	assert.NotEqual(t, id, enqueue(t, d, newJob("main", "deps(//foo/...)")))
+	assert.NotEqual(t, id, enqueue(t, d, newJob("release", "deps(//...)")))
+}
+
+func testDedupRunning(t *testing.T, d db.DB) {
+	id := enqueue(t, d, newJob("main", "deps(//...)"))
+	assert.Equal(t, id, dequeue(t, d, "worker").ID)
+	assert.Equal(t, id, enqueue(t, d, newJob("main", "deps(//...)")))
+	assertStatus(t, d, id, db.StatusRunning)
+}
+
+func testDedupSucceeded(t *testing.T, d db.DB) {
+	ctx := context.Background()
+	for _, committish := range []string{commitHash, "main"} {
+		id := enqueue(t, d, newJob(committish, "deps(//...)"))
+		assert.Equal(t, id, dequeue(t, d, "worker").ID)
+		assert.Nil(t, d.FinishJob(ctx, id, "worker", db.StatusSucceeded, &db.JobResult{URL: "gs://bucket/result"}))
+
+		again := enqueue(t, d, newJob(committish, "deps(//...)"))
+		if db.IsCommitHash(committish) {
+			// A full commit hash always refers to the same commit, so the
+			// result is reused
+			assert.Equal(t, id, again, "job at %s", committish)
+		} else {
+			// A branch may have moved since the job ran
+			assert.NotEqual(t, id, again, "job at %s", committish)
+		}
+	}
+}
+
+func testReenqueueAfterFailure(t *testing.T, d db.DB) {
+	ctx := context.Background()
+	id := enqueue(t, d, newJob(commitHash, "deps(//...)"))
+	assert.Equal(t, id, dequeue(t, d, "worker").ID)
+	assert.Nil(t, d.FinishJob(ctx, id, "worker", db.StatusFailed, &db.JobResult{
+		Error:           "query failed",
+		FailureCategory: db.FailureCategoryQuery,
+	}))
+
+	again := enqueue(t, d, newJob(commitHash, "deps(//...)"))
+	assert.NotEqual(t, id, again)
+	assertStatus(t, d, id, db.StatusFailed)
+	assertStatus(t, d, again, db.StatusPending)
+	// The new job is deduplicated like any other
+	assert.Equal(t, again, enqueue(t, d, newJob(commitHash, "deps(//...)")))
+}
+
+func testReenqueueAfterCancel(t *testing.T, d db.DB) {
+	ctx := context.Background()
+	id := enqueue(t, d, newJob(commitHash, "deps(//...)"))
+	_, err := d.CancelJob(ctx, id)
+	assert.Nil(t, err)
+
+	again := enqueue(t, d, newJob(commitHash, "deps(//...)"))
+	assert.NotEqual(t, id, again)
+	assertStatus(t, d, id, db.StatusCancelled)
+	assertStatus(t, d, again, db.StatusPending)
+}
+
+func testDequeueFIFO(t *testing.T, d db.DB) {
+	var ids []string
+	for i := 0; i < 5; i++ {
+		ids = append(ids, enqueue(t, d, newJob("main", fmt.Sprintf("deps(//%d/...)", i))))
+	}
+	for i, want := range ids {
+		assert.Equal(t, want, dequeue(t, d, "worker").ID, "dequeue %d", i)
+	}
+}
+
+func testQueuePosition(t *testing.T, d db.DB) {
+	ctx := context.Background()
+	// Jobs are queued in quick succession, so some may share a queue time
+	var ids []string
+	for i := 0; i < 3; i++ {
+		ids = append(ids, enqueue(t, d, newJob("main", fmt.Sprintf("deps(//%d/...)", i))))
+	}
+	assertPositions := func(ids []string) {
+		t.Helper()
+		for want, id := range ids {
+			job, err := d.GetJob(ctx, id)
+			if err != nil {
+				t.Fatalf("GetJob(%q) failed: %v", id, err)
+			}
+			pos, err := d.QueuePosition(ctx, job)
+			if assert.Nil(t, err, "QueuePosition(%q)", id) {
+				assert.Equal(t, want, pos, "position of job %s", id)
+			}
+		}
+	}
+	assertPositions(ids)
+
+	// Running jobs don't count towards the position of pending jobs
+	assert.Equal(t, ids[0], dequeue(t, d, "worker").ID)
+	assertPositions(ids[1:])
+}
+
+func testNoOutstandingJobs(t *testing.T, d db.DB) {
+	ctx := context.Background()
+	worker := &db.Worker{Name: "worker"}
+	_, err := d.DequeueJob(ctx, worker, time.Now().Add(leaseDuration))
+	assert.ErrorIs(t, err, db.ErrNoOutstandingJobs, "dequeue from empty DB")
+
+	// Running and finished jobs aren't handed out again
+	running := enqueue(t, d, newJob("main", "deps(//...)"))
+	assert.Equal(t, running, dequeue(t, d, "worker").ID)
+	finished := enqueue(t, d, newJob("main", "deps(//foo/...)"))
+	assert.Equal(t, finished, dequeue(t, d, "worker").ID)
+	assert.Nil(t, d.FinishJob(ctx, finished, "worker", db.StatusSucceeded, &db.JobResult{URL: "gs://bucket/result"}))
+	cancelled := enqueue(t, d, newJob("main", "deps(//bar/...)"))
+	_, err = d.CancelJob(ctx, cancelled)
+	assert.Nil(t, err)
+
+	_, err = d.DequeueJob(ctx, worker, time.Now().Add(leaseDuration))
+	assert.ErrorIs(t, err, db.ErrNoOutstandingJobs, "dequeue with no pending jobs")
+}
+
+func testJobNotFound(t *testing.T, d db.DB) {
+	ctx := context.Background()
+	// Create a job, so that the DB isn't empty
+	enqueue(t, d, newJob("main", "deps(//...)"))
+	const id = "00000000-0000-0000-0000-000000000000"
+
+	_, err := d.GetJob(ctx, id)
+	assert.ErrorIs(t, err, db.ErrJobNotFound, "GetJob")
+	_, err = d.CancelJob(ctx, id)
+	assert.ErrorIs(t, err, db.ErrJobNotFound, "CancelJob")
+	err = d.FinishJob(ctx, id, "worker", db.StatusSucceeded, &db.JobResult{URL: "gs://bucket/result"})
+	assert.ErrorIs(t, err, db.ErrJobNotFound, "FinishJob")
+}
+
+func testFinishInvalidStatus(t *testing.T, d db.DB) {
+	ctx := context.Background()
+	id := enqueue(t, d, newJob("main", "deps(//...)"))
+	assert.Equal(t, id, dequeue(t, d, "worker").ID)
+
+	for _, status := range []string{db.StatusPending, db.StatusRunning, db.StatusCancelled, "bogus", ""} {
+		err := d.FinishJob(ctx, id, "worker", status, &db.JobResult{URL: "gs://bucket/result"})
+		assert.Error(t, err, "FinishJob with status %q", status)
+	}
+	assertStatus(t, d, id, db.StatusRunning)
+}
+
+func testFinishResolvedCommit(t *testing.T, d db.DB) {
+	ctx := context.Background()
+	unresolved := enqueue(t, d, newJob("main", "deps(//...)"))
+	resolved := enqueue(t, d, newJob("release", "deps(//...)"))
+	assert.Equal(t, unresolved, dequeue(t, d, "worker").ID)
+	assert.Equal(t, resolved, dequeue(t, d, "worker").ID)
+
+	// An empty resolved commit isn't recorded
+	assert.Nil(t, d.FinishJob(ctx, unresolved, "worker", db.StatusSucceeded, &db.JobResult{URL: "gs://bucket/result"}))
+	job, err := d.GetJob(ctx, unresolved)
+	if err != nil {
+		t.Fatalf("GetJob(%q) failed: %v", unresolved, err)
+	}
+	assert.Nil(t, job.ResolvedCommitHash)
+
+	// Failed jobs record the commit they resolved to as well
+	assert.Nil(t, d.FinishJob(ctx, resolved, "worker", db.StatusFailed, &db.JobResult{Error: "query failed", ResolvedCommitHash: commitHash}))
+	job, err = d.GetJob(ctx, resolved)
+	if err != nil {
+		t.Fatalf("GetJob(%q) failed: %v", resolved, err)
+	}
+	if assert.NotNil(t, job.ResolvedCommitHash) {
+		assert.Equal(t, commitHash, *job.ResolvedCommitHash)
+	}
+}
+
+func testFinishLeaseExpired(t *testing.T, d db.DB) {
+	ctx := context.Background()
+	id := enqueue(t, d, newJob("main", "deps(//...)"))
+	assert.Equal(t, id, dequeue(t, d, "worker").ID)
+
+	// Only the worker running the job can finish or retry it
+	err := d.FinishJob(ctx, id, "other-worker", db.StatusSucceeded, &db.JobResult{URL: "gs://bucket/other"})
+	assert.ErrorIs(t, err, db.ErrLeaseExpired, "FinishJob by another worker")
+	err = d.RetryJob(ctx, id, "other-worker", time.Now(), &db.JobResult{Error: "failed to fetch"})
+	assert.ErrorIs(t, err, db.ErrLeaseExpired, "RetryJob by another worker")
+	assertStatus(t, d, id, db.StatusRunning)
+
+	// A finished job can't be finished again
+	assert.Nil(t, d.FinishJob(ctx, id, "worker", db.StatusSucceeded, &db.JobResult{URL: "gs://bucket/result"}))
+	err = d.FinishJob(ctx, id, "worker", db.StatusFailed, &db.JobResult{Error: "query failed"})
+	assert.ErrorIs(t, err, db.ErrLeaseExpired, "FinishJob of finished job")
+	job, err := d.GetJob(ctx, id)
+	if err != nil {
+		t.Fatalf("GetJob(%q) failed: %v", id, err)
+	}
+	assert.Equal(t, db.StatusSucceeded, job.Status)
+	if assert.NotNil(t, job.ResultURL) {
+		assert.Equal(t, "gs://bucket/result", *job.ResultURL)
+	}
+}
+
+func testConcurrentDequeue(t *testing.T, d db.DB) {
+	const (
+		numJobs    = 50
+		numWorkers = 10
+	)
+	for i := 0; i < numJobs; i++ {
+		enqueue(t, d, newJob("main", fmt.Sprintf("deps(//%d/...)", i)))
+	}
+
+	// Workers dequeue until no jobs are left. Each job must be handed to
+	// exactly one worker.
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		owner = map[string]string{}
+	)
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func(workerName string) {
+			defer wg.Done()
+			worker := &db.Worker{Name: workerName}
+			for {
+				job, err := d.DequeueJob(context.Background(), worker, time.Now().Add(leaseDuration))
+				if errors.Is(err, db.ErrNoOutstandingJobs) {
+					return
+				}
+				if !assert.Nil(t, err, "dequeue by %s", workerName) {
+					return
+				}
+				mu.Lock()
+				if prev, ok := owner[job.ID]; ok {
+					t.Errorf("job %s dequeued by both %s and %s", job.ID, prev, workerName)
+				}
+				owner[job.ID] = workerName
+				mu.Unlock()
+			}
+		}(fmt.Sprintf("worker-%d", w))
+	}
+	wg.Wait()
+	assert.Len(t, owner, numJobs)
+}
@@ -22,7 +22,8 @@ const (
 var errTooMuchContention = status.Errorf(codes.Aborted, "too much contention on these datastore entities. please try again.")
 
 type DB struct {
-	client *datastore.Client
+	client   *datastore.Client
+	watchers db.Watchers
 }
 
 func New(ctx context.Context, projectName string) (*DB, error) {
@@ -40,66 +41,126 @@ func (d *DB) Close() error {
 }
 
 func (d *DB) EnqueueJob(ctx context.Context, job *db.QueryJob) error {
+	var queued bool
 	_, err := d.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
-		q := datastore.NewQuery(typeQueryJob)
-		q = q.Filter("repository =", job.Repository)
-		q = q.Filter("commit_hash =", job.CommitHash)
-		q = q.Filter("query_string =", job.Query)
-		iter := d.client.Run(ctx, q)
-
-		var iterJob db.QueryJob
-		var err error
-		for _, err = iter.Next(&iterJob); err == nil; _, err = iter.Next(&iterJob) {
-			if iterJob.Status != db.StatusFailed {
-				// Job is either
-				// * successful, and is cacheable
-				// * in progress, and we want to dedupe this request
-				*job = iterJob
+		// A job matches either by the commit it was queued with, or by the
+		// commit it resolved to. Datastore doesn't support OR filters, so
+		// each is a separate query.
+		commitFields := []string{"commit_hash"}
+		if db.IsCommitHash(job.CommitHash) {
+			commitFields = append(commitFields, "resolved_commit_hash")
+		}
+		for _, field := range commitFields {
+			q := datastore.NewQuery(typeQueryJob)
+			q = q.Filter("repository =", job.Repository)
+			q = q.Filter(field+" =", job.CommitHash)
+			q = q.Filter("query_string =", job.Query)
+			q = q.Filter("query_type =", job.QueryType)
+			q = q.Filter("output_format =", job.OutputFormat)
+			existing, err := d.findDuplicate(ctx, q, job)
+			if err != nil {
+				return err
+			}
+			if existing != nil {
+				*job = *existing
 				return nil
 			}
 		}
-		// Either iteration is finished or failed
-		if !errors.Is(err, iterator.Done) {
-			return fmt.Errorf("failed while searching for matching existing queries: %w", err)
-		}
 		// Successfully scanned but found no matching cacheable jobs; add a new
 		// entry
 		id, err := uuid.NewRandom()
 		if err != nil {
 			return fmt.Errorf("failed to create UUID for query: %w", err)
 		}
-		job = &db.QueryJob{
-			ID:         id.String(),
-			Repository: job.Repository,
-			CommitHash: job.CommitHash,
-			Query:      job.Query,
-			Status:     db.StatusPending,
-			QueueTime:  time.Now().UTC(),
+		*job = db.QueryJob{
+			ID:             id.String(),
+			Repository:     job.Repository,
+			CommitHash:     job.CommitHash,
+			Query:          job.Query,
+			QueryType:      job.QueryType,
+			BazelFlags:     job.BazelFlags,
+			OutputFormat:   job.OutputFormat,
+			RequiredLabels: job.RequiredLabels,
+			Status:         db.StatusPending,
+			QueueTime:      time.Now().UTC(),
 		}
 		_, err = tx.Put(datastore.IncompleteKey(typeQueryJob, nil), job)
 		if err != nil {
 			return fmt.Errorf("failed to queue query: %w", err)
 		}
+		queued = true
 		return nil
 	})
 	if err != nil {
 		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
+	if queued {
+		d.watchers.Notify(job)
+	}
 	return nil
 }
 
-func (d *DB) attemptDequeueTx(ctx context.Context, workerName string) (*db.QueryJob, error) {
+// findDuplicate returns the first job returned by q that job should be
+// deduplicated against, or nil if there is none.
+func (d *DB) findDuplicate(ctx context.Context, q *datastore.Query, job *db.QueryJob) (*db.QueryJob, error) {
+	iter := d.client.Run(ctx, q)
+	for {
+		var iterJob db.QueryJob
+		_, err := iter.Next(&iterJob)
+		if errors.Is(err, iterator.Done) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed while searching for matching existing queries: %w", err)
+		}
+		// Flags and labels aren't indexed, so they have to be compared here
+		if !equalFlags(iterJob.BazelFlags, job.BazelFlags) || !equalFlags(iterJob.RequiredLabels, job.RequiredLabels) {
+			continue
+		}
+		switch iterJob.Status {
+		case db.StatusFailed, db.StatusCancelled:
+			continue
+		case db.StatusSucceeded:
+			// Successful jobs are only cacheable if the commit they were
+			// requested at can't move
+			if !db.IsCommitHash(job.CommitHash) {
+				continue
+			}
+		}
+		return &iterJob, nil
+	}
+}
+
+func (d *DB) attemptDequeueTx(ctx context.Context, worker *db.Worker, leaseExpiry time.Time) (*db.QueryJob, error) {
 	var retJob db.QueryJob
 
 	_, err := d.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		now := time.Now().UTC()
 		q := datastore.NewQuery(typeQueryJob)
 		q = q.Filter("status =", db.StatusPending)
 		q = q.Order("queue_time") // Ascending is the default
 		iter := d.client.Run(ctx, q)
 
+		// Jobs are filtered on the query results, so that only the job that is
+		// dequeued is read in the transaction. Jobs that are skipped are
+		// neither contended nor counted towards the transaction's entity
+		// limit.
 		var err error
 		var key *datastore.Key
-		for key, err = iter.Next(nil); err == nil; key, err = iter.Next(nil) {
+		for {
+			var candidate db.QueryJob
+			key, err = iter.Next(&candidate)
+			if err != nil {
+				break
+			}
+			// Skip jobs waiting to be retried, and jobs the worker can't run.
+			// Neither can be expressed as a datastore filter.
+			if !canDequeue(&candidate, worker, now) {
+				continue
+			}
+
+			// Skipped jobs mustn't leak fields into the next one
+			retJob = db.QueryJob{}
 			queryErr := tx.Get(key, &retJob)
 			if queryErr != nil {
 				// Alias any errors about contention to
@@ -117,7 +178,7 @@ func (d *DB) attemptDequeueTx(ctx context.Context, workerName string) (*db.Query
 			// transaction - it's possible that a dequeue operation has already
 			// marked this as running. Performing this Get does happen within
 			// the transaction, so it should be "locked" after this point.
-			if retJob.Status == db.StatusPending {
+			if retJob.Status == db.StatusPending && canDequeue(&retJob, worker, now) {
 				break
 			}
 		}
@@ -127,9 +188,13 @@ func (d *DB) attemptDequeueTx(ctx context.Context, workerName string) (*db.Query
 			return db.ErrNoOutstandingJobs
 		}
 		retJob.Status = db.StatusRunning
-		retJob.Worker = &workerName
-		now := time.Now().UTC()
+		retJob.Worker = &worker.Name
 		retJob.StartTime = &now
+		retJob.RetryTime = nil
+		retJob.Phase = ""
+		leaseExpiry = leaseExpiry.UTC()
+		retJob.LeaseExpiry = &leaseExpiry
+		retJob.Attempts++
 
 		_, err = tx.Put(key, &retJob)
 		if err != nil {
@@ -142,12 +207,18 @@ func (d *DB) attemptDequeueTx(ctx context.Context, workerName string) (*db.Query
 	} else if err != nil {
 		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
+	d.watchers.Notify(&retJob)
 	return &retJob, nil
 }
 
-func (d *DB) DequeueJob(ctx context.Context, workerName string) (*db.QueryJob, error) {
+// canDequeue returns whether a pending job may be given to worker at now.
+func canDequeue(job *db.QueryJob, worker *db.Worker, now time.Time) bool {
+	return (job.RetryTime == nil || !job.RetryTime.After(now)) && worker.CanRun(job)
+}
+
+func (d *DB) DequeueJob(ctx context.Context, worker *db.Worker, leaseExpiry time.Time) (*db.QueryJob, error) {
 	for {
-		job, err := d.attemptDequeueTx(ctx, workerName)
+		job, err := d.attemptDequeueTx(ctx, worker, leaseExpiry)
 		if err != nil && errors.Is(err, datastore.ErrConcurrentTransaction) {
 			continue
 		}
@@ -161,18 +232,96 @@ func (d *DB) GetJob(ctx context.Context, id string) (*db.QueryJob, error) {
 	iter := d.client.Run(ctx, q)
 
 	key, err := singleKeyFromIter(iter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query datastore by QueryJob.id: %w", err)
+	} else if key == nil {
+		return nil, fmt.Errorf("job %s: %w", id, db.ErrJobNotFound)
+	}
 	var job db.QueryJob
 	if err := d.client.Get(ctx, key, &job); err != nil {
 		return nil, err
 	}
-	if err != nil {
-		return nil, fmt.Errorf("failed to query datastore by QueryJob.id: %w", err)
-	}
 
 	return &job, nil
 }
 
-func (d *DB) FinishJob(ctx context.Context, id string, status string, result string) error {
+func (d *DB) ListJobs(ctx context.Context, filter *db.ListJobsFilter, pageSize int, pageToken string) ([]*db.QueryJob, string, error) {
+	q := datastore.NewQuery(typeQueryJob)
+	if filter.Repository != "" {
+		q = q.Filter("repository =", filter.Repository)
+	}
+	if filter.Status != "" {
+		q = q.Filter("status =", filter.Status)
+	}
+	if filter.Worker != "" {
+		q = q.Filter("worker =", filter.Worker)
+	}
+	if !filter.QueuedAfter.IsZero() {
+		q = q.Filter("queue_time >=", filter.QueuedAfter.UTC())
+	}
+	if !filter.QueuedBefore.IsZero() {
+		q = q.Filter("queue_time <", filter.QueuedBefore.UTC())
+	}
+	q = q.Order("-queue_time")
+	if pageToken != "" {
+		cursor, err := datastore.DecodeCursor(pageToken)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: %v", db.ErrInvalidPageToken, err)
+		}
+		q = q.Start(cursor)
+	}
+	// A job matches CommitHash either by the commit it was queued with or by the
+	// commit it resolved to. Datastore doesn't support OR filters, so jobs are
+	// matched below instead, and the query can't be limited to one page.
+	if filter.CommitHash == "" {
+		// Fetch one extra entity to find out whether there is another page
+		q = q.Limit(pageSize + 1)
+	}
+	iter := d.client.Run(ctx, q)
+
+	var (
+		jobs   []*db.QueryJob
+		cursor datastore.Cursor
+	)
+	for {
+		var job db.QueryJob
+		_, err := iter.Next(&job)
+		if errors.Is(err, iterator.Done) {
+			return jobs, "", nil
+		} else if err != nil {
+			return nil, "", fmt.Errorf("failed to list jobs: %w", err)
+		}
+		if filter.CommitHash != "" && job.CommitHash != filter.CommitHash && (job.ResolvedCommitHash == nil || *job.ResolvedCommitHash != filter.CommitHash) {
+			continue
+		}
+		if len(jobs) == pageSize {
+			// There is at least one more job; the next page starts right after
+			// the last job of this page.
+			return jobs, cursor.String(), nil
+		}
+		jobs = append(jobs, &job)
+		if len(jobs) == pageSize {
+			cursor, err = iter.Cursor()
+			if err != nil {
+				return nil, "", fmt.Errorf("failed to get cursor for next page: %w", err)
+			}
+		}
+	}
+}
+
+func (d *DB) QueuePosition(ctx context.Context, job *db.QueryJob) (int, error) {
+	q := datastore.NewQuery(typeQueryJob)
+	q = q.Filter("status =", db.StatusPending)
+	q = q.Filter("queue_time <", job.QueueTime.UTC())
+	pos, err := d.client.Count(ctx, q)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count jobs queued before %s: %w", job.ID, err)
+	}
+	return pos, nil
+}
+
+func (d *DB) FinishJob(ctx context.Context, id string, workerName string, status string, result *db.JobResult) error {
+	var job db.QueryJob
 	_, err := d.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
 		q := datastore.NewQuery(typeQueryJob)
 		q = q.Filter("id =", id)
@@ -180,24 +329,45 @@ func (d *DB) FinishJob(ctx context.Context, id string, status string, result str
 		key, err := singleKeyFromIter(iter)
 		if err != nil {
 			return fmt.Errorf("failed to query datastore by QueryJob.id %q: %w", id, err)
+		} else if key == nil {
+			return fmt.Errorf("job %s: %w", id, db.ErrJobNotFound)
 		}
 
-		var job db.QueryJob
 		if err := tx.Get(key, &job); err != nil {
 			return err
 		}
+		if job.Status == db.StatusCancelled {
+			return fmt.Errorf("can't finish job %s: %w", id, db.ErrJobCancelled)
+		}
+		if job.Status != db.StatusRunning || job.Worker == nil || *job.Worker != workerName {
+			return fmt.Errorf("job %s is no longer running on worker %q: %w", id, workerName, db.ErrLeaseExpired)
+		}
 
 		now := time.Now().UTC()
 		job.FinishTime = &now
 		job.Status = status
 		switch status {
 		case db.StatusSucceeded:
-			job.ResultURL = &result
+			job.ResultURL = nil
+			if result.URL != "" {
+				job.ResultURL = &result.URL
+			}
+			job.ResultInline = result.Inline
+			job.ResultMetadata = result.Metadata
+			job.ResultSHA256 = result.SHA256
+			job.ResultSize = result.Size
+			job.ResultEncoding = result.Encoding
 		case db.StatusFailed:
-			job.ResultError = &result
+			job.ResultError = &result.Error
+			job.FailureCategory = result.FailureCategory
+			job.ExitCode = result.ExitCode
+			job.Stderr = result.Stderr
 		default:
 			return fmt.Errorf("can't finish job using status %q", status)
 		}
+		if result.ResolvedCommitHash != "" {
+			job.ResolvedCommitHash = &result.ResolvedCommitHash
+		}
 
 		_, err = tx.Put(key, &job)
 		if err != nil {
@@ -208,9 +378,241 @@ func (d *DB) FinishJob(ctx context.Context, id string, status string, result str
 	if err != nil {
 		return fmt.Errorf("failed to mark job %s as done: %w", id, err)
 	}
+	d.watchers.Notify(&job)
+	return nil
+}
+
+func (d *DB) RetryJob(ctx context.Context, id string, workerName string, retryTime time.Time, result *db.JobResult) error {
+	var job db.QueryJob
+	_, err := d.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		q := datastore.NewQuery(typeQueryJob)
+		q = q.Filter("id =", id)
+		iter := d.client.Run(ctx, q)
+		key, err := singleKeyFromIter(iter)
+		if err != nil {
+			return fmt.Errorf("failed to query datastore by QueryJob.id %q: %w", id, err)
+		} else if key == nil {
+			return fmt.Errorf("job %s: %w", id, db.ErrJobNotFound)
+		}
+
+		if err := tx.Get(key, &job); err != nil {
+			return err
+		}
+		if job.Status == db.StatusCancelled {
+			return fmt.Errorf("can't retry job %s: %w", id, db.ErrJobCancelled)
+		}
+		if job.Status != db.StatusRunning || job.Worker == nil || *job.Worker != workerName {
+			return fmt.Errorf("job %s is no longer running on worker %q: %w", id, workerName, db.ErrLeaseExpired)
+		}
+
+		retryTime = retryTime.UTC()
+		job.Status = db.StatusPending
+		job.Worker = nil
+		job.StartTime = nil
+		job.LeaseExpiry = nil
+		job.ResultError = &result.Error
+		job.FailureCategory = result.FailureCategory
+		job.ExitCode = result.ExitCode
+		job.Stderr = result.Stderr
+		job.RetryTime = &retryTime
+		job.Retries++
+
+		_, err = tx.Put(key, &job)
+		if err != nil {
+			return fmt.Errorf("failed to requeue job %s for retry: %w", id, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to requeue job %s for retry: %w", id, err)
+	}
+	d.watchers.Notify(&job)
+	return nil
+}
+
+func (d *DB) CancelJob(ctx context.Context, id string) (*db.QueryJob, error) {
+	var job db.QueryJob
+	_, err := d.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		q := datastore.NewQuery(typeQueryJob)
+		q = q.Filter("id =", id)
+		iter := d.client.Run(ctx, q)
+		key, err := singleKeyFromIter(iter)
+		if err != nil {
+			return fmt.Errorf("failed to query datastore by QueryJob.id %q: %w", id, err)
+		} else if key == nil {
+			return fmt.Errorf("job %s: %w", id, db.ErrJobNotFound)
+		}
+
+		if err := tx.Get(key, &job); err != nil {
+			return err
+		}
+		if job.Status != db.StatusPending && job.Status != db.StatusRunning {
+			return fmt.Errorf("can't cancel job %s with status %q: %w", id, job.Status, db.ErrJobFinished)
+		}
+
+		now := time.Now().UTC()
+		job.FinishTime = &now
+		job.Status = db.StatusCancelled
+
+		_, err = tx.Put(key, &job)
+		if err != nil {
+			return fmt.Errorf("failed to mark job %s as cancelled: %w", id, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel job %s: %w", id, err)
+	}
+	d.watchers.Notify(&job)
+	return &job, nil
+}
+
+func (d *DB) RenewLease(ctx context.Context, id string, workerName string, leaseExpiry time.Time) (*db.QueryJob, error) {
+	var job db.QueryJob
+	_, err := d.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		q := datastore.NewQuery(typeQueryJob)
+		q = q.Filter("id =", id)
+		iter := d.client.Run(ctx, q)
+		key, err := singleKeyFromIter(iter)
+		if err != nil {
+			return fmt.Errorf("failed to query datastore by QueryJob.id %q: %w", id, err)
+		} else if key == nil {
+			return fmt.Errorf("job %s: %w", id, db.ErrJobNotFound)
+		}
+
+		if err := tx.Get(key, &job); err != nil {
+			return err
+		}
+		if job.Status == db.StatusCancelled {
+			return fmt.Errorf("can't renew lease on job %s: %w", id, db.ErrJobCancelled)
+		}
+		if job.Status != db.StatusRunning || job.Worker == nil || *job.Worker != workerName {
+			return fmt.Errorf("job %s is no longer running on worker %q: %w", id, workerName, db.ErrLeaseExpired)
+		}
+
+		leaseExpiry = leaseExpiry.UTC()
+		job.LeaseExpiry = &leaseExpiry
+
+		_, err = tx.Put(key, &job)
+		if err != nil {
+			return fmt.Errorf("failed to renew lease on job %s: %w", id, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to renew lease on job %s: %w", id, err)
+	}
+	return &job, nil
+}
+
+func (d *DB) RequeueExpiredJobs(ctx context.Context, now time.Time, maxAttempts int) (int, error) {
+	q := datastore.NewQuery(typeQueryJob)
+	q = q.Filter("status =", db.StatusRunning)
+	q = q.Filter("lease_expiry <", now.UTC())
+	q = q.KeysOnly()
+	keys, err := d.client.GetAll(ctx, q, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query for expired jobs: %w", err)
+	}
+
+	requeued := 0
+	for _, key := range keys {
+		var (
+			job     db.QueryJob
+			expired bool
+		)
+		_, err := d.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			if err := tx.Get(key, &job); err != nil {
+				return err
+			}
+			// Double-check the condition, since the query happened outside
+			// the transaction - the lease may have been renewed since.
+			expired = job.Status == db.StatusRunning && job.LeaseExpiry != nil && job.LeaseExpiry.Before(now)
+			if !expired {
+				return nil
+			}
+			if job.Attempts-job.Retries >= maxAttempts {
+				msg := fmt.Sprintf("job abandoned by workers %d times", job.Attempts-job.Retries)
+				finishTime := now.UTC()
+				job.Status = db.StatusFailed
+				job.ResultError = &msg
+				job.FailureCategory = db.FailureCategoryInfrastructure
+				job.FinishTime = &finishTime
+			} else {
+				job.Status = db.StatusPending
+				job.Worker = nil
+				job.StartTime = nil
+			}
+			job.LeaseExpiry = nil
+
+			_, err := tx.Put(key, &job)
+			return err
+		})
+		if err != nil {
+			return requeued, fmt.Errorf("failed to requeue job %v: %w", key, err)
+		}
+		if expired {
+			requeued++
+			d.watchers.Notify(&job)
+		}
+	}
+	return requeued, nil
+}
+
+func (d *DB) SetJobPhase(ctx context.Context, id string, workerName string, phase string) error {
+	var job db.QueryJob
+	_, err := d.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		q := datastore.NewQuery(typeQueryJob)
+		q = q.Filter("id =", id)
+		iter := d.client.Run(ctx, q)
+		key, err := singleKeyFromIter(iter)
+		if err != nil {
+			return fmt.Errorf("failed to query datastore by QueryJob.id %q: %w", id, err)
+		} else if key == nil {
+			return fmt.Errorf("job %s: %w", id, db.ErrJobNotFound)
+		}
+
+		if err := tx.Get(key, &job); err != nil {
+			return err
+		}
+		if job.Status == db.StatusCancelled {
+			return fmt.Errorf("can't set phase of job %s: %w", id, db.ErrJobCancelled)
+		}
+		if job.Status != db.StatusRunning || job.Worker == nil || *job.Worker != workerName {
+			return fmt.Errorf("job %s is no longer running on worker %q: %w", id, workerName, db.ErrLeaseExpired)
+		}
+
+		job.Phase = phase
+
+		_, err = tx.Put(key, &job)
+		if err != nil {
+			return fmt.Errorf("failed to set phase of job %s: %w", id, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set phase of job %s: %w", id, err)
+	}
+	d.watchers.Notify(&job)
 	return nil
 }
 
+func (d *DB) WatchJob(id string) (<-chan *db.QueryJob, func()) {
+	return d.watchers.Watch(id)
+}
+
+func equalFlags(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func singleKeyFromIter(iter *datastore.Iterator) (*datastore.Key, error) {
 	key, err := iter.Next(nil)
 	if err != nil && !errors.Is(err, iterator.Done) {
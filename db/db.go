@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"io"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -12,52 +14,359 @@ const (
 	StatusRunning   = "running"
 	StatusSucceeded = "succeeded"
 	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
 )
 
+const (
+	QueryTypeQuery  = "query"
+	QueryTypeCquery = "cquery"
+	QueryTypeAquery = "aquery"
+)
+
+// Output formats are named after the corresponding value of Bazel's --output
+// flag.
+const (
+	OutputFormatProto             = "proto"
+	OutputFormatLabel             = "label"
+	OutputFormatLabelKind         = "label_kind"
+	OutputFormatXML               = "xml"
+	OutputFormatGraph             = "graph"
+	OutputFormatStreamedJSONProto = "streamed_jsonproto"
+)
+
+// Failure categories distinguish failures caused by the query itself, which
+// would fail the same way if retried, from failures of the infrastructure
+// running it, which may succeed if retried.
+const (
+	FailureCategoryQuery          = "query"
+	FailureCategoryInfrastructure = "infrastructure"
+)
+
+// Encodings of stored query results. Results stored uncompressed have an
+// empty encoding.
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// Phases of a running job, as reported by the worker running it.
+const (
+	PhaseFetch    = "fetch"
+	PhaseCheckout = "checkout"
+	PhaseQuery    = "query"
+	PhaseUpload   = "upload"
+)
+
+// MaxInlineResultSize is the largest query output, in bytes, that may be
+// stored in the DB instead of the result store. It keeps jobs well within
+// Datastore's entity size limit.
+const MaxInlineResultSize = 512 << 10
+
 var (
 	ErrNoOutstandingJobs = errors.New("no pending jobs")
 	ErrJobNotFound       = errors.New("job not found")
+	ErrJobFinished       = errors.New("job already finished")
+	ErrJobCancelled      = errors.New("job cancelled")
+	ErrInvalidPageToken  = errors.New("invalid page token")
+	ErrLeaseExpired      = errors.New("job lease expired")
 )
 
 type QueryJob struct {
-	Repository  string     `datastore:"repository"`
-	CommitHash  string     `datastore:"commit_hash"`
-	Query       string     `datastore:"query_string"`
-	ID          string     `datastore:"id"`
-	Status      string     `datastore:"status"`
-	Worker      *string    `datastore:"worker"`
-	QueueTime   time.Time  `datastore:"queue_time"`
-	StartTime   *time.Time `datastore:"start_time"`
-	FinishTime  *time.Time `datastore:"finish_time"`
-	ResultURL   *string    `datastore:"result_url"`
-	ResultError *string    `datastore:"result_error"`
+	Repository         string     `datastore:"repository"`
+	CommitHash         string     `datastore:"commit_hash"`
+	ResolvedCommitHash *string    `datastore:"resolved_commit_hash"`
+	Query              string     `datastore:"query_string"`
+	QueryType          string     `datastore:"query_type"`
+	BazelFlags         []string   `datastore:"bazel_flags,noindex"`
+	OutputFormat       string     `datastore:"output_format"`
+	RequiredLabels     []string   `datastore:"required_labels,noindex"`
+	ID                 string     `datastore:"id"`
+	Status             string     `datastore:"status"`
+	Worker             *string    `datastore:"worker"`
+	QueueTime          time.Time  `datastore:"queue_time"`
+	StartTime          *time.Time `datastore:"start_time"`
+	FinishTime         *time.Time `datastore:"finish_time"`
+	ResultURL          *string    `datastore:"result_url"`
+	ResultError        *string    `datastore:"result_error"`
+
+	// Hex SHA-256 digest and size of the stored query output, and how it is
+	// encoded, if the job succeeded
+	ResultSHA256   string `datastore:"result_sha256,noindex"`
+	ResultSize     int64  `datastore:"result_size,noindex"`
+	ResultEncoding string `datastore:"result_encoding,noindex"`
+
+	// ResultInline holds the query output of a succeeded job whose result was
+	// small enough to be stored in the DB, in which case ResultURL is nil.
+	ResultInline []byte `datastore:"result_inline,noindex"`
+
+	// ResultMetadata describes how the query output of a succeeded job was
+	// produced, as reported by the worker that ran it.
+	ResultMetadata ResultMetadata `datastore:"result_metadata,noindex"`
+
+	// LeaseExpiry is the time by which the worker running the job must renew
+	// its lease, or else the job is considered abandoned.
+	LeaseExpiry *time.Time `datastore:"lease_expiry"`
+
+	// Attempts is the number of times the job has been dequeued.
+	Attempts int `datastore:"attempts"`
+
+	// Retries is the number of times the job has been retried after an
+	// infrastructure failure, i.e. the number of calls to RetryJob. Unlike
+	// Attempts, it doesn't count attempts abandoned by their worker.
+	Retries int `datastore:"retries"`
+
+	// Details of the job's most recent failure, if any. These are kept when
+	// a job is retried after a failure.
+	FailureCategory string `datastore:"failure_category"`
+	ExitCode        int    `datastore:"exit_code,noindex"`
+	Stderr          string `datastore:"stderr,noindex"`
+
+	// RetryTime is the earliest time at which a job that is pending after a
+	// failure may be dequeued again.
+	RetryTime *time.Time `datastore:"retry_time"`
+
+	// Phase is the phase the job was last reported to be in by the worker
+	// running it. It is cleared whenever the job is dequeued.
+	Phase string `datastore:"phase,noindex"`
+}
+
+// ResultMetadata describes how a job's query output was produced. The commit
+// it was produced at is QueryJob.ResolvedCommitHash.
+type ResultMetadata struct {
+	BazelVersion string   `datastore:"bazel_version,noindex"`
+	BazelFlags   []string `datastore:"bazel_flags,noindex"`
+
+	// Number of targets in the output, if the worker could count them
+	TargetCount int64 `datastore:"target_count,noindex"`
+
+	// Size of the output before compression
+	Size int64 `datastore:"size,noindex"`
+
+	// Time the worker spent in each phase of the job
+	FetchDuration    time.Duration `datastore:"fetch_duration,noindex"`
+	CheckoutDuration time.Duration `datastore:"checkout_duration,noindex"`
+	QueryDuration    time.Duration `datastore:"query_duration,noindex"`
+	UploadDuration   time.Duration `datastore:"upload_duration,noindex"`
+}
+
+// JobResult describes the outcome of a job, as reported by the worker that ran
+// it.
+type JobResult struct {
+	// URL, hex SHA-256 digest, size and encoding of the stored query output,
+	// if the job succeeded
+	URL      string
+	SHA256   string
+	Size     int64
+	Encoding string
+
+	// Query output to store in the DB instead of at URL, if the job succeeded
+	// and its output is at most MaxInlineResultSize bytes
+	Inline []byte
+
+	// How the query output was produced, if the job succeeded
+	Metadata ResultMetadata
+
+	// Error message, if the job failed
+	Error string
+
+	// Full hash of the commit the job ran at, if known
+	ResolvedCommitHash string
+
+	// Details of the failure, if the job failed
+	FailureCategory string
+	ExitCode        int
+	Stderr          string
+}
+
+// IsCommitHash returns whether committish is a full commit hash, as opposed to
+// e.g. a branch name or an abbreviated hash. Only full commit hashes are
+// guaranteed to always refer to the same commit.
+func IsCommitHash(committish string) bool {
+	if len(committish) != 40 {
+		return false
+	}
+	for _, c := range committish {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Worker describes a worker asking for a job, and which jobs it is able to
+// run.
+type Worker struct {
+	Name string
+
+	// Repositories the worker can run queries in. If empty, the worker may be
+	// given jobs for any repository.
+	Repositories []string
+
+	// Labels describing the worker's environment, e.g. its Bazel version. Jobs
+	// are only given to workers that have all of their RequiredLabels.
+	Labels map[string]string
+}
+
+// CanRun returns whether job may be assigned to w.
+func (w *Worker) CanRun(job *QueryJob) bool {
+	if len(w.Repositories) > 0 {
+		found := false
+		for _, r := range w.Repositories {
+			if r == job.Repository {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for k, v := range LabelMap(job.RequiredLabels) {
+		if got, ok := w.Labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// LabelList converts labels to the form stored in QueryJob.RequiredLabels: a
+// sorted list of "key=value" strings. Returns nil if labels is empty.
+func LabelList(labels map[string]string) []string {
+	if len(labels) == 0 {
+		return nil
+	}
+	var list []string
+	for k, v := range labels {
+		list = append(list, k+"="+v)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// LabelMap is the inverse of LabelList.
+func LabelMap(list []string) map[string]string {
+	labels := map[string]string{}
+	for _, l := range list {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) == 2 {
+			labels[kv[0]] = kv[1]
+		} else {
+			labels[kv[0]] = ""
+		}
+	}
+	return labels
+}
+
+// ListJobsFilter restricts which jobs are returned by ListJobs. Fields left at
+// their zero value don't restrict the results.
+type ListJobsFilter struct {
+	Repository string
+	// CommitHash matches jobs either by the commit they were queued with or by
+	// the commit they resolved to, as deduplication does.
+	CommitHash string
+	Status     string
+	Worker     string
+
+	// Only jobs queued at or after QueuedAfter and strictly before
+	// QueuedBefore are returned.
+	QueuedAfter  time.Time
+	QueuedBefore time.Time
 }
 
 // The invariants of the DB are:
-// * There should be only one (repository, commit, query) tuple in the
-//   non-failed state (either queued or running or succeeded) at any point in
-//   time
-// * There can be multiple (repository, commit, query) tuples in the failed
-//   state
+// * There should be only one (repository, commit, query, query type, flags,
+//   output format, required labels) tuple in the non-failed state (either
+//   queued or running or succeeded) at any point in time
+// * There can be multiple (repository, commit, query, query type, flags,
+//   output format, required labels) tuples in the failed state
+// * Cancelled jobs are treated the same as failed jobs
+// * A commit is matched either by the commit a job was queued with, or by the
+//   commit it resolved to when it ran
+// * Jobs whose commit isn't a full commit hash (e.g. a branch name) are only
+//   deduplicated while pending or running, since the commit they refer to may
+//   change over time
+// * A running job whose lease has expired is moved back to pending, or to
+//   failed once it has been attempted too many times
 type DB interface {
 	// EnqueueJob enqueues a query to be run in a specific repository at a
 	// specific point in the commit history.
 	//
-	// Input QueryJob must have the Repository, CommitHash, Query fields
-	// populated.
+	// Input QueryJob must have the Repository, CommitHash, Query, QueryType,
+	// OutputFormat fields populated. BazelFlags and RequiredLabels (as
+	// returned by LabelList) may optionally be populated.
 	//
 	// On exit, QueryJob has the ID and QueueTime fields populated.
 	//
-	// If there is an existing non-failed job with the same Repository, CommitHash, and
-	// Query, enqueue requests should deduplicate to the same request ID; failed
-	// jobs are ignored for the purposes of this deduplication.
+	// If there is an existing non-failed job with the same Repository,
+	// CommitHash, Query, QueryType, BazelFlags (in the same order),
+	// OutputFormat, and RequiredLabels, enqueue requests should deduplicate to
+	// the same request ID; failed and cancelled jobs are ignored for the
+	// purposes of this deduplication.
 	EnqueueJob(context.Context, *QueryJob) error
 
-	DequeueJob(ctx context.Context, workerName string) (*QueryJob, error)
+	// DequeueJob assigns the oldest pending job that worker can run to worker,
+	// and leases it to worker until leaseExpiry. Increments the job's attempt
+	// counter. Jobs whose RetryTime is in the future are skipped.
+	DequeueJob(ctx context.Context, worker *Worker, leaseExpiry time.Time) (*QueryJob, error)
+
+	// RenewLease extends the lease that workerName holds on a running job until
+	// leaseExpiry. Returns ErrJobCancelled if the job was cancelled, and
+	// ErrLeaseExpired if the job is no longer running on workerName, e.g.
+	// because it was requeued after its lease expired.
+	RenewLease(ctx context.Context, id string, workerName string, leaseExpiry time.Time) (*QueryJob, error)
+
+	// RequeueExpiredJobs moves running jobs whose lease expired before now back
+	// to pending, so that they are picked up by another worker. Jobs that have
+	// already been abandoned maxAttempts times, i.e. whose Attempts minus
+	// Retries has reached maxAttempts, are marked as failed instead.
+	// Returns the number of jobs that were requeued or failed.
+	RequeueExpiredJobs(ctx context.Context, now time.Time, maxAttempts int) (int, error)
+
+	// SetJobPhase records the phase that a running job is in. Like RenewLease,
+	// returns ErrJobCancelled if the job was cancelled, and ErrLeaseExpired if
+	// the job is no longer running on workerName.
+	SetJobPhase(ctx context.Context, id string, workerName string, phase string) error
 
 	GetJob(ctx context.Context, id string) (*QueryJob, error)
 
-	FinishJob(ctx context.Context, id string, status string, result string) error
+	// ListJobs returns up to pageSize jobs matching filter, most recently
+	// queued first. If there may be more matching jobs, a token is returned
+	// that can be passed as pageToken to get the next page; otherwise the
+	// returned token is empty. Returns ErrInvalidPageToken if pageToken wasn't
+	// returned by a previous call.
+	ListJobs(ctx context.Context, filter *ListJobsFilter, pageSize int, pageToken string) ([]*QueryJob, string, error)
+
+	// QueuePosition returns the number of pending jobs that were queued before
+	// job, regardless of whether they can run on the same workers.
+	QueuePosition(ctx context.Context, job *QueryJob) (int, error)
+
+	// FinishJob marks a job running on workerName as succeeded or failed, and
+	// records its result. Returns ErrJobCancelled if the job was cancelled
+	// while it was running, and ErrLeaseExpired if the job is no longer
+	// running on workerName, e.g. because it was requeued after its lease
+	// expired, or because it has already finished. An empty
+	// result.ResolvedCommitHash leaves the job's ResolvedCommitHash unchanged.
+	FinishJob(ctx context.Context, id string, workerName string, status string, result *JobResult) error
+
+	// RetryJob records a failed attempt by workerName at running a job,
+	// increments the job's Retries, and moves the job back to pending so that
+	// it is dequeued again no earlier than retryTime. Like FinishJob, returns
+	// ErrJobCancelled if the job was cancelled, and ErrLeaseExpired if the job
+	// is no longer running on workerName.
+	RetryJob(ctx context.Context, id string, workerName string, retryTime time.Time, result *JobResult) error
+
+	// CancelJob marks a pending or running job as cancelled. Workers running a
+	// cancelled job are expected to notice the new status and abandon it.
+	// Returns ErrJobFinished if the job has already finished.
+	CancelJob(ctx context.Context, id string) (*QueryJob, error)
+
+	// WatchJob subscribes to changes of the job with the given ID. The
+	// returned channel receives the updated job each time it is enqueued,
+	// dequeued, or finished by this DB instance; changes made by other
+	// processes sharing the same database are not observed, so callers should
+	// periodically fall back to GetJob. The returned function must be called to
+	// release the subscription.
+	WatchJob(id string) (<-chan *QueryJob, func())
 
 	io.Closer
 }
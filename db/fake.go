@@ -2,6 +2,8 @@ package db
 
 import (
 	"context"
+	"fmt"
+	"time"
 )
 
 type FakeQueueEntry struct {
@@ -9,12 +11,29 @@ type FakeQueueEntry struct {
 	Err error
 }
 
+// Fake is a DB for tests that replays a scripted queue. It isn't safe for
+// concurrent use, and doesn't implement the invariants checked by the
+// conformance tests listed in conformance.FakeSkips.
 type Fake struct {
+	// Queue holds the jobs and errors that DequeueJob returns, in order.
+	// EnqueueJob appends to it.
 	Queue []FakeQueueEntry
 
 	EnqueueJobErr error
 	GetJobErr     error
 	FinishJobErr  error
+	RetryJobErr   error
+	CancelJobErr  error
+	ListJobsErr   error
+	RenewLeaseErr error
+	SetPhaseErr   error
+
+	Watchers Watchers
+
+	// dequeued holds the jobs that DequeueJob removed from Queue, so that they
+	// can still be looked up
+	dequeued []*QueryJob
+	nextID   int
 }
 
 func (f *Fake) Close() error { return nil }
@@ -23,21 +42,41 @@ func (f *Fake) EnqueueJob(ctx context.Context, job *QueryJob) error {
 	if f.EnqueueJobErr != nil {
 		return f.EnqueueJobErr
 	}
+	if job.ID == "" {
+		f.nextID++
+		job.ID = fmt.Sprintf("fake-%d", f.nextID)
+	}
+	job.Status = StatusPending
 	f.Queue = append(f.Queue, FakeQueueEntry{Job: job, Err: nil})
 	return nil
 }
 
-func (f *Fake) DequeueJob(ctx context.Context, workerName string) (*QueryJob, error) {
-	if len(f.Queue) == 0 {
-		return nil, ErrNoOutstandingJobs
-	}
-	head := f.Queue[0]
-	if len(f.Queue) > 1 {
-		f.Queue = f.Queue[1:]
-	} else {
-		f.Queue = nil
+// DequeueJob returns the next entry of Queue, skipping jobs that were
+// cancelled or finished since they were queued. Jobs are marked as running on
+// worker.
+func (f *Fake) DequeueJob(ctx context.Context, worker *Worker, leaseExpiry time.Time) (*QueryJob, error) {
+	for len(f.Queue) > 0 {
+		head := f.Queue[0]
+		if len(f.Queue) > 1 {
+			f.Queue = f.Queue[1:]
+		} else {
+			f.Queue = nil
+		}
+		if head.Job == nil || head.Err != nil {
+			return head.Job, head.Err
+		}
+		f.dequeued = append(f.dequeued, head.Job)
+		if head.Job.Status != "" && head.Job.Status != StatusPending {
+			continue
+		}
+		workerName := worker.Name
+		head.Job.Status = StatusRunning
+		head.Job.Worker = &workerName
+		head.Job.LeaseExpiry = &leaseExpiry
+		head.Job.Attempts++
+		return head.Job, nil
 	}
-	return head.Job, head.Err
+	return nil, ErrNoOutstandingJobs
 }
 
 func (f *Fake) GetJob(ctx context.Context, id string) (*QueryJob, error) {
@@ -49,9 +88,162 @@ func (f *Fake) GetJob(ctx context.Context, id string) (*QueryJob, error) {
 			return entry.Job, nil
 		}
 	}
-	return nil, ErrJobNotFound
+	for _, job := range f.dequeued {
+		if job.ID == id {
+			return job, nil
+		}
+	}
+	return nil, fmt.Errorf("job %s: %w", id, ErrJobNotFound)
+}
+
+// ListJobs returns all matching jobs in queue order; pagination is not
+// supported.
+func (f *Fake) ListJobs(ctx context.Context, filter *ListJobsFilter, pageSize int, pageToken string) ([]*QueryJob, string, error) {
+	if f.ListJobsErr != nil {
+		return nil, "", f.ListJobsErr
+	}
+	var jobs []*QueryJob
+	for _, entry := range f.Queue {
+		j := entry.Job
+		switch {
+		case j == nil:
+		case filter.Repository != "" && j.Repository != filter.Repository:
+		case filter.CommitHash != "" && j.CommitHash != filter.CommitHash:
+		case filter.Status != "" && j.Status != filter.Status:
+		case filter.Worker != "" && (j.Worker == nil || *j.Worker != filter.Worker):
+		case !filter.QueuedAfter.IsZero() && j.QueueTime.Before(filter.QueuedAfter):
+		case !filter.QueuedBefore.IsZero() && !j.QueueTime.Before(filter.QueuedBefore):
+		default:
+			jobs = append(jobs, j)
+		}
+	}
+	return jobs, "", nil
+}
+
+func (f *Fake) QueuePosition(ctx context.Context, job *QueryJob) (int, error) {
+	pos := 0
+	for _, entry := range f.Queue {
+		if j := entry.Job; j != nil && j.Status == StatusPending && j.QueueTime.Before(job.QueueTime) {
+			pos++
+		}
+	}
+	return pos, nil
+}
+
+// FinishJob sets the status and result of the job, if it is running on
+// workerName.
+func (f *Fake) FinishJob(ctx context.Context, id string, workerName string, status string, result *JobResult) error {
+	if f.FinishJobErr != nil {
+		return f.FinishJobErr
+	}
+	if status != StatusSucceeded && status != StatusFailed {
+		return fmt.Errorf("can't finish job using status %q", status)
+	}
+	job, err := f.GetJob(ctx, id)
+	if err != nil {
+		return err
+	}
+	if job.Status == StatusCancelled {
+		return ErrJobCancelled
+	}
+	if job.Status != StatusRunning || job.Worker == nil || *job.Worker != workerName {
+		return ErrLeaseExpired
+	}
+	job.Status = status
+	job.FailureCategory = result.FailureCategory
+	if result.ResolvedCommitHash != "" {
+		job.ResolvedCommitHash = &result.ResolvedCommitHash
+	}
+	if status == StatusSucceeded {
+		job.ResultURL = nil
+		if result.URL != "" {
+			job.ResultURL = &result.URL
+		}
+		job.ResultInline = result.Inline
+		job.ResultMetadata = result.Metadata
+		job.ResultSHA256 = result.SHA256
+		job.ResultSize = result.Size
+		job.ResultEncoding = result.Encoding
+	}
+	return nil
+}
+
+func (f *Fake) RetryJob(ctx context.Context, id string, workerName string, retryTime time.Time, result *JobResult) error {
+	if f.RetryJobErr != nil {
+		return f.RetryJobErr
+	}
+	job, err := f.GetJob(ctx, id)
+	if err != nil {
+		return err
+	}
+	if job.Status == StatusCancelled {
+		return ErrJobCancelled
+	}
+	if job.Status != StatusRunning || job.Worker == nil || *job.Worker != workerName {
+		return ErrLeaseExpired
+	}
+	job.Status = StatusPending
+	job.FailureCategory = result.FailureCategory
+	job.RetryTime = &retryTime
+	job.Retries++
+	return nil
+}
+
+func (f *Fake) CancelJob(ctx context.Context, id string) (*QueryJob, error) {
+	if f.CancelJobErr != nil {
+		return nil, f.CancelJobErr
+	}
+	job, err := f.GetJob(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status != StatusPending && job.Status != StatusRunning {
+		return nil, ErrJobFinished
+	}
+	job.Status = StatusCancelled
+	return job, nil
+}
+
+func (f *Fake) RenewLease(ctx context.Context, id string, workerName string, leaseExpiry time.Time) (*QueryJob, error) {
+	if f.RenewLeaseErr != nil {
+		return nil, f.RenewLeaseErr
+	}
+	job, err := f.GetJob(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status == StatusCancelled {
+		return nil, ErrJobCancelled
+	}
+	if job.Status != StatusRunning || job.Worker == nil || *job.Worker != workerName {
+		return nil, ErrLeaseExpired
+	}
+	job.LeaseExpiry = &leaseExpiry
+	return job, nil
+}
+
+func (f *Fake) SetJobPhase(ctx context.Context, id string, workerName string, phase string) error {
+	if f.SetPhaseErr != nil {
+		return f.SetPhaseErr
+	}
+	job, err := f.GetJob(ctx, id)
+	if err != nil {
+		return err
+	}
+	if job.Status == StatusCancelled {
+		return ErrJobCancelled
+	}
+	if job.Status != StatusRunning || job.Worker == nil || *job.Worker != workerName {
+		return ErrLeaseExpired
+	}
+	job.Phase = phase
+	return nil
+}
+
+func (f *Fake) RequeueExpiredJobs(ctx context.Context, now time.Time, maxAttempts int) (int, error) {
+	return 0, nil
 }
 
-func (f *Fake) FinishJob(ctx context.Context, id string, status string, result string) error {
-	return f.FinishJobErr
+func (f *Fake) WatchJob(id string) (<-chan *QueryJob, func()) {
+	return f.Watchers.Watch(id)
 }
@@ -0,0 +1,540 @@
+// Package memory implements db.DB in process memory. It is safe for
+// concurrent use, and honors the same invariants as the SQL implementations,
+// but jobs are lost when the process exits, and only the most recently finished
+// jobs are kept (see Memory.MaxFinishedJobs). It is meant for single-dispatcher
+// development deployments and as a realistic fake in tests.
+package memory
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/minorhacks/bazel_remote_query/db"
+
+	"github.com/google/uuid"
+)
+
+// DefaultMaxFinishedJobs is the default limit on the number of finished jobs
+// kept.
+const DefaultMaxFinishedJobs = 1000
+
+// entry holds a job along with its position in the queue.
+type entry struct {
+	job db.QueryJob
+	seq int
+}
+
+type Memory struct {
+	// MaxFinishedJobs limits the number of succeeded, failed and cancelled
+	// jobs kept, along with their results. Once it is exceeded, the job that
+	// finished first is forgotten, as if it had never been queued. Defaults to
+	// DefaultMaxFinishedJobs if not set.
+	MaxFinishedJobs int
+
+	mu sync.Mutex
+
+	// all holds every job that hasn't been forgotten, in the order it was
+	// queued, i.e. sorted by seq
+	all     []*entry
+	byID    map[string]*entry
+	nextSeq int
+
+	// pending holds pending jobs ordered by seq, so that DequeueJob hands out
+	// the oldest job first, including jobs that were requeued
+	pending []*entry
+
+	// running holds running jobs by ID, for RequeueExpiredJobs
+	running map[string]*entry
+
+	// finished holds finished jobs in the order they finished, so that the
+	// oldest are forgotten first
+	finished []*entry
+
+	// byKey indexes jobs by their deduplication key, under both the commit
+	// they were queued at and the commit they resolved to. Entries may be
+	// stale, and must be checked against the job before use.
+	byKey map[string][]*entry
+
+	watchers db.Watchers
+}
+
+// New returns an empty in-memory DB.
+func New() *Memory {
+	return &Memory{
+		byID:    map[string]*entry{},
+		running: map[string]*entry{},
+		byKey:   map[string][]*entry{},
+	}
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+func (m *Memory) EnqueueJob(ctx context.Context, job *db.QueryJob) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, e := range m.byKey[dedupKey(job, job.CommitHash)] {
+		if isDuplicate(&e.job, job) {
+			// Job has already been executed; return the cached result
+			*job = clone(&e.job)
+			return nil
+		}
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return fmt.Errorf("failed to create UUID for query: %w", err)
+	}
+	e := &entry{job: clone(job), seq: m.nextSeq}
+	m.nextSeq++
+	e.job.ID = id.String()
+	e.job.Status = db.StatusPending
+	e.job.QueueTime = time.Now().UTC()
+	m.all = append(m.all, e)
+	m.byID[e.job.ID] = e
+	m.pending = append(m.pending, e)
+	m.index(e)
+
+	*job = clone(&e.job)
+	m.watchers.Notify(job)
+	return nil
+}
+
+func (m *Memory) DequeueJob(ctx context.Context, worker *db.Worker, leaseExpiry time.Time) (*db.QueryJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Get the first job in PENDING state that isn't waiting to be retried, and
+	// that the worker can run
+	now := time.Now().UTC()
+	for i, e := range m.pending {
+		if e.job.RetryTime != nil && e.job.RetryTime.After(now) {
+			continue
+		}
+		if !worker.CanRun(&e.job) {
+			continue
+		}
+		m.pending = append(m.pending[:i], m.pending[i+1:]...)
+		m.running[e.job.ID] = e
+
+		workerName := worker.Name
+		leaseExpiry = leaseExpiry.UTC()
+		e.job.Status = db.StatusRunning
+		e.job.Worker = &workerName
+		e.job.StartTime = &now
+		e.job.RetryTime = nil
+		e.job.Phase = ""
+		e.job.LeaseExpiry = &leaseExpiry
+		e.job.Attempts++
+		return m.notify(e), nil
+	}
+	return nil, db.ErrNoOutstandingJobs
+}
+
+func (m *Memory) GetJob(ctx context.Context, id string) (*db.QueryJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, err := m.get(id)
+	if err != nil {
+		return nil, err
+	}
+	job := clone(&e.job)
+	return &job, nil
+}
+
+func (m *Memory) ListJobs(ctx context.Context, filter *db.ListJobsFilter, pageSize int, pageToken string) ([]*db.QueryJob, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Jobs are listed from the most recently queued one, down from the job
+	// before the last one of the previous page
+	start := len(m.all) - 1
+	if pageToken != "" {
+		seq, err := decodePageToken(pageToken)
+		if err != nil {
+			return nil, "", err
+		}
+		if seq > m.nextSeq {
+			return nil, "", db.ErrInvalidPageToken
+		}
+		// Jobs may have been forgotten since the previous page
+		start = sort.Search(len(m.all), func(i int) bool { return m.all[i].seq >= seq }) - 1
+	}
+
+	var jobs []*db.QueryJob
+	lastSeq := start + 1
+	for i := start; i >= 0; i-- {
+		j := &m.all[i].job
+		switch {
+		case filter.Repository != "" && j.Repository != filter.Repository:
+		case filter.CommitHash != "" && j.CommitHash != filter.CommitHash && (j.ResolvedCommitHash == nil || *j.ResolvedCommitHash != filter.CommitHash):
+		case filter.Status != "" && j.Status != filter.Status:
+		case filter.Worker != "" && (j.Worker == nil || *j.Worker != filter.Worker):
+		case !filter.QueuedAfter.IsZero() && j.QueueTime.Before(filter.QueuedAfter):
+		case !filter.QueuedBefore.IsZero() && !j.QueueTime.Before(filter.QueuedBefore):
+		default:
+			if len(jobs) == pageSize {
+				// There is at least one more matching job
+				return jobs, encodePageToken(lastSeq), nil
+			}
+			job := clone(j)
+			jobs = append(jobs, &job)
+			lastSeq = m.all[i].seq
+		}
+	}
+	return jobs, "", nil
+}
+
+func (m *Memory) QueuePosition(ctx context.Context, job *db.QueryJob) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pos := 0
+	for _, e := range m.pending {
+		if e.job.QueueTime.Before(job.QueueTime) {
+			pos++
+		}
+	}
+	return pos, nil
+}
+
+func (m *Memory) FinishJob(ctx context.Context, id string, workerName string, status string, result *db.JobResult) error {
+	if status != db.StatusSucceeded && status != db.StatusFailed {
+		return fmt.Errorf("can't finish job using status %q", status)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, err := m.runningOn(id, workerName, "finish")
+	if err != nil {
+		return err
+	}
+	m.unqueue(e)
+
+	now := time.Now().UTC()
+	e.job.Status = status
+	e.job.FinishTime = &now
+	if result.ResolvedCommitHash != "" {
+		resolved := result.ResolvedCommitHash
+		e.job.ResolvedCommitHash = &resolved
+	}
+	switch status {
+	case db.StatusSucceeded:
+		e.job.ResultURL = nil
+		if result.URL != "" {
+			url := result.URL
+			e.job.ResultURL = &url
+		}
+		e.job.ResultSHA256 = result.SHA256
+		e.job.ResultSize = result.Size
+		e.job.ResultEncoding = result.Encoding
+		e.job.ResultInline = result.Inline
+		e.job.ResultMetadata = result.Metadata
+		e.job = clone(&e.job)
+	case db.StatusFailed:
+		msg := result.Error
+		e.job.ResultError = &msg
+		e.job.FailureCategory = result.FailureCategory
+		e.job.ExitCode = result.ExitCode
+		e.job.Stderr = result.Stderr
+	}
+	m.index(e)
+	m.notify(e)
+	m.finish(e)
+	return nil
+}
+
+func (m *Memory) RetryJob(ctx context.Context, id string, workerName string, retryTime time.Time, result *db.JobResult) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, err := m.runningOn(id, workerName, "retry")
+	if err != nil {
+		return err
+	}
+
+	msg := result.Error
+	retryTime = retryTime.UTC()
+	e.job.ResultError = &msg
+	e.job.FailureCategory = result.FailureCategory
+	e.job.ExitCode = result.ExitCode
+	e.job.Stderr = result.Stderr
+	e.job.RetryTime = &retryTime
+	e.job.Retries++
+	m.requeue(e)
+	m.notify(e)
+	return nil
+}
+
+func (m *Memory) CancelJob(ctx context.Context, id string) (*db.QueryJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, err := m.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if e.job.Status != db.StatusPending && e.job.Status != db.StatusRunning {
+		return nil, fmt.Errorf("can't cancel job %s with status %q: %w", id, e.job.Status, db.ErrJobFinished)
+	}
+	m.unqueue(e)
+
+	now := time.Now().UTC()
+	e.job.Status = db.StatusCancelled
+	e.job.FinishTime = &now
+	job := m.notify(e)
+	m.finish(e)
+	return job, nil
+}
+
+func (m *Memory) RenewLease(ctx context.Context, id string, workerName string, leaseExpiry time.Time) (*db.QueryJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, err := m.runningOn(id, workerName, "renew lease on")
+	if err != nil {
+		return nil, err
+	}
+	leaseExpiry = leaseExpiry.UTC()
+	e.job.LeaseExpiry = &leaseExpiry
+	job := clone(&e.job)
+	return &job, nil
+}
+
+func (m *Memory) RequeueExpiredJobs(ctx context.Context, now time.Time, maxAttempts int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var expired []*entry
+	for _, e := range m.running {
+		if e.job.LeaseExpiry != nil && e.job.LeaseExpiry.Before(now) {
+			expired = append(expired, e)
+		}
+	}
+	for _, e := range expired {
+		if e.job.Attempts-e.job.Retries >= maxAttempts {
+			m.unqueue(e)
+			msg := fmt.Sprintf("job abandoned by workers %d times", e.job.Attempts-e.job.Retries)
+			finishTime := now.UTC()
+			e.job.Status = db.StatusFailed
+			e.job.ResultError = &msg
+			e.job.FailureCategory = db.FailureCategoryInfrastructure
+			e.job.FinishTime = &finishTime
+			e.job.LeaseExpiry = nil
+			m.notify(e)
+			m.finish(e)
+		} else {
+			m.requeue(e)
+			m.notify(e)
+		}
+	}
+	return len(expired), nil
+}
+
+func (m *Memory) SetJobPhase(ctx context.Context, id string, workerName string, phase string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, err := m.runningOn(id, workerName, "set phase of")
+	if err != nil {
+		return err
+	}
+	e.job.Phase = phase
+	m.notify(e)
+	return nil
+}
+
+func (m *Memory) WatchJob(id string) (<-chan *db.QueryJob, func()) {
+	return m.watchers.Watch(id)
+}
+
+// get returns the entry of the job with the given ID. m.mu must be held.
+func (m *Memory) get(id string) (*entry, error) {
+	e, ok := m.byID[id]
+	if !ok {
+		return nil, fmt.Errorf("job %s: %w", id, db.ErrJobNotFound)
+	}
+	return e, nil
+}
+
+// runningOn returns the entry of the job with the given ID, if it is running
+// on workerName. op describes the caller's operation in errors. m.mu must be
+// held.
+func (m *Memory) runningOn(id string, workerName string, op string) (*entry, error) {
+	e, err := m.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if e.job.Status == db.StatusCancelled {
+		return nil, fmt.Errorf("can't %s job %s: %w", op, id, db.ErrJobCancelled)
+	}
+	if e.job.Status != db.StatusRunning || e.job.Worker == nil || *e.job.Worker != workerName {
+		return nil, fmt.Errorf("job %s is no longer running on worker %q: %w", id, workerName, db.ErrLeaseExpired)
+	}
+	return e, nil
+}
+
+// requeue moves a running job back to pending, at its original position in
+// the queue. m.mu must be held.
+func (m *Memory) requeue(e *entry) {
+	delete(m.running, e.job.ID)
+	e.job.Status = db.StatusPending
+	e.job.Worker = nil
+	e.job.StartTime = nil
+	e.job.LeaseExpiry = nil
+
+	i := sort.Search(len(m.pending), func(i int) bool { return m.pending[i].seq >= e.seq })
+	m.pending = append(m.pending, nil)
+	copy(m.pending[i+1:], m.pending[i:])
+	m.pending[i] = e
+}
+
+// unqueue removes a job from the pending and running sets, before it moves to
+// a final status. m.mu must be held.
+func (m *Memory) unqueue(e *entry) {
+	delete(m.running, e.job.ID)
+	i := sort.Search(len(m.pending), func(i int) bool { return m.pending[i].seq >= e.seq })
+	if i < len(m.pending) && m.pending[i] == e {
+		m.pending = append(m.pending[:i], m.pending[i+1:]...)
+	}
+}
+
+// finish records that a job has moved to a final status, and forgets the jobs
+// that finished first once there are more than MaxFinishedJobs. m.mu must be
+// held.
+func (m *Memory) finish(e *entry) {
+	maxFinished := m.MaxFinishedJobs
+	if maxFinished <= 0 {
+		maxFinished = DefaultMaxFinishedJobs
+	}
+	m.finished = append(m.finished, e)
+	for len(m.finished) > maxFinished {
+		m.forget(m.finished[0])
+		m.finished[0] = nil
+		m.finished = m.finished[1:]
+	}
+}
+
+// forget removes a finished job from the DB. m.mu must be held.
+func (m *Memory) forget(e *entry) {
+	delete(m.byID, e.job.ID)
+	for _, key := range dedupKeys(&e.job) {
+		entries := m.byKey[key]
+		for i, other := range entries {
+			if other == e {
+				entries = append(entries[:i], entries[i+1:]...)
+				break
+			}
+		}
+		if len(entries) == 0 {
+			delete(m.byKey, key)
+		} else {
+			m.byKey[key] = entries
+		}
+	}
+	i := sort.Search(len(m.all), func(i int) bool { return m.all[i].seq >= e.seq })
+	m.all = append(m.all[:i], m.all[i+1:]...)
+}
+
+// index adds a job to byKey under the commits it may be deduplicated by. m.mu
+// must be held.
+func (m *Memory) index(e *entry) {
+	for _, key := range dedupKeys(&e.job) {
+		found := false
+		for _, other := range m.byKey[key] {
+			found = found || other == e
+		}
+		if !found {
+			m.byKey[key] = append(m.byKey[key], e)
+		}
+	}
+}
+
+// notify sends a copy of a job to its watchers, and returns another copy. m.mu
+// must be held.
+func (m *Memory) notify(e *entry) *db.QueryJob {
+	job := clone(&e.job)
+	m.watchers.Notify(&job)
+	return &job
+}
+
+// dedupKeys returns the deduplication keys of job under the commit it was
+// queued at and the commit it resolved to.
+func dedupKeys(job *db.QueryJob) []string {
+	keys := []string{dedupKey(job, job.CommitHash)}
+	if job.ResolvedCommitHash != nil && *job.ResolvedCommitHash != job.CommitHash {
+		keys = append(keys, dedupKey(job, *job.ResolvedCommitHash))
+	}
+	return keys
+}
+
+// dedupKey returns the deduplication key of job, when it is matched by commit.
+func dedupKey(job *db.QueryJob, commit string) string {
+	return fmt.Sprintf("%q %q %q %q %q %q %q", job.Repository, commit, job.Query, job.QueryType, job.BazelFlags, job.OutputFormat, job.RequiredLabels)
+}
+
+// isDuplicate returns whether a job being queued should be deduplicated to the
+// existing job, which has the same deduplication key as the new job's
+// commit. Succeeded jobs can only be reused if the commit always refers to the
+// same commit.
+func isDuplicate(existing *db.QueryJob, queued *db.QueryJob) bool {
+	commit := queued.CommitHash
+	if existing.CommitHash != commit && (existing.ResolvedCommitHash == nil || *existing.ResolvedCommitHash != commit) {
+		// Stale index entry
+		return false
+	}
+	switch existing.Status {
+	case db.StatusPending, db.StatusRunning:
+		return true
+	case db.StatusSucceeded:
+		return db.IsCommitHash(commit)
+	default:
+		return false
+	}
+}
+
+// clone returns a copy of job that shares no mutable state with it.
+func clone(job *db.QueryJob) db.QueryJob {
+	j := *job
+	j.BazelFlags = cloneStrings(job.BazelFlags)
+	j.RequiredLabels = cloneStrings(job.RequiredLabels)
+	j.ResultMetadata.BazelFlags = cloneStrings(job.ResultMetadata.BazelFlags)
+	if job.ResultInline != nil {
+		j.ResultInline = append([]byte{}, job.ResultInline...)
+	}
+	return j
+}
+
+func cloneStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
+}
+
+// encodePageToken returns an opaque token identifying the position of a job in
+// the queue.
+func encodePageToken(seq int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(seq)))
+}
+
+func decodePageToken(token string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", db.ErrInvalidPageToken, err)
+	}
+	seq, err := strconv.Atoi(string(raw))
+	if err != nil || seq < 0 {
+		return 0, fmt.Errorf("%w: %q", db.ErrInvalidPageToken, raw)
+	}
+	return seq, nil
+}
@@ -0,0 +1,92 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/minorhacks/bazel_remote_query/db"
+)
+
+const commitHash = "0123456789abcdef0123456789abcdef01234567"
+
+func TestMaxFinishedJobs(t *testing.T) {
+	ctx := context.Background()
+	m := New()
+	m.MaxFinishedJobs = 2
+
+	newJob := func(i int) *db.QueryJob {
+		return &db.QueryJob{
+			Repository: "https://github.com/grpc/grpc",
+			CommitHash: commitHash,
+			Query:      fmt.Sprintf("deps(//%d/...)", i),
+		}
+	}
+	var ids []string
+	for i := 0; i < 4; i++ {
+		job := newJob(i)
+		if err := m.EnqueueJob(ctx, job); err != nil {
+			t.Fatalf("EnqueueJob() failed: %v", err)
+		}
+		ids = append(ids, job.ID)
+	}
+	finishNext := func(want string) {
+		t.Helper()
+		job, err := m.DequeueJob(ctx, &db.Worker{Name: "worker"}, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatalf("DequeueJob() failed: %v", err)
+		}
+		if job.ID != want {
+			t.Fatalf("DequeueJob() returned job %s; want %s", job.ID, want)
+		}
+		if err := m.FinishJob(ctx, job.ID, "worker", db.StatusSucceeded, &db.JobResult{Inline: []byte("//foo:bar")}); err != nil {
+			t.Fatalf("FinishJob() failed: %v", err)
+		}
+	}
+
+	// The job that finished first is forgotten once a third job finishes.
+	// Pending jobs are kept.
+	finishNext(ids[0])
+	if _, err := m.CancelJob(ctx, ids[1]); err != nil {
+		t.Fatalf("CancelJob() failed: %v", err)
+	}
+	finishNext(ids[2])
+	if _, err := m.GetJob(ctx, ids[0]); !errors.Is(err, db.ErrJobNotFound) {
+		t.Errorf("GetJob() of forgotten job returned error %v; want %v", err, db.ErrJobNotFound)
+	}
+	for _, id := range ids[1:] {
+		if _, err := m.GetJob(ctx, id); err != nil {
+			t.Errorf("GetJob(%q) failed: %v", id, err)
+		}
+	}
+
+	// Paging continues past jobs forgotten between pages
+	jobs, next, err := m.ListJobs(ctx, &db.ListJobsFilter{}, 1, "")
+	if err != nil {
+		t.Fatalf("ListJobs() failed: %v", err)
+	}
+	finishNext(ids[3])
+	more, next, err := m.ListJobs(ctx, &db.ListJobsFilter{}, 1, next)
+	if err != nil {
+		t.Fatalf("ListJobs() failed: %v", err)
+	}
+	jobs = append(jobs, more...)
+	var got []string
+	for _, j := range jobs {
+		got = append(got, j.ID)
+	}
+	if want := []string{ids[3], ids[2]}; fmt.Sprint(got) != fmt.Sprint(want) || next != "" {
+		t.Errorf("ListJobs() returned jobs %v with next page %q; want %v and no next page", got, next, want)
+	}
+
+	// A forgotten job isn't reused for the same query
+	job := newJob(0)
+	if err := m.EnqueueJob(ctx, job); err != nil {
+		t.Fatalf("EnqueueJob() failed: %v", err)
+	}
+	if job.ID == ids[0] || job.Status != db.StatusPending {
+		t.Errorf("EnqueueJob() returned job %s with status %q; want a new pending job", job.ID, job.Status)
+	}
+}
@@ -0,0 +1,904 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/minorhacks/bazel_remote_query/db"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+)
+
+// Like PostgreSQL, MySQL can be shared by several dispatcher processes.
+// Concurrent dequeues skip each other's locked rows. MySQL has no partial
+// indexes, so the deduplication invariant documented on db.DB is enforced by a
+// unique index on dedup_key, which is NULL for jobs that may be duplicated.
+// Queries, flags and labels are hashed into dedup_key to stay within the
+// maximum size of an index entry.
+const createTableStmt = `
+CREATE TABLE IF NOT EXISTS bazel_query_jobs (
+	id VARCHAR(36) NOT NULL,
+	repository VARCHAR(255) NOT NULL,
+	commit_hash VARCHAR(255) NOT NULL,
+	resolved_commit_hash VARCHAR(255),
+	query_string TEXT NOT NULL,
+	query_type VARCHAR(32) NOT NULL DEFAULT 'query',
+	bazel_flags TEXT NOT NULL,
+	output_format VARCHAR(32) NOT NULL DEFAULT 'proto',
+	required_labels JSON NOT NULL,
+	cacheable BOOLEAN NOT NULL,
+	status VARCHAR(32) NOT NULL,
+	worker VARCHAR(255),
+	queue_time DATETIME(6) NOT NULL,
+	start_time DATETIME(6),
+	finish_time DATETIME(6),
+	query_result_url TEXT,
+	query_error MEDIUMTEXT,
+	lease_expiry DATETIME(6),
+	attempts INTEGER NOT NULL DEFAULT 0,
+	retries INTEGER NOT NULL DEFAULT 0,
+	failure_category VARCHAR(64) NOT NULL DEFAULT '',
+	exit_code INTEGER NOT NULL DEFAULT 0,
+	stderr MEDIUMTEXT NOT NULL,
+	retry_time DATETIME(6),
+	phase VARCHAR(64) NOT NULL DEFAULT '',
+	result_sha256 VARCHAR(64) NOT NULL DEFAULT '',
+	result_size BIGINT NOT NULL DEFAULT 0,
+	result_encoding VARCHAR(32) NOT NULL DEFAULT '',
+	result_inline MEDIUMBLOB,
+	result_metadata TEXT NOT NULL,
+	-- Only one job per deduplication key may be pending, running, or (if it
+	-- was queued at a full commit hash) succeeded. See cacheableStatus.
+	dedup_key BINARY(32) AS (
+		IF(
+			status IN ('pending', 'running') OR (status = 'succeeded' AND cacheable),
+			UNHEX(SHA2(CONCAT_WS(CHAR(0), repository, commit_hash, query_string, query_type, bazel_flags, output_format, required_labels), 256)),
+			NULL
+		)
+	) STORED,
+	PRIMARY KEY(id),
+	UNIQUE KEY bazel_query_jobs_dedup (dedup_key),
+	-- Serves DequeueJob
+	KEY bazel_query_jobs_pending (status, queue_time),
+	-- Serve ListJobs without scanning the whole table
+	KEY bazel_query_jobs_by_queue_time (queue_time, id),
+	KEY bazel_query_jobs_by_repository (repository, queue_time, id),
+	KEY bazel_query_jobs_by_worker (worker, queue_time, id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+`
+
+// jobColumns are the columns scanned by jobFromRow, in order.
+const jobColumns = `
+	repository,
+	commit_hash,
+	resolved_commit_hash,
+	query_string,
+	query_type,
+	bazel_flags,
+	output_format,
+	required_labels,
+	id,
+	status,
+	worker,
+	queue_time,
+	start_time,
+	finish_time,
+	query_result_url,
+	query_error,
+	lease_expiry,
+	attempts,
+	retries,
+	failure_category,
+	exit_code,
+	stderr,
+	retry_time,
+	phase,
+	result_sha256,
+	result_size,
+	result_encoding,
+	result_inline,
+	result_metadata
+`
+
+// maxEnqueueAttempts is the number of times EnqueueJob looks for a duplicate
+// job before giving up, when concurrent enqueues of the same job conflict.
+const maxEnqueueAttempts = 3
+
+// MySQL error numbers for a duplicate key in a unique index, and for a
+// transaction that was rolled back to break a deadlock.
+const (
+	errDupEntry     = 1062
+	errLockDeadlock = 1213
+)
+
+// txOptions are used for all transactions. Under the default REPEATABLE READ
+// isolation level, InnoDB also locks the gaps between scanned index entries,
+// which makes concurrent enqueues and dequeues block each other.
+var txOptions = &sql.TxOptions{Isolation: sql.LevelReadCommitted}
+
+type Mysql struct {
+	db       *sql.DB
+	watchers db.Watchers
+}
+
+// New connects to the MySQL database described by dsn, e.g.
+// `user:password@tcp(host:3306)/dbname`, and creates the jobs table if it
+// doesn't exist.
+func New(ctx context.Context, dsn string) (*Mysql, error) {
+	cfg, err := mysqldriver.ParseDSN(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse mysql DSN: %w", err)
+	}
+	// Times are stored as UTC DATETIMEs. RowsAffected must count rows that
+	// matched an UPDATE, even if their values didn't change.
+	cfg.ParseTime = true
+	cfg.Loc = time.UTC
+	cfg.ClientFoundRows = true
+	connector, err := mysqldriver.NewConnector(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mysql database: %w", err)
+	}
+	sqlDB := sql.OpenDB(connector)
+	if _, err := sqlDB.ExecContext(ctx, createTableStmt); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("failed to create 'bazel_query_jobs' table: %w", err)
+	}
+	return &Mysql{db: sqlDB}, nil
+}
+
+func (m *Mysql) Close() error {
+	return m.db.Close()
+}
+
+func (m *Mysql) EnqueueJob(ctx context.Context, job *db.QueryJob) error {
+	flags, err := encodeFlags(job.BazelFlags)
+	if err != nil {
+		return err
+	}
+	labels, err := encodeLabels(job.RequiredLabels)
+	if err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		err := m.enqueueJob(ctx, job, flags, labels)
+		var myErr *mysqldriver.MySQLError
+		if errors.As(err, &myErr) && (myErr.Number == errDupEntry || myErr.Number == errLockDeadlock) && attempt < maxEnqueueAttempts {
+			// A duplicate job was queued concurrently; deduplicate against it
+			continue
+		}
+		return err
+	}
+}
+
+func (m *Mysql) enqueueJob(ctx context.Context, job *db.QueryJob, flags string, labels string) error {
+	tx, err := m.db.BeginTx(ctx, txOptions)
+	if err != nil {
+		return fmt.Errorf("failed to start enqueue transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, `
+	SELECT `+jobColumns+`
+	FROM bazel_query_jobs
+	WHERE
+		repository = ? AND
+		(commit_hash = ? OR resolved_commit_hash = ?) AND
+		query_string = ? AND
+		query_type = ? AND
+		bazel_flags = ? AND
+		output_format = ? AND
+		required_labels = CAST(? AS JSON) AND
+		status NOT IN (?, ?, ?)
+	LIMIT 1;
+	`, job.Repository, job.CommitHash, job.CommitHash, job.Query, job.QueryType, flags, job.OutputFormat, labels, db.StatusFailed, db.StatusCancelled, cacheableStatus(job.CommitHash))
+	r, err := jobFromRow(row)
+	if err != nil && !errors.Is(err, db.ErrNoOutstandingJobs) {
+		return fmt.Errorf("failed to query for existing jobs: %w", err)
+	} else if err == nil {
+		// Job has already been executed; return the cached result
+		*job = *r
+		return nil
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return fmt.Errorf("failed to create UUID for query: %w", err)
+	}
+	queueTime := time.Now().UTC().Truncate(time.Microsecond)
+	_, err = tx.ExecContext(ctx, `
+	INSERT INTO bazel_query_jobs (
+		repository,
+		commit_hash,
+		resolved_commit_hash,
+		query_string,
+		query_type,
+		bazel_flags,
+		output_format,
+		required_labels,
+		cacheable,
+		id,
+		status,
+		queue_time,
+		stderr,
+		result_metadata
+	)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, '', '{}');
+	`,
+		job.Repository,
+		job.CommitHash,
+		job.ResolvedCommitHash,
+		job.Query,
+		job.QueryType,
+		flags,
+		job.OutputFormat,
+		labels,
+		db.IsCommitHash(job.CommitHash),
+		id.String(),
+		db.StatusPending,
+		queueTime,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to queue query: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit queued query: %w", err)
+	}
+	job.ID = id.String()
+	job.Status = db.StatusPending
+	job.QueueTime = queueTime
+	m.watchers.Notify(job)
+	return nil
+}
+
+func (m *Mysql) DequeueJob(ctx context.Context, worker *db.Worker, leaseExpiry time.Time) (*db.QueryJob, error) {
+	tx, err := m.db.BeginTx(ctx, txOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start dequeue transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	workerLabels, err := encodeLabels(db.LabelList(worker.Labels))
+	if err != nil {
+		return nil, err
+	}
+	// Get the first job in PENDING state that isn't waiting to be retried, and
+	// that the worker can run. Rows locked by concurrent dequeues are skipped
+	// rather than waited for.
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	args := []interface{}{db.StatusPending, now, workerLabels}
+	repoCond := ""
+	if len(worker.Repositories) > 0 {
+		for _, repo := range worker.Repositories {
+			args = append(args, repo)
+		}
+		repoCond = "AND repository IN (?" + strings.Repeat(", ?", len(worker.Repositories)-1) + ")"
+	}
+	row := tx.QueryRowContext(ctx, fmt.Sprintf(`
+	SELECT `+jobColumns+`
+	FROM bazel_query_jobs
+	WHERE
+		status = ? AND
+		(retry_time IS NULL OR retry_time <= ?) AND
+		JSON_CONTAINS(CAST(? AS JSON), required_labels)
+		%s
+	ORDER BY queue_time ASC
+	LIMIT 1
+	FOR UPDATE SKIP LOCKED;
+	`, repoCond), args...)
+	job, err := jobFromRow(row)
+	if err != nil {
+		return nil, err
+	}
+
+	job.Status = db.StatusRunning
+	job.Worker = &worker.Name
+	job.StartTime = &now
+	job.RetryTime = nil
+	job.Phase = ""
+	leaseExpiry = leaseExpiry.UTC().Truncate(time.Microsecond)
+	job.LeaseExpiry = &leaseExpiry
+	job.Attempts++
+
+	result, err := tx.ExecContext(ctx, `
+	UPDATE bazel_query_jobs
+	SET
+		status = ?,
+		worker = ?,
+		start_time = ?,
+		lease_expiry = ?,
+		attempts = ?,
+		retry_time = NULL,
+		phase = ''
+	WHERE
+		id = ?;
+	`, job.Status, job.Worker, job.StartTime, job.LeaseExpiry, job.Attempts, job.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to mark job %s as running: %w", job.ID, err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return nil, fmt.Errorf("want 1 row affected, got %d rows affected with error: %w", n, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit job assignment for %s: %w", job.ID, err)
+	}
+	m.watchers.Notify(job)
+	return job, nil
+}
+
+func (m *Mysql) GetJob(ctx context.Context, id string) (*db.QueryJob, error) {
+	row := m.db.QueryRowContext(ctx, `
+	SELECT `+jobColumns+`
+	FROM bazel_query_jobs
+	WHERE id = ?;
+	`, id)
+	job, err := jobFromRow(row)
+	if errors.Is(err, db.ErrNoOutstandingJobs) {
+		return nil, fmt.Errorf("job %s: %w", id, db.ErrJobNotFound)
+	}
+	return job, err
+}
+
+func (m *Mysql) ListJobs(ctx context.Context, filter *db.ListJobsFilter, pageSize int, pageToken string) ([]*db.QueryJob, string, error) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+	addCond := func(cond string, condArgs ...interface{}) {
+		args = append(args, condArgs...)
+		conds = append(conds, cond)
+	}
+	if filter.Repository != "" {
+		addCond("repository = ?", filter.Repository)
+	}
+	if filter.CommitHash != "" {
+		addCond("(commit_hash = ? OR resolved_commit_hash = ?)", filter.CommitHash, filter.CommitHash)
+	}
+	if filter.Status != "" {
+		addCond("status = ?", filter.Status)
+	}
+	if filter.Worker != "" {
+		addCond("worker = ?", filter.Worker)
+	}
+	if !filter.QueuedAfter.IsZero() {
+		addCond("queue_time >= ?", filter.QueuedAfter.UTC())
+	}
+	if !filter.QueuedBefore.IsZero() {
+		addCond("queue_time < ?", filter.QueuedBefore.UTC())
+	}
+	if pageToken != "" {
+		queueTime, id, err := decodePageToken(pageToken)
+		if err != nil {
+			return nil, "", err
+		}
+		args = append(args, queueTime, id)
+		conds = append(conds, "(queue_time, id) < (?, ?)")
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = "WHERE " + strings.Join(conds, " AND ")
+	}
+	// Fetch one extra row to find out whether there is another page
+	args = append(args, pageSize+1)
+	rows, err := m.db.QueryContext(ctx, fmt.Sprintf(`
+	SELECT `+jobColumns+`
+	FROM bazel_query_jobs
+	%s
+	ORDER BY queue_time DESC, id DESC
+	LIMIT ?;
+	`, where), args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var jobs []*db.QueryJob
+	for rows.Next() {
+		job, err := jobFromRow(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("failed to list jobs: %w", err)
+	}
+
+	var nextPageToken string
+	if len(jobs) > pageSize {
+		jobs = jobs[:pageSize]
+		last := jobs[len(jobs)-1]
+		nextPageToken = encodePageToken(last.QueueTime, last.ID)
+	}
+	return jobs, nextPageToken, nil
+}
+
+func (m *Mysql) QueuePosition(ctx context.Context, job *db.QueryJob) (int, error) {
+	var pos int
+	err := m.db.QueryRowContext(ctx, `
+	SELECT COUNT(*)
+	FROM bazel_query_jobs
+	WHERE
+		status = ? AND
+		queue_time < ?;
+	`, db.StatusPending, job.QueueTime.UTC()).Scan(&pos)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count jobs queued before %s: %w", job.ID, err)
+	}
+	return pos, nil
+}
+
+func (m *Mysql) FinishJob(ctx context.Context, id string, workerName string, status string, result *db.JobResult) error {
+	var (
+		sqlRes   sql.Result
+		err      error
+		resolved *string
+		url      *string
+	)
+	metadata, err := json.Marshal(result.Metadata)
+	if err != nil {
+		return fmt.Errorf("failed to marshal result metadata: %w", err)
+	}
+	if result.ResolvedCommitHash != "" {
+		resolved = &result.ResolvedCommitHash
+	}
+	if result.URL != "" {
+		url = &result.URL
+	}
+	switch status {
+	case db.StatusSucceeded:
+		sqlRes, err = m.db.ExecContext(ctx, `
+		UPDATE bazel_query_jobs
+		SET
+			status = ?,
+			finish_time = ?,
+			query_result_url = ?,
+			resolved_commit_hash = COALESCE(?, resolved_commit_hash),
+			result_sha256 = ?,
+			result_size = ?,
+			result_encoding = ?,
+			result_inline = ?,
+			result_metadata = ?
+		WHERE
+			id = ? AND
+			status = ? AND
+			worker = ?;
+		`, status, time.Now().UTC(), url, resolved, result.SHA256, result.Size, result.Encoding, result.Inline, string(metadata), id, db.StatusRunning, workerName)
+	case db.StatusFailed:
+		sqlRes, err = m.db.ExecContext(ctx, `
+		UPDATE bazel_query_jobs
+		SET
+			status = ?,
+			finish_time = ?,
+			query_error = ?,
+			resolved_commit_hash = COALESCE(?, resolved_commit_hash),
+			failure_category = ?,
+			exit_code = ?,
+			stderr = ?
+		WHERE
+			id = ? AND
+			status = ? AND
+			worker = ?;
+		`, status, time.Now().UTC(), result.Error, resolved, result.FailureCategory, result.ExitCode, result.Stderr, id, db.StatusRunning, workerName)
+	default:
+		return fmt.Errorf("can't finish job using status %q", status)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to mark job %s as done: %w", id, err)
+	}
+	n, err := sqlRes.RowsAffected()
+	if err == nil && n == 0 {
+		// Either the job doesn't exist, or it is no longer running on the
+		// worker
+		job, err := m.GetJob(ctx, id)
+		if err != nil {
+			return err
+		}
+		if job.Status == db.StatusCancelled {
+			return fmt.Errorf("can't finish job %s: %w", id, db.ErrJobCancelled)
+		}
+		return fmt.Errorf("job %s is no longer running on worker %q: %w", id, workerName, db.ErrLeaseExpired)
+	}
+	if err != nil || n != 1 {
+		return fmt.Errorf("want 1 row affected; got %d rows affected with error: %w", n, err)
+	}
+	if job, err := m.GetJob(ctx, id); err == nil {
+		m.watchers.Notify(job)
+	}
+	return nil
+}
+
+func (m *Mysql) RetryJob(ctx context.Context, id string, workerName string, retryTime time.Time, result *db.JobResult) error {
+	sqlRes, err := m.db.ExecContext(ctx, `
+	UPDATE bazel_query_jobs
+	SET
+		status = ?,
+		worker = NULL,
+		start_time = NULL,
+		lease_expiry = NULL,
+		query_error = ?,
+		failure_category = ?,
+		exit_code = ?,
+		stderr = ?,
+		retry_time = ?,
+		retries = retries + 1
+	WHERE
+		id = ? AND
+		status = ? AND
+		worker = ?;
+	`, db.StatusPending, result.Error, result.FailureCategory, result.ExitCode, result.Stderr, retryTime.UTC(), id, db.StatusRunning, workerName)
+	if err != nil {
+		return fmt.Errorf("failed to requeue job %s for retry: %w", id, err)
+	}
+	n, err := sqlRes.RowsAffected()
+	if err == nil && n == 0 {
+		// Either the job doesn't exist, or it is no longer running on the
+		// worker
+		job, err := m.GetJob(ctx, id)
+		if err != nil {
+			return err
+		}
+		if job.Status == db.StatusCancelled {
+			return fmt.Errorf("can't retry job %s: %w", id, db.ErrJobCancelled)
+		}
+		return fmt.Errorf("job %s is no longer running on worker %q: %w", id, workerName, db.ErrLeaseExpired)
+	}
+	if err != nil || n != 1 {
+		return fmt.Errorf("want 1 row affected; got %d rows affected with error: %w", n, err)
+	}
+	if job, err := m.GetJob(ctx, id); err == nil {
+		m.watchers.Notify(job)
+	}
+	return nil
+}
+
+func (m *Mysql) CancelJob(ctx context.Context, id string) (*db.QueryJob, error) {
+	tx, err := m.db.BeginTx(ctx, txOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start cancel transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, `
+	SELECT `+jobColumns+`
+	FROM bazel_query_jobs
+	WHERE id = ?
+	FOR UPDATE;
+	`, id)
+	job, err := jobFromRow(row)
+	if errors.Is(err, db.ErrNoOutstandingJobs) {
+		return nil, fmt.Errorf("job %s: %w", id, db.ErrJobNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+	if job.Status != db.StatusPending && job.Status != db.StatusRunning {
+		return nil, fmt.Errorf("can't cancel job %s with status %q: %w", id, job.Status, db.ErrJobFinished)
+	}
+
+	job.Status = db.StatusCancelled
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	job.FinishTime = &now
+
+	result, err := tx.ExecContext(ctx, `
+	UPDATE bazel_query_jobs
+	SET
+		status = ?,
+		finish_time = ?
+	WHERE
+		id = ?;
+	`, job.Status, job.FinishTime, job.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to mark job %s as cancelled: %w", job.ID, err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return nil, fmt.Errorf("want 1 row affected, got %d rows affected with error: %w", n, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit cancellation of %s: %w", job.ID, err)
+	}
+	m.watchers.Notify(job)
+	return job, nil
+}
+
+func (m *Mysql) RenewLease(ctx context.Context, id string, workerName string, leaseExpiry time.Time) (*db.QueryJob, error) {
+	tx, err := m.db.BeginTx(ctx, txOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start lease renewal transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, `
+	SELECT `+jobColumns+`
+	FROM bazel_query_jobs
+	WHERE id = ?
+	FOR UPDATE;
+	`, id)
+	job, err := jobFromRow(row)
+	if errors.Is(err, db.ErrNoOutstandingJobs) {
+		return nil, fmt.Errorf("job %s: %w", id, db.ErrJobNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+	if job.Status == db.StatusCancelled {
+		return nil, fmt.Errorf("can't renew lease on job %s: %w", id, db.ErrJobCancelled)
+	}
+	if job.Status != db.StatusRunning || job.Worker == nil || *job.Worker != workerName {
+		return nil, fmt.Errorf("job %s is no longer running on worker %q: %w", id, workerName, db.ErrLeaseExpired)
+	}
+
+	leaseExpiry = leaseExpiry.UTC().Truncate(time.Microsecond)
+	job.LeaseExpiry = &leaseExpiry
+	result, err := tx.ExecContext(ctx, `
+	UPDATE bazel_query_jobs
+	SET
+		lease_expiry = ?
+	WHERE
+		id = ?;
+	`, job.LeaseExpiry, job.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to renew lease on job %s: %w", job.ID, err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return nil, fmt.Errorf("want 1 row affected, got %d rows affected with error: %w", n, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit lease renewal for %s: %w", job.ID, err)
+	}
+	return job, nil
+}
+
+func (m *Mysql) RequeueExpiredJobs(ctx context.Context, now time.Time, maxAttempts int) (int, error) {
+	tx, err := m.db.BeginTx(ctx, txOptions)
+	if err != nil {
+		return 0, fmt.Errorf("failed to start requeue transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Jobs locked by another dispatcher are being requeued or renewed by it
+	rows, err := tx.QueryContext(ctx, `
+	SELECT `+jobColumns+`
+	FROM bazel_query_jobs
+	WHERE
+		status = ? AND
+		lease_expiry < ?
+	FOR UPDATE SKIP LOCKED;
+	`, db.StatusRunning, now.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to query for expired jobs: %w", err)
+	}
+	var jobs []*db.QueryJob
+	for rows.Next() {
+		job, err := jobFromRow(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to query for expired jobs: %w", err)
+	}
+
+	for _, job := range jobs {
+		var result sql.Result
+		if job.Attempts-job.Retries >= maxAttempts {
+			msg := fmt.Sprintf("job abandoned by workers %d times", job.Attempts-job.Retries)
+			finishTime := now.UTC().Truncate(time.Microsecond)
+			job.Status = db.StatusFailed
+			job.ResultError = &msg
+			job.FailureCategory = db.FailureCategoryInfrastructure
+			job.FinishTime = &finishTime
+			job.LeaseExpiry = nil
+			result, err = tx.ExecContext(ctx, `
+			UPDATE bazel_query_jobs
+			SET
+				status = ?,
+				query_error = ?,
+				failure_category = ?,
+				finish_time = ?,
+				lease_expiry = NULL
+			WHERE
+				id = ?;
+			`, job.Status, msg, job.FailureCategory, finishTime, job.ID)
+		} else {
+			job.Status = db.StatusPending
+			job.Worker = nil
+			job.StartTime = nil
+			job.LeaseExpiry = nil
+			result, err = tx.ExecContext(ctx, `
+			UPDATE bazel_query_jobs
+			SET
+				status = ?,
+				worker = NULL,
+				start_time = NULL,
+				lease_expiry = NULL
+			WHERE
+				id = ?;
+			`, job.Status, job.ID)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to requeue job %s: %w", job.ID, err)
+		}
+		if n, err := result.RowsAffected(); err != nil || n != 1 {
+			return 0, fmt.Errorf("want 1 row affected, got %d rows affected with error: %w", n, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit requeue of expired jobs: %w", err)
+	}
+	for _, job := range jobs {
+		m.watchers.Notify(job)
+	}
+	return len(jobs), nil
+}
+
+func (m *Mysql) SetJobPhase(ctx context.Context, id string, workerName string, phase string) error {
+	result, err := m.db.ExecContext(ctx, `
+	UPDATE bazel_query_jobs
+	SET
+		phase = ?
+	WHERE
+		id = ? AND
+		status = ? AND
+		worker = ?;
+	`, phase, id, db.StatusRunning, workerName)
+	if err != nil {
+		return fmt.Errorf("failed to set phase of job %s: %w", id, err)
+	}
+	n, err := result.RowsAffected()
+	if err == nil && n == 0 {
+		// Either the job doesn't exist, or it is no longer running on workerName
+		job, err := m.GetJob(ctx, id)
+		if err != nil {
+			return err
+		}
+		if job.Status == db.StatusCancelled {
+			return fmt.Errorf("can't set phase of job %s: %w", id, db.ErrJobCancelled)
+		}
+		return fmt.Errorf("job %s is no longer running on worker %q: %w", id, workerName, db.ErrLeaseExpired)
+	}
+	if err != nil || n != 1 {
+		return fmt.Errorf("want 1 row affected; got %d rows affected with error: %w", n, err)
+	}
+	if job, err := m.GetJob(ctx, id); err == nil {
+		m.watchers.Notify(job)
+	}
+	return nil
+}
+
+func (m *Mysql) WatchJob(id string) (<-chan *db.QueryJob, func()) {
+	return m.watchers.Watch(id)
+}
+
+// encodePageToken returns an opaque token identifying the position of a job in
+// the (queue_time, id) ordering used by ListJobs.
+func encodePageToken(queueTime time.Time, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(queueTime.UTC().Format(time.RFC3339Nano) + "|" + id))
+}
+
+func decodePageToken(token string) (queueTime time.Time, id string, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("%w: %v", db.ErrInvalidPageToken, err)
+	}
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 {
+		return time.Time{}, "", db.ErrInvalidPageToken
+	}
+	queueTime, err = time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("%w: %v", db.ErrInvalidPageToken, err)
+	}
+	return queueTime, parts[1], nil
+}
+
+// cacheableStatus returns the status that, in addition to failed and
+// cancelled, is excluded when looking for a duplicate of a job queued at
+// committish. Succeeded jobs can only be reused if committish always refers
+// to the same commit. This must agree with the predicate of the
+// bazel_query_jobs_dedup index.
+func cacheableStatus(committish string) string {
+	if db.IsCommitHash(committish) {
+		// Excluding failed jobs again is a no-op
+		return db.StatusFailed
+	}
+	return db.StatusSucceeded
+}
+
+// encodeFlags encodes Bazel flags as a JSON list, so that they can be stored in
+// a single column and compared as part of the deduplication key.
+func encodeFlags(flags []string) (string, error) {
+	if flags == nil {
+		flags = []string{}
+	}
+	encoded, err := json.Marshal(flags)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode bazel flags: %w", err)
+	}
+	return string(encoded), nil
+}
+
+// encodeLabels encodes required labels as a JSON list, like encodeFlags. They
+// are stored as JSON, so that DequeueJob can match them against a worker's
+// labels by containment.
+func encodeLabels(labels []string) (string, error) {
+	if labels == nil {
+		labels = []string{}
+	}
+	encoded, err := json.Marshal(labels)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode required labels: %w", err)
+	}
+	return string(encoded), nil
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func jobFromRow(r scanner) (*db.QueryJob, error) {
+	var (
+		j        db.QueryJob
+		flags    string
+		labels   string
+		metadata string
+	)
+	err := r.Scan(
+		&j.Repository,
+		&j.CommitHash,
+		&j.ResolvedCommitHash,
+		&j.Query,
+		&j.QueryType,
+		&flags,
+		&j.OutputFormat,
+		&labels,
+		&j.ID,
+		&j.Status,
+		&j.Worker,
+		&j.QueueTime,
+		&j.StartTime,
+		&j.FinishTime,
+		&j.ResultURL,
+		&j.ResultError,
+		&j.LeaseExpiry,
+		&j.Attempts,
+		&j.Retries,
+		&j.FailureCategory,
+		&j.ExitCode,
+		&j.Stderr,
+		&j.RetryTime,
+		&j.Phase,
+		&j.ResultSHA256,
+		&j.ResultSize,
+		&j.ResultEncoding,
+		&j.ResultInline,
+		&metadata,
+	)
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return nil, db.ErrNoOutstandingJobs
+	} else if err != nil {
+		return nil, fmt.Errorf("while translating mysql row to QueryJob: %w", err)
+	}
+	if err := json.Unmarshal([]byte(flags), &j.BazelFlags); err != nil {
+		return nil, fmt.Errorf("failed to parse bazel_flags for job %s: %w", j.ID, err)
+	}
+	if len(j.BazelFlags) == 0 {
+		j.BazelFlags = nil
+	}
+	if err := json.Unmarshal([]byte(labels), &j.RequiredLabels); err != nil {
+		return nil, fmt.Errorf("failed to parse required_labels for job %s: %w", j.ID, err)
+	}
+	if len(j.RequiredLabels) == 0 {
+		j.RequiredLabels = nil
+	}
+	if err := json.Unmarshal([]byte(metadata), &j.ResultMetadata); err != nil {
+		return nil, fmt.Errorf("failed to parse result_metadata for job %s: %w", j.ID, err)
+	}
+	return &j, nil
+}
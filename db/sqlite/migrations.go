@@ -0,0 +1,214 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// migration changes the schema of a database. It runs in the same transaction
+// that records the new schema version.
+type migration struct {
+	desc  string
+	apply func(ctx context.Context, tx *sql.Tx) error
+}
+
+// migrations bring the schema of a database up to date, in order. The schema
+// version of a database is the number of migrations that have been applied to
+// it. Migrations must not be changed or reordered once released, since
+// existing databases have already applied them; the schema is changed by
+// appending a new migration.
+var migrations = []migration{
+	{
+		desc: "create jobs table",
+		apply: execMigration(`
+		CREATE TABLE IF NOT EXISTS "bazel_query_jobs" (
+			id TEXT NOT NULL,
+			repository TEXT NOT NULL,
+			commit_hash TEXT NOT NULL,
+			query_string TEXT NOT NULL,
+			status TEXT NOT NULL,
+			worker TEXT,
+			queue_time TEXT NOT NULL,
+			start_time TEXT,
+			finish_time TEXT,
+			query_result_url TEXT,
+			query_error TEXT,
+			PRIMARY KEY(id)
+		);
+		`),
+	},
+	{
+		// Before schema versioning, columns were added by recreating the
+		// table only if it didn't exist, so existing tables may lack any of
+		// them.
+		desc: "add columns missing from unversioned jobs tables",
+		apply: addMissingColumns("bazel_query_jobs", []column{
+			{"resolved_commit_hash", "TEXT"},
+			{"query_type", "TEXT NOT NULL DEFAULT 'query'"},
+			{"bazel_flags", "TEXT NOT NULL DEFAULT '[]'"},
+			{"output_format", "TEXT NOT NULL DEFAULT 'proto'"},
+			{"required_labels", "TEXT NOT NULL DEFAULT '[]'"},
+			{"lease_expiry", "TEXT"},
+			{"attempts", "INTEGER NOT NULL DEFAULT 0"},
+			{"failure_category", "TEXT NOT NULL DEFAULT ''"},
+			{"exit_code", "INTEGER NOT NULL DEFAULT 0"},
+			{"stderr", "TEXT NOT NULL DEFAULT ''"},
+			{"retry_time", "TEXT"},
+			{"phase", "TEXT NOT NULL DEFAULT ''"},
+			{"result_sha256", "TEXT NOT NULL DEFAULT ''"},
+			{"result_size", "INTEGER NOT NULL DEFAULT 0"},
+			{"result_encoding", "TEXT NOT NULL DEFAULT ''"},
+			{"result_inline", "BLOB"},
+			{"result_metadata", "TEXT NOT NULL DEFAULT '{}'"},
+		}),
+	},
+	{
+		// Serve ListJobs without scanning the whole table. Unversioned
+		// databases may already have these.
+		desc: "index jobs for ListJobs",
+		apply: execMigration(`
+		CREATE INDEX IF NOT EXISTS "bazel_query_jobs_by_queue_time"
+			ON "bazel_query_jobs" (queue_time, id);
+		CREATE INDEX IF NOT EXISTS "bazel_query_jobs_by_repository"
+			ON "bazel_query_jobs" (repository, queue_time, id);
+		CREATE INDEX IF NOT EXISTS "bazel_query_jobs_by_worker"
+			ON "bazel_query_jobs" (worker, queue_time, id);
+		`),
+	},
+	{
+		// Serve DequeueJob in queue order, and the duplicate lookup in
+		// EnqueueJob. The commit is last in the deduplication index, since it
+		// is matched against either of two columns.
+		desc: "index jobs for DequeueJob and EnqueueJob",
+		apply: execMigration(`
+		CREATE INDEX "bazel_query_jobs_pending"
+			ON "bazel_query_jobs" (status, queue_time);
+		CREATE INDEX "bazel_query_jobs_dedup"
+			ON "bazel_query_jobs" (repository, query_string, query_type, bazel_flags, output_format, required_labels, commit_hash);
+		`),
+	},
+	{
+		desc: "count infrastructure retries",
+		apply: execMigration(`
+		ALTER TABLE "bazel_query_jobs" ADD COLUMN retries INTEGER NOT NULL DEFAULT 0;
+		`),
+	},
+}
+
+// migrate applies the migrations that haven't been applied to the database
+// yet, each in its own transaction.
+func migrate(ctx context.Context, sqlDB *sql.DB) error {
+	_, err := sqlDB.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS "schema_version" (
+		version INTEGER NOT NULL
+	);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create 'schema_version' table: %w", err)
+	}
+	for {
+		applied, err := applyNextMigration(ctx, sqlDB)
+		if err != nil {
+			return err
+		}
+		if !applied {
+			return nil
+		}
+	}
+}
+
+// applyNextMigration applies the first migration that hasn't been applied to
+// the database, and records the new schema version in the same transaction.
+// Returns false if there are no more migrations to apply.
+func applyNextMigration(ctx context.Context, sqlDB *sql.DB) (bool, error) {
+	tx, err := sqlDB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return false, fmt.Errorf("failed to start migration transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	version, err := schemaVersion(ctx, tx)
+	if err != nil {
+		return false, err
+	}
+	if version > len(migrations) {
+		return false, fmt.Errorf("database has schema version %d, but only %d is supported; it was created by a newer version", version, len(migrations))
+	}
+	if version == len(migrations) {
+		return false, nil
+	}
+
+	m := migrations[version]
+	if err := m.apply(ctx, tx); err != nil {
+		return false, fmt.Errorf("failed to migrate to schema version %d (%s): %w", version+1, m.desc, err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM "schema_version";`); err != nil {
+		return false, fmt.Errorf("failed to record schema version %d: %w", version+1, err)
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO "schema_version" (version) VALUES ($1);`, version+1); err != nil {
+		return false, fmt.Errorf("failed to record schema version %d: %w", version+1, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit migration to schema version %d: %w", version+1, err)
+	}
+	return true, nil
+}
+
+// schemaVersion returns the number of migrations that have been applied to
+// the database.
+func schemaVersion(ctx context.Context, tx *sql.Tx) (int, error) {
+	var version int
+	err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM "schema_version";`).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return version, nil
+}
+
+// execMigration returns a migration that executes stmt, which may contain
+// several statements.
+func execMigration(stmt string) func(ctx context.Context, tx *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, stmt)
+		return err
+	}
+}
+
+type column struct {
+	name string
+	def  string
+}
+
+// addMissingColumns returns a migration that adds each of columns to table,
+// unless the table already has it.
+func addMissingColumns(table string, columns []column) func(ctx context.Context, tx *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, fmt.Sprintf(`SELECT name FROM pragma_table_info('%s');`, table))
+		if err != nil {
+			return fmt.Errorf("failed to list columns of %q: %w", table, err)
+		}
+		existing := map[string]bool{}
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to list columns of %q: %w", table, err)
+			}
+			existing[name] = true
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to list columns of %q: %w", table, err)
+		}
+
+		for _, c := range columns {
+			if existing[c.name] {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %q ADD COLUMN %s %s;`, table, c.name, c.def)); err != nil {
+				return fmt.Errorf("failed to add column %q to %q: %w", c.name, table, err)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,164 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/minorhacks/bazel_remote_query/db"
+	"github.com/minorhacks/bazel_remote_query/testutil"
+)
+
+// unversionedSchema creates the jobs table as the first release did, before
+// schema versioning.
+const unversionedSchema = `
+CREATE TABLE "bazel_query_jobs" (
+	id TEXT NOT NULL,
+	repository TEXT NOT NULL,
+	commit_hash TEXT NOT NULL,
+	query_string TEXT NOT NULL,
+	status TEXT NOT NULL,
+	worker TEXT,
+	queue_time TEXT NOT NULL,
+	start_time TEXT,
+	finish_time TEXT,
+	query_result_url TEXT,
+	query_error TEXT,
+	PRIMARY KEY(id)
+);
+INSERT INTO "bazel_query_jobs" (id, repository, commit_hash, query_string, status, queue_time)
+VALUES ('1', 'https://github.com/grpc/grpc', 'main', 'deps(//...)', 'pending', '2022-05-01T12:00:00Z');
+`
+
+func TestMigrate(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		setup       string
+		wantVersion int
+		wantErr     string
+	}{
+		{
+			desc:        "new database",
+			wantVersion: len(migrations),
+		},
+		{
+			desc:        "unversioned database",
+			setup:       unversionedSchema,
+			wantVersion: len(migrations),
+		},
+		{
+			desc: "database from newer version",
+			setup: `
+			CREATE TABLE "schema_version" (version INTEGER NOT NULL);
+			INSERT INTO "schema_version" (version) VALUES (1000);
+			`,
+			wantErr: "created by a newer version",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctx := context.Background()
+			dbPath := filepath.Join(t.TempDir(), "jobs.sqlite")
+			if tc.setup != "" {
+				setupDB, err := sql.Open("sqlite3", dbPath)
+				if err != nil {
+					t.Fatalf("failed to open %q: %v", dbPath, err)
+				}
+				if _, err := setupDB.Exec(tc.setup); err != nil {
+					t.Fatalf("failed to set up database: %v", err)
+				}
+				setupDB.Close()
+			}
+
+			// Opening the database again must be a no-op
+			for i := 0; i < 2; i++ {
+				s, gotErr := New(ctx, dbPath)
+				if diff := testutil.ErrSubstring(gotErr, tc.wantErr); diff != "" {
+					t.Fatal(diff)
+				}
+				if gotErr != nil {
+					return
+				}
+				var version int
+				if err := s.db.QueryRow(`SELECT version FROM "schema_version";`).Scan(&version); err != nil {
+					t.Fatalf("failed to read schema version: %v", err)
+				}
+				if version != tc.wantVersion {
+					t.Errorf("got schema version %d, want %d", version, tc.wantVersion)
+				}
+				// Jobs from before the migration are readable, and new jobs
+				// can be queued
+				if _, _, err := s.ListJobs(ctx, &db.ListJobsFilter{}, 10, ""); err != nil {
+					t.Errorf("ListJobs() failed: %v", err)
+				}
+				if err := s.EnqueueJob(ctx, &db.QueryJob{Repository: "https://github.com/grpc/grpc", CommitHash: "main", Query: "deps(//...)"}); err != nil {
+					t.Errorf("EnqueueJob() failed: %v", err)
+				}
+				s.Close()
+			}
+		})
+	}
+}
+
+func TestQueryPlans(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		query     string
+		wantIndex string
+	}{
+		{
+			desc: "DequeueJob",
+			query: `
+			SELECT id FROM "bazel_query_jobs"
+			WHERE status = 'pending' AND (retry_time IS NULL OR retry_time <= '')
+			ORDER BY queue_time ASC, rowid ASC;
+			`,
+			wantIndex: "bazel_query_jobs_pending",
+		},
+		{
+			desc: "EnqueueJob",
+			query: `
+			SELECT id FROM "bazel_query_jobs"
+			WHERE
+				repository = '' AND
+				(commit_hash = '' OR resolved_commit_hash = '') AND
+				query_string = '' AND
+				query_type = '' AND
+				bazel_flags = '' AND
+				output_format = '' AND
+				required_labels = '' AND
+				status NOT IN ('', '', '');
+			`,
+			wantIndex: "bazel_query_jobs_dedup",
+		},
+	}
+	ctx := context.Background()
+	s, err := New(ctx, filepath.Join(t.TempDir(), "jobs.sqlite"))
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+	defer s.Close()
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			rows, err := s.db.Query("EXPLAIN QUERY PLAN " + tc.query)
+			if err != nil {
+				t.Fatalf("EXPLAIN QUERY PLAN failed: %v", err)
+			}
+			defer rows.Close()
+			var plan []string
+			for rows.Next() {
+				var id, parent, unused int
+				var detail string
+				if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+					t.Fatalf("failed to read query plan: %v", err)
+				}
+				plan = append(plan, detail)
+			}
+			if got := strings.Join(plan, "\n"); !strings.Contains(got, "INDEX "+tc.wantIndex) {
+				t.Errorf("got query plan:\n%s\nwant plan using index %s", got, tc.wantIndex)
+			}
+		})
+	}
+}
@@ -3,8 +3,11 @@ package sqlite
 import (
 	"context"
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/minorhacks/bazel_remote_query/db"
@@ -14,7 +17,8 @@ import (
 )
 
 type Sqlite struct {
-	db *sql.DB
+	db       *sql.DB
+	watchers db.Watchers
 }
 
 func New(ctx context.Context, dbPath string) (*Sqlite, error) {
@@ -23,25 +27,9 @@ func New(ctx context.Context, dbPath string) (*Sqlite, error) {
 		return nil, fmt.Errorf("failed to open sqlite database %q: %w", dbPath, err)
 	}
 	sqlDB.SetMaxOpenConns(1)
-	createTableStmt := `
-	CREATE TABLE IF NOT EXISTS "bazel_query_jobs" (
-		id TEXT NOT NULL,
-		repository TEXT NOT NULL,
-		commit_hash TEXT NOT NULL,
-		query_string TEXT NOT NULL,
-		status TEXT NOT NULL,
-		worker TEXT,
-		queue_time TEXT NOT NULL,
-		start_time TEXT,
-		finish_time TEXT,
-		query_result_url TEXT,
-		query_error TEXT,
-		PRIMARY KEY(id)
-	);
-	`
-	_, err = sqlDB.Exec(createTableStmt)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create 'bazel_query_jobs' table: %w", err)
+	if err := migrate(ctx, sqlDB); err != nil {
+		sqlDB.Close()
+		return nil, err
 	}
 
 	return &Sqlite{db: sqlDB}, nil
@@ -52,6 +40,14 @@ func (s *Sqlite) Close() error {
 }
 
 func (s *Sqlite) EnqueueJob(ctx context.Context, job *db.QueryJob) (retErr error) {
+	flags, err := encodeFlags(job.BazelFlags)
+	if err != nil {
+		return err
+	}
+	labels, err := encodeLabels(job.RequiredLabels)
+	if err != nil {
+		return err
+	}
 	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
 	if err != nil {
 		return fmt.Errorf("failed to start enqueue transaction: %w", err)
@@ -62,7 +58,12 @@ func (s *Sqlite) EnqueueJob(ctx context.Context, job *db.QueryJob) (retErr error
 	SELECT
 		repository,
 		commit_hash,
+		resolved_commit_hash,
 		query_string,
+		query_type,
+		bazel_flags,
+		output_format,
+		required_labels,
 		id,
 		status,
 		worker,
@@ -70,14 +71,31 @@ func (s *Sqlite) EnqueueJob(ctx context.Context, job *db.QueryJob) (retErr error
 		start_time,
 		finish_time,
 		query_result_url,
-		query_error
+		query_error,
+		lease_expiry,
+		attempts,
+		retries,
+		failure_category,
+		exit_code,
+		stderr,
+		retry_time,
+		phase,
+		result_sha256,
+		result_size,
+		result_encoding,
+		result_inline,
+		result_metadata
 	FROM "bazel_query_jobs"
 	WHERE
 		repository = $1 AND
-		commit_hash = $2 AND
+		(commit_hash = $2 OR resolved_commit_hash = $2) AND
 		query_string = $3 AND
-		status != $4;
-	`, job.Repository, job.CommitHash, job.Query, db.StatusFailed)
+		query_type = $4 AND
+		bazel_flags = $5 AND
+		output_format = $6 AND
+		required_labels = $7 AND
+		status NOT IN ($8, $9, $10);
+	`, job.Repository, job.CommitHash, job.Query, job.QueryType, flags, job.OutputFormat, labels, db.StatusFailed, db.StatusCancelled, cacheableStatus(job.CommitHash))
 	r, err := jobFromRow(row)
 	if err != nil && !errors.Is(err, db.ErrNoOutstandingJobs) {
 		return fmt.Errorf("failed to query for existing jobs: %w", err)
@@ -90,51 +108,83 @@ func (s *Sqlite) EnqueueJob(ctx context.Context, job *db.QueryJob) (retErr error
 	INSERT INTO "bazel_query_jobs" (
 		repository,
 		commit_hash,
+		resolved_commit_hash,
 		query_string,
+		query_type,
+		bazel_flags,
+		output_format,
+		required_labels,
 		id,
 		status,
 		queue_time
 	)
-	VALUES ($1, $2, $3, $4, $5, $6);
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11);
 	`
 	id, err := uuid.NewRandom()
 	if err != nil {
 		return fmt.Errorf("failed to create UUID for query: %w", err)
 	}
+	queueTime := time.Now().UTC()
 	_, err = tx.ExecContext(
 		ctx,
 		insertStmt,
 		job.Repository,
 		job.CommitHash,
+		job.ResolvedCommitHash,
 		job.Query,
+		job.QueryType,
+		flags,
+		job.OutputFormat,
+		labels,
 		id,
 		db.StatusPending,
-		time.Now().UTC().Format(time.RFC3339),
+		queueTime.Format(time.RFC3339),
 	)
 	if err != nil {
 		return fmt.Errorf("failed to queue query: %w", err)
 	}
 	job.ID = id.String()
+	job.Status = db.StatusPending
+	job.QueueTime = queueTime
 
 	if err := tx.Commit(); err != nil {
 		return fmt.Errorf("failed to commit queued query: %w", err)
 	}
+	s.watchers.Notify(job)
 	return nil
 }
 
-func (s *Sqlite) DequeueJob(ctx context.Context, workerName string) (*db.QueryJob, error) {
+func (s *Sqlite) DequeueJob(ctx context.Context, worker *db.Worker, leaseExpiry time.Time) (*db.QueryJob, error) {
 	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
 	if err != nil {
 		return nil, fmt.Errorf("failed to start dequeue transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	// Get the first job in PENDING state
-	row := tx.QueryRowContext(ctx, `
+	// Get the first job in PENDING state that isn't waiting to be retried, and
+	// that the worker can run. Labels are stored as JSON, so they are matched
+	// after the query.
+	now := time.Now().UTC()
+	args := []interface{}{db.StatusPending, now.Format(time.RFC3339)}
+	repoCond := ""
+	if len(worker.Repositories) > 0 {
+		var placeholders []string
+		for _, r := range worker.Repositories {
+			args = append(args, r)
+			placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+		}
+		repoCond = fmt.Sprintf("AND repository IN (%s)", strings.Join(placeholders, ", "))
+	}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`
 	SELECT
 		repository,
 		commit_hash,
+		resolved_commit_hash,
 		query_string,
+		query_type,
+		bazel_flags,
+		output_format,
+		required_labels,
 		id,
 		status,
 		worker,
@@ -142,30 +192,72 @@ func (s *Sqlite) DequeueJob(ctx context.Context, workerName string) (*db.QueryJo
 		start_time,
 		finish_time,
 		query_result_url,
-		query_error
+		query_error,
+		lease_expiry,
+		attempts,
+		retries,
+		failure_category,
+		exit_code,
+		stderr,
+		retry_time,
+		phase,
+		result_sha256,
+		result_size,
+		result_encoding,
+		result_inline,
+		result_metadata
 	FROM "bazel_query_jobs"
-	WHERE status = $1
-	ORDER BY queue_time ASC;
-	`, db.StatusPending)
-	job, err := jobFromRow(row)
+	WHERE
+		status = $1 AND
+		(retry_time IS NULL OR retry_time <= $2)
+		%s
+	ORDER BY queue_time ASC, rowid ASC;
+	`, repoCond), args...)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to query for pending jobs: %w", err)
+	}
+	var job *db.QueryJob
+	for rows.Next() {
+		j, err := jobFromRow(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if worker.CanRun(j) {
+			job = j
+			break
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query for pending jobs: %w", err)
+	}
+	if job == nil {
+		return nil, db.ErrNoOutstandingJobs
 	}
 
 	job.Status = db.StatusRunning
-	job.Worker = &workerName
-	now := time.Now().UTC()
+	job.Worker = &worker.Name
 	job.StartTime = &now
+	job.RetryTime = nil
+	job.Phase = ""
+	leaseExpiry = leaseExpiry.UTC()
+	job.LeaseExpiry = &leaseExpiry
+	job.Attempts++
 
 	result, err := tx.ExecContext(ctx, `
 	UPDATE "bazel_query_jobs"
 	SET
 		status = $1,
 		worker = $2,
-		start_time = $3
+		start_time = $3,
+		lease_expiry = $4,
+		attempts = $5,
+		retry_time = NULL,
+		phase = ''
 	WHERE
-		id = $4;
-	`, job.Status, job.Worker, job.StartTime.UTC().Format(time.RFC3339), job.ID)
+		id = $6;
+	`, job.Status, job.Worker, job.StartTime.UTC().Format(time.RFC3339), job.LeaseExpiry.Format(time.RFC3339), job.Attempts, job.ID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to mark job %s as running: %w", job.ID, err)
 	}
@@ -175,6 +267,7 @@ func (s *Sqlite) DequeueJob(ctx context.Context, workerName string) (*db.QueryJo
 	if err := tx.Commit(); err != nil {
 		return nil, fmt.Errorf("failed to commit job assignment for %s: %w", job.ID, err)
 	}
+	s.watchers.Notify(job)
 	return job, nil
 }
 
@@ -183,7 +276,12 @@ func (s *Sqlite) GetJob(ctx context.Context, id string) (*db.QueryJob, error) {
 	SELECT
 		repository,
 		commit_hash,
+		resolved_commit_hash,
 		query_string,
+		query_type,
+		bazel_flags,
+		output_format,
+		required_labels,
 		id,
 		status,
 		worker,
@@ -191,21 +289,170 @@ func (s *Sqlite) GetJob(ctx context.Context, id string) (*db.QueryJob, error) {
 		start_time,
 		finish_time,
 		query_result_url,
-		query_error
+		query_error,
+		lease_expiry,
+		attempts,
+		retries,
+		failure_category,
+		exit_code,
+		stderr,
+		retry_time,
+		phase,
+		result_sha256,
+		result_size,
+		result_encoding,
+		result_inline,
+		result_metadata
 	FROM "bazel_query_jobs"
 	WHERE id = $1;
 	`, id)
-	if err := row.Err(); errors.Is(err, sql.ErrNoRows) {
+	job, err := jobFromRow(row)
+	if errors.Is(err, db.ErrNoOutstandingJobs) {
 		return nil, fmt.Errorf("job %s: %w", id, db.ErrJobNotFound)
 	}
-	return jobFromRow(row)
+	return job, err
+}
+
+func (s *Sqlite) ListJobs(ctx context.Context, filter *db.ListJobsFilter, pageSize int, pageToken string) ([]*db.QueryJob, string, error) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+	addCond := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if filter.Repository != "" {
+		addCond("repository = $%d", filter.Repository)
+	}
+	if filter.CommitHash != "" {
+		addCond("(commit_hash = $%[1]d OR resolved_commit_hash = $%[1]d)", filter.CommitHash)
+	}
+	if filter.Status != "" {
+		addCond("status = $%d", filter.Status)
+	}
+	if filter.Worker != "" {
+		addCond("worker = $%d", filter.Worker)
+	}
+	if !filter.QueuedAfter.IsZero() {
+		addCond("queue_time >= $%d", filter.QueuedAfter.UTC().Format(time.RFC3339))
+	}
+	if !filter.QueuedBefore.IsZero() {
+		addCond("queue_time < $%d", filter.QueuedBefore.UTC().Format(time.RFC3339))
+	}
+	if pageToken != "" {
+		queueTime, id, err := decodePageToken(pageToken)
+		if err != nil {
+			return nil, "", err
+		}
+		args = append(args, queueTime, id)
+		conds = append(conds, fmt.Sprintf("(queue_time, id) < ($%d, $%d)", len(args)-1, len(args)))
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = "WHERE " + strings.Join(conds, " AND ")
+	}
+	// Fetch one extra row to find out whether there is another page
+	args = append(args, pageSize+1)
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`
+	SELECT
+		repository,
+		commit_hash,
+		resolved_commit_hash,
+		query_string,
+		query_type,
+		bazel_flags,
+		output_format,
+		required_labels,
+		id,
+		status,
+		worker,
+		queue_time,
+		start_time,
+		finish_time,
+		query_result_url,
+		query_error,
+		lease_expiry,
+		attempts,
+		retries,
+		failure_category,
+		exit_code,
+		stderr,
+		retry_time,
+		phase,
+		result_sha256,
+		result_size,
+		result_encoding,
+		result_inline,
+		result_metadata
+	FROM "bazel_query_jobs"
+	%s
+	ORDER BY queue_time DESC, id DESC
+	LIMIT $%d;
+	`, where, len(args)), args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var jobs []*db.QueryJob
+	for rows.Next() {
+		job, err := jobFromRow(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("failed to list jobs: %w", err)
+	}
+
+	var nextPageToken string
+	if len(jobs) > pageSize {
+		jobs = jobs[:pageSize]
+		last := jobs[len(jobs)-1]
+		nextPageToken = encodePageToken(last.QueueTime.UTC().Format(time.RFC3339), last.ID)
+	}
+	return jobs, nextPageToken, nil
+}
+
+func (s *Sqlite) QueuePosition(ctx context.Context, job *db.QueryJob) (int, error) {
+	// Queue times only have second resolution, so jobs queued in the same
+	// second are ordered by insertion, as in DequeueJob
+	var pos int
+	err := s.db.QueryRowContext(ctx, `
+	SELECT COUNT(*)
+	FROM "bazel_query_jobs"
+	WHERE
+		status = $1 AND
+		(queue_time < $2 OR (
+			queue_time = $2 AND
+			rowid < (SELECT rowid FROM "bazel_query_jobs" WHERE id = $3)
+		));
+	`, db.StatusPending, job.QueueTime.UTC().Format(time.RFC3339), job.ID).Scan(&pos)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count jobs queued before %s: %w", job.ID, err)
+	}
+	return pos, nil
 }
 
-func (s *Sqlite) FinishJob(ctx context.Context, id string, status string, result string) error {
+func (s *Sqlite) FinishJob(ctx context.Context, id string, workerName string, status string, result *db.JobResult) error {
 	var (
-		sqlRes sql.Result
-		err    error
+		sqlRes   sql.Result
+		err      error
+		resolved *string
+		url      *string
 	)
+	metadata, err := json.Marshal(result.Metadata)
+	if err != nil {
+		return fmt.Errorf("failed to marshal result metadata: %w", err)
+	}
+	if result.ResolvedCommitHash != "" {
+		resolved = &result.ResolvedCommitHash
+	}
+	if result.URL != "" {
+		url = &result.URL
+	}
 	switch status {
 	case db.StatusSucceeded:
 		sqlRes, err = s.db.ExecContext(ctx, `
@@ -213,43 +460,487 @@ func (s *Sqlite) FinishJob(ctx context.Context, id string, status string, result
 		SET
 			status = $1,
 			finish_time = $2,
-			query_result_url = $3
+			query_result_url = $3,
+			resolved_commit_hash = COALESCE($4, resolved_commit_hash),
+			result_sha256 = $5,
+			result_size = $6,
+			result_encoding = $7,
+			result_inline = $8,
+			result_metadata = $9
 		WHERE
-			id = $4;
-		`, status, time.Now().UTC().Format(time.RFC3339), result, id)
+			id = $10 AND
+			status = $11 AND
+			worker = $12;
+		`, status, time.Now().UTC().Format(time.RFC3339), url, resolved, result.SHA256, result.Size, result.Encoding, result.Inline, string(metadata), id, db.StatusRunning, workerName)
 	case db.StatusFailed:
 		sqlRes, err = s.db.ExecContext(ctx, `
 		UPDATE "bazel_query_jobs"
 		SET
 			status = $1,
 			finish_time = $2,
-			query_error = $3
+			query_error = $3,
+			resolved_commit_hash = COALESCE($4, resolved_commit_hash),
+			failure_category = $5,
+			exit_code = $6,
+			stderr = $7
 		WHERE
-			id = $4;
-		`, status, time.Now().UTC().Format(time.RFC3339), result, id)
+			id = $8 AND
+			status = $9 AND
+			worker = $10;
+		`, status, time.Now().UTC().Format(time.RFC3339), result.Error, resolved, result.FailureCategory, result.ExitCode, result.Stderr, id, db.StatusRunning, workerName)
 	default:
 		return fmt.Errorf("can't finish job using status %q", status)
 	}
 	if err != nil {
 		return fmt.Errorf("failed to mark job %s as done: %w", id, err)
 	}
-	if n, err := sqlRes.RowsAffected(); err != nil || n != 1 {
+	n, err := sqlRes.RowsAffected()
+	if err == nil && n == 0 {
+		// Either the job doesn't exist, or it is no longer running on the
+		// worker
+		job, err := s.GetJob(ctx, id)
+		if err != nil {
+			return err
+		}
+		if job.Status == db.StatusCancelled {
+			return fmt.Errorf("can't finish job %s: %w", id, db.ErrJobCancelled)
+		}
+		return fmt.Errorf("job %s is no longer running on worker %q: %w", id, workerName, db.ErrLeaseExpired)
+	}
+	if err != nil || n != 1 {
 		return fmt.Errorf("want 1 row affected; got %d rows affected with error: %w", n, err)
 	}
+	if job, err := s.GetJob(ctx, id); err == nil {
+		s.watchers.Notify(job)
+	}
 	return nil
 }
 
-func jobFromRow(r *sql.Row) (*db.QueryJob, error) {
+func (s *Sqlite) RetryJob(ctx context.Context, id string, workerName string, retryTime time.Time, result *db.JobResult) error {
+	sqlRes, err := s.db.ExecContext(ctx, `
+	UPDATE "bazel_query_jobs"
+	SET
+		status = $1,
+		worker = NULL,
+		start_time = NULL,
+		lease_expiry = NULL,
+		query_error = $2,
+		failure_category = $3,
+		exit_code = $4,
+		stderr = $5,
+		retry_time = $6,
+		retries = retries + 1
+	WHERE
+		id = $7 AND
+		status = $8 AND
+		worker = $9;
+	`, db.StatusPending, result.Error, result.FailureCategory, result.ExitCode, result.Stderr, retryTime.UTC().Format(time.RFC3339), id, db.StatusRunning, workerName)
+	if err != nil {
+		return fmt.Errorf("failed to requeue job %s for retry: %w", id, err)
+	}
+	n, err := sqlRes.RowsAffected()
+	if err == nil && n == 0 {
+		// Either the job doesn't exist, or it is no longer running on the
+		// worker
+		job, err := s.GetJob(ctx, id)
+		if err != nil {
+			return err
+		}
+		if job.Status == db.StatusCancelled {
+			return fmt.Errorf("can't retry job %s: %w", id, db.ErrJobCancelled)
+		}
+		return fmt.Errorf("job %s is no longer running on worker %q: %w", id, workerName, db.ErrLeaseExpired)
+	}
+	if err != nil || n != 1 {
+		return fmt.Errorf("want 1 row affected; got %d rows affected with error: %w", n, err)
+	}
+	if job, err := s.GetJob(ctx, id); err == nil {
+		s.watchers.Notify(job)
+	}
+	return nil
+}
+
+func (s *Sqlite) CancelJob(ctx context.Context, id string) (*db.QueryJob, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start cancel transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, `
+	SELECT
+		repository,
+		commit_hash,
+		resolved_commit_hash,
+		query_string,
+		query_type,
+		bazel_flags,
+		output_format,
+		required_labels,
+		id,
+		status,
+		worker,
+		queue_time,
+		start_time,
+		finish_time,
+		query_result_url,
+		query_error,
+		lease_expiry,
+		attempts,
+		retries,
+		failure_category,
+		exit_code,
+		stderr,
+		retry_time,
+		phase,
+		result_sha256,
+		result_size,
+		result_encoding,
+		result_inline,
+		result_metadata
+	FROM "bazel_query_jobs"
+	WHERE id = $1;
+	`, id)
+	job, err := jobFromRow(row)
+	if errors.Is(err, db.ErrNoOutstandingJobs) {
+		return nil, fmt.Errorf("job %s: %w", id, db.ErrJobNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+	if job.Status != db.StatusPending && job.Status != db.StatusRunning {
+		return nil, fmt.Errorf("can't cancel job %s with status %q: %w", id, job.Status, db.ErrJobFinished)
+	}
+
+	job.Status = db.StatusCancelled
+	now := time.Now().UTC()
+	job.FinishTime = &now
+
+	result, err := tx.ExecContext(ctx, `
+	UPDATE "bazel_query_jobs"
+	SET
+		status = $1,
+		finish_time = $2
+	WHERE
+		id = $3;
+	`, job.Status, job.FinishTime.Format(time.RFC3339), job.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to mark job %s as cancelled: %w", job.ID, err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return nil, fmt.Errorf("want 1 row affected, got %d rows affected with error: %w", n, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit cancellation of %s: %w", job.ID, err)
+	}
+	s.watchers.Notify(job)
+	return job, nil
+}
+
+func (s *Sqlite) RenewLease(ctx context.Context, id string, workerName string, leaseExpiry time.Time) (*db.QueryJob, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start lease renewal transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, `
+	SELECT
+		repository,
+		commit_hash,
+		resolved_commit_hash,
+		query_string,
+		query_type,
+		bazel_flags,
+		output_format,
+		required_labels,
+		id,
+		status,
+		worker,
+		queue_time,
+		start_time,
+		finish_time,
+		query_result_url,
+		query_error,
+		lease_expiry,
+		attempts,
+		retries,
+		failure_category,
+		exit_code,
+		stderr,
+		retry_time,
+		phase,
+		result_sha256,
+		result_size,
+		result_encoding,
+		result_inline,
+		result_metadata
+	FROM "bazel_query_jobs"
+	WHERE id = $1;
+	`, id)
+	job, err := jobFromRow(row)
+	if errors.Is(err, db.ErrNoOutstandingJobs) {
+		return nil, fmt.Errorf("job %s: %w", id, db.ErrJobNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+	if job.Status == db.StatusCancelled {
+		return nil, fmt.Errorf("can't renew lease on job %s: %w", id, db.ErrJobCancelled)
+	}
+	if job.Status != db.StatusRunning || job.Worker == nil || *job.Worker != workerName {
+		return nil, fmt.Errorf("job %s is no longer running on worker %q: %w", id, workerName, db.ErrLeaseExpired)
+	}
+
+	leaseExpiry = leaseExpiry.UTC()
+	job.LeaseExpiry = &leaseExpiry
+	result, err := tx.ExecContext(ctx, `
+	UPDATE "bazel_query_jobs"
+	SET
+		lease_expiry = $1
+	WHERE
+		id = $2;
+	`, job.LeaseExpiry.Format(time.RFC3339), job.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to renew lease on job %s: %w", job.ID, err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return nil, fmt.Errorf("want 1 row affected, got %d rows affected with error: %w", n, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit lease renewal for %s: %w", job.ID, err)
+	}
+	return job, nil
+}
+
+func (s *Sqlite) RequeueExpiredJobs(ctx context.Context, now time.Time, maxAttempts int) (int, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return 0, fmt.Errorf("failed to start requeue transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+	SELECT
+		repository,
+		commit_hash,
+		resolved_commit_hash,
+		query_string,
+		query_type,
+		bazel_flags,
+		output_format,
+		required_labels,
+		id,
+		status,
+		worker,
+		queue_time,
+		start_time,
+		finish_time,
+		query_result_url,
+		query_error,
+		lease_expiry,
+		attempts,
+		retries,
+		failure_category,
+		exit_code,
+		stderr,
+		retry_time,
+		phase,
+		result_sha256,
+		result_size,
+		result_encoding,
+		result_inline,
+		result_metadata
+	FROM "bazel_query_jobs"
+	WHERE
+		status = $1 AND
+		lease_expiry < $2;
+	`, db.StatusRunning, now.UTC().Format(time.RFC3339))
+	if err != nil {
+		return 0, fmt.Errorf("failed to query for expired jobs: %w", err)
+	}
+	var jobs []*db.QueryJob
+	for rows.Next() {
+		job, err := jobFromRow(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to query for expired jobs: %w", err)
+	}
+
+	for _, job := range jobs {
+		var result sql.Result
+		if job.Attempts-job.Retries >= maxAttempts {
+			msg := fmt.Sprintf("job abandoned by workers %d times", job.Attempts-job.Retries)
+			finishTime := now.UTC()
+			job.Status = db.StatusFailed
+			job.ResultError = &msg
+			job.FailureCategory = db.FailureCategoryInfrastructure
+			job.FinishTime = &finishTime
+			job.LeaseExpiry = nil
+			result, err = tx.ExecContext(ctx, `
+			UPDATE "bazel_query_jobs"
+			SET
+				status = $1,
+				query_error = $2,
+				failure_category = $3,
+				finish_time = $4,
+				lease_expiry = NULL
+			WHERE
+				id = $5;
+			`, job.Status, msg, job.FailureCategory, finishTime.Format(time.RFC3339), job.ID)
+		} else {
+			job.Status = db.StatusPending
+			job.Worker = nil
+			job.StartTime = nil
+			job.LeaseExpiry = nil
+			result, err = tx.ExecContext(ctx, `
+			UPDATE "bazel_query_jobs"
+			SET
+				status = $1,
+				worker = NULL,
+				start_time = NULL,
+				lease_expiry = NULL
+			WHERE
+				id = $2;
+			`, job.Status, job.ID)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to requeue job %s: %w", job.ID, err)
+		}
+		if n, err := result.RowsAffected(); err != nil || n != 1 {
+			return 0, fmt.Errorf("want 1 row affected, got %d rows affected with error: %w", n, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit requeue of expired jobs: %w", err)
+	}
+	for _, job := range jobs {
+		s.watchers.Notify(job)
+	}
+	return len(jobs), nil
+}
+
+func (s *Sqlite) SetJobPhase(ctx context.Context, id string, workerName string, phase string) error {
+	result, err := s.db.ExecContext(ctx, `
+	UPDATE "bazel_query_jobs"
+	SET
+		phase = $1
+	WHERE
+		id = $2 AND
+		status = $3 AND
+		worker = $4;
+	`, phase, id, db.StatusRunning, workerName)
+	if err != nil {
+		return fmt.Errorf("failed to set phase of job %s: %w", id, err)
+	}
+	n, err := result.RowsAffected()
+	if err == nil && n == 0 {
+		// Either the job doesn't exist, or it is no longer running on workerName
+		job, err := s.GetJob(ctx, id)
+		if err != nil {
+			return err
+		}
+		if job.Status == db.StatusCancelled {
+			return fmt.Errorf("can't set phase of job %s: %w", id, db.ErrJobCancelled)
+		}
+		return fmt.Errorf("job %s is no longer running on worker %q: %w", id, workerName, db.ErrLeaseExpired)
+	}
+	if err != nil || n != 1 {
+		return fmt.Errorf("want 1 row affected; got %d rows affected with error: %w", n, err)
+	}
+	if job, err := s.GetJob(ctx, id); err == nil {
+		s.watchers.Notify(job)
+	}
+	return nil
+}
+
+func (s *Sqlite) WatchJob(id string) (<-chan *db.QueryJob, func()) {
+	return s.watchers.Watch(id)
+}
+
+// encodePageToken returns an opaque token identifying the position of a job in
+// the (queue_time, id) ordering used by ListJobs.
+func encodePageToken(queueTime string, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(queueTime + "|" + id))
+}
+
+func decodePageToken(token string) (queueTime string, id string, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %v", db.ErrInvalidPageToken, err)
+	}
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 {
+		return "", "", db.ErrInvalidPageToken
+	}
+	return parts[0], parts[1], nil
+}
+
+// cacheableStatus returns the status that, in addition to failed and
+// cancelled, is excluded when looking for a duplicate of a job queued at
+// committish. Succeeded jobs can only be reused if committish always refers
+// to the same commit.
+func cacheableStatus(committish string) string {
+	if db.IsCommitHash(committish) {
+		// Excluding failed jobs again is a no-op
+		return db.StatusFailed
+	}
+	return db.StatusSucceeded
+}
+
+// encodeFlags encodes Bazel flags as a JSON list, so that they can be stored in
+// a single column and compared as part of the deduplication key.
+func encodeFlags(flags []string) (string, error) {
+	if flags == nil {
+		flags = []string{}
+	}
+	encoded, err := json.Marshal(flags)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode bazel flags: %w", err)
+	}
+	return string(encoded), nil
+}
+
+// encodeLabels encodes required labels as a JSON list, like encodeFlags.
+func encodeLabels(labels []string) (string, error) {
+	if labels == nil {
+		labels = []string{}
+	}
+	encoded, err := json.Marshal(labels)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode required labels: %w", err)
+	}
+	return string(encoded), nil
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func jobFromRow(r scanner) (*db.QueryJob, error) {
 	var (
-		j          db.QueryJob
-		queryTime  string
-		startTime  *string
-		finishTime *string
+		j           db.QueryJob
+		flags       string
+		labels      string
+		queryTime   string
+		startTime   *string
+		finishTime  *string
+		leaseExpiry *string
+		retryTime   *string
+		metadata    string
 	)
 	err := r.Scan(
 		&j.Repository,
 		&j.CommitHash,
+		&j.ResolvedCommitHash,
 		&j.Query,
+		&j.QueryType,
+		&flags,
+		&j.OutputFormat,
+		&labels,
 		&j.ID,
 		&j.Status,
 		&j.Worker,
@@ -258,12 +949,40 @@ func jobFromRow(r *sql.Row) (*db.QueryJob, error) {
 		&finishTime,
 		&j.ResultURL,
 		&j.ResultError,
+		&leaseExpiry,
+		&j.Attempts,
+		&j.Retries,
+		&j.FailureCategory,
+		&j.ExitCode,
+		&j.Stderr,
+		&retryTime,
+		&j.Phase,
+		&j.ResultSHA256,
+		&j.ResultSize,
+		&j.ResultEncoding,
+		&j.ResultInline,
+		&metadata,
 	)
 	if err != nil && errors.Is(err, sql.ErrNoRows) {
 		return nil, db.ErrNoOutstandingJobs
 	} else if err != nil {
 		return nil, fmt.Errorf("while translating sqlite row to QueryJob: %w", err)
 	}
+	if err := json.Unmarshal([]byte(flags), &j.BazelFlags); err != nil {
+		return nil, fmt.Errorf("failed to parse bazel_flags for job %s: %w", j.ID, err)
+	}
+	if len(j.BazelFlags) == 0 {
+		j.BazelFlags = nil
+	}
+	if err := json.Unmarshal([]byte(labels), &j.RequiredLabels); err != nil {
+		return nil, fmt.Errorf("failed to parse required_labels for job %s: %w", j.ID, err)
+	}
+	if len(j.RequiredLabels) == 0 {
+		j.RequiredLabels = nil
+	}
+	if err := json.Unmarshal([]byte(metadata), &j.ResultMetadata); err != nil {
+		return nil, fmt.Errorf("failed to parse result_metadata for job %s: %w", j.ID, err)
+	}
 	j.QueueTime, err = time.Parse(time.RFC3339, queryTime)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse query_time for job %s: %w", j.ID, err)
@@ -282,5 +1001,19 @@ func jobFromRow(r *sql.Row) (*db.QueryJob, error) {
 		}
 		j.FinishTime = &t
 	}
+	if leaseExpiry != nil {
+		t, err := time.Parse(time.RFC3339, *leaseExpiry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse lease_expiry for job %s: %w", j.ID, err)
+		}
+		j.LeaseExpiry = &t
+	}
+	if retryTime != nil {
+		t, err := time.Parse(time.RFC3339, *retryTime)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse retry_time for job %s: %w", j.ID, err)
+		}
+		j.RetryTime = &t
+	}
 	return &j, nil
 }
@@ -0,0 +1,84 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/minorhacks/bazel_remote_query/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDequeueMatchesWorker(t *testing.T) {
+	for _, tc := range backends {
+		t.Run(tc.desc, func(t *testing.T) {
+			tempDB, cleanup, err := tc.dbFactory(t)
+			if err != nil {
+				return
+			}
+			defer tempDB.Close()
+			defer cleanup()
+
+			ctx := context.Background()
+			enqueue := func(repo string, labels map[string]string) string {
+				t.Helper()
+				job := &db.QueryJob{
+					Repository:     repo,
+					CommitHash:     "foobar",
+					Query:          "deps(//...)",
+					QueryType:      db.QueryTypeQuery,
+					OutputFormat:   db.OutputFormatProto,
+					RequiredLabels: db.LabelList(labels),
+				}
+				assert.Nil(t, tempDB.EnqueueJob(ctx, job))
+				return job.ID
+			}
+			dequeue := func(worker *db.Worker) (string, error) {
+				t.Helper()
+				job, err := tempDB.DequeueJob(ctx, worker, time.Now().Add(time.Minute))
+				if err != nil {
+					return "", err
+				}
+				return job.ID, nil
+			}
+
+			grpcJob := enqueue("https://github.com/grpc/grpc", map[string]string{"bazel_version": "5.1.0"})
+			abseilJob := enqueue("https://github.com/abseil/abseil-cpp", nil)
+			// Required labels are part of the deduplication key
+			unlabeledJob := enqueue("https://github.com/grpc/grpc", nil)
+			assert.NotEqual(t, grpcJob, unlabeledJob)
+
+			// Workers are only given jobs for their repositories...
+			id, err := dequeue(&db.Worker{
+				Name:         "worker-0",
+				Repositories: []string{"https://github.com/abseil/abseil-cpp"},
+			})
+			assert.Nil(t, err)
+			assert.Equal(t, abseilJob, id)
+
+			// ...and with labels they have
+			unlabeledWorker := &db.Worker{
+				Name:         "worker-1",
+				Repositories: []string{"https://github.com/grpc/grpc"},
+			}
+			id, err = dequeue(unlabeledWorker)
+			assert.Nil(t, err)
+			assert.Equal(t, unlabeledJob, id)
+			_, err = dequeue(unlabeledWorker)
+			assert.True(t, errors.Is(err, db.ErrNoOutstandingJobs), "got error: %v", err)
+			id, err = dequeue(&db.Worker{
+				Name:         "worker-2",
+				Repositories: []string{"https://github.com/grpc/grpc"},
+				Labels:       map[string]string{"bazel_version": "5.1.0", "os": "linux"},
+			})
+			assert.Nil(t, err)
+			assert.Equal(t, grpcJob, id)
+
+			job, err := tempDB.GetJob(ctx, grpcJob)
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"bazel_version=5.1.0"}, job.RequiredLabels)
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/minorhacks/bazel_remote_query/db"
+	"github.com/minorhacks/bazel_remote_query/db/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	for _, tc := range backends {
+		t.Run(tc.desc, func(t *testing.T) {
+			conformance.Run(t, tc.dbFactory)
+		})
+	}
+
+	t.Run("fake", func(t *testing.T) {
+		conformance.Run(t, func(t *testing.T) (db.DB, func(), error) {
+			return &db.Fake{}, func() {}, nil
+		}, conformance.FakeSkips...)
+	})
+}
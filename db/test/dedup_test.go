@@ -0,0 +1,117 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/minorhacks/bazel_remote_query/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnqueueDedup(t *testing.T) {
+	for _, tc := range backends {
+		t.Run(tc.desc, func(t *testing.T) {
+			tempDB, cleanup, err := tc.dbFactory(t)
+			if err != nil {
+				return
+			}
+			defer tempDB.Close()
+			defer cleanup()
+
+			ctx := context.Background()
+			newJob := func(queryType string, flags ...string) *db.QueryJob {
+				return &db.QueryJob{
+					Repository:   "https://github.com/grpc/grpc",
+					CommitHash:   "foobar",
+					Query:        "deps(//...)",
+					QueryType:    queryType,
+					BazelFlags:   flags,
+					OutputFormat: db.OutputFormatProto,
+				}
+			}
+			enqueue := func(job *db.QueryJob) string {
+				t.Helper()
+				assert.Nil(t, tempDB.EnqueueJob(ctx, job))
+				return job.ID
+			}
+
+			query := enqueue(newJob(db.QueryTypeQuery))
+			assert.Equal(t, query, enqueue(newJob(db.QueryTypeQuery)))
+			assert.Equal(t, query, enqueue(newJob(db.QueryTypeQuery, []string{}...)))
+
+			cquery := enqueue(newJob(db.QueryTypeCquery))
+			assert.NotEqual(t, query, cquery)
+
+			withFlags := enqueue(newJob(db.QueryTypeQuery, "--keep_going", "--noimplicit_deps"))
+			assert.NotEqual(t, query, withFlags)
+			assert.Equal(t, withFlags, enqueue(newJob(db.QueryTypeQuery, "--keep_going", "--noimplicit_deps")))
+			assert.NotEqual(t, withFlags, enqueue(newJob(db.QueryTypeQuery, "--noimplicit_deps", "--keep_going")))
+
+			labelKind := newJob(db.QueryTypeQuery)
+			labelKind.OutputFormat = db.OutputFormatLabelKind
+			assert.NotEqual(t, query, enqueue(labelKind))
+
+			job, err := tempDB.GetJob(ctx, withFlags)
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"--keep_going", "--noimplicit_deps"}, job.BazelFlags)
+		})
+	}
+}
+
+func TestEnqueueDedupResolvedCommit(t *testing.T) {
+	const commit = "0123456789abcdef0123456789abcdef01234567"
+	for _, tc := range backends {
+		t.Run(tc.desc, func(t *testing.T) {
+			tempDB, cleanup, err := tc.dbFactory(t)
+			if err != nil {
+				return
+			}
+			defer tempDB.Close()
+			defer cleanup()
+
+			ctx := context.Background()
+			enqueue := func(committish string) string {
+				t.Helper()
+				job := &db.QueryJob{
+					Repository:   "https://github.com/grpc/grpc",
+					CommitHash:   committish,
+					Query:        "deps(//...)",
+					QueryType:    db.QueryTypeQuery,
+					OutputFormat: db.OutputFormatProto,
+				}
+				assert.Nil(t, tempDB.EnqueueJob(ctx, job))
+				return job.ID
+			}
+
+			// Pending jobs at a branch are deduplicated
+			branch := enqueue("main")
+			assert.Equal(t, branch, enqueue("main"))
+
+			_, err = tempDB.DequeueJob(ctx, &db.Worker{Name: "worker"}, time.Now().Add(time.Minute))
+			assert.Nil(t, err)
+			assert.Nil(t, tempDB.FinishJob(ctx, branch, "worker", db.StatusSucceeded, &db.JobResult{
+				URL:                "gs://bucket/result",
+				SHA256:             "0123abcd",
+				Size:               42,
+				Encoding:           db.EncodingZstd,
+				ResolvedCommitHash: commit,
+			}))
+
+			job, err := tempDB.GetJob(ctx, branch)
+			assert.Nil(t, err)
+			if assert.NotNil(t, job.ResolvedCommitHash) {
+				assert.Equal(t, commit, *job.ResolvedCommitHash)
+			}
+			assert.Equal(t, "0123abcd", job.ResultSHA256)
+			assert.Equal(t, int64(42), job.ResultSize)
+			assert.Equal(t, db.EncodingZstd, job.ResultEncoding)
+
+			// The branch may have moved since, so its result isn't reused...
+			assert.NotEqual(t, branch, enqueue("main"))
+			// ...but it is reused for the commit it resolved to
+			assert.Equal(t, branch, enqueue(commit))
+		})
+	}
+}
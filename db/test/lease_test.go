@@ -0,0 +1,195 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/minorhacks/bazel_remote_query/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeaseExpiry(t *testing.T) {
+	for _, tc := range backends {
+		t.Run(tc.desc, func(t *testing.T) {
+			tempDB, cleanup, err := tc.dbFactory(t)
+			if err != nil {
+				return
+			}
+			defer tempDB.Close()
+			defer cleanup()
+
+			ctx := context.Background()
+			now := time.Now().UTC().Truncate(time.Second)
+			const maxAttempts = 2
+
+			job := &db.QueryJob{
+				Repository:   "https://github.com/grpc/grpc",
+				CommitHash:   "foobar",
+				Query:        "deps(//...)",
+				QueryType:    db.QueryTypeQuery,
+				OutputFormat: db.OutputFormatProto,
+			}
+			assert.Nil(t, tempDB.EnqueueJob(ctx, job))
+
+			// A job with a live lease is left alone
+			running, err := tempDB.DequeueJob(ctx, &db.Worker{Name: "worker-0"}, now.Add(time.Minute))
+			assert.Nil(t, err)
+			assert.Equal(t, 1, running.Attempts)
+			n, err := tempDB.RequeueExpiredJobs(ctx, now, maxAttempts)
+			assert.Nil(t, err)
+			assert.Equal(t, 0, n)
+
+			// Only the worker holding the lease can renew it
+			_, err = tempDB.RenewLease(ctx, job.ID, "worker-1", now.Add(time.Minute))
+			assert.True(t, errors.Is(err, db.ErrLeaseExpired), "got error: %v", err)
+			renewed, err := tempDB.RenewLease(ctx, job.ID, "worker-0", now.Add(-time.Second))
+			assert.Nil(t, err)
+			assert.Equal(t, now.Add(-time.Second), *renewed.LeaseExpiry)
+
+			// Once the lease expires, the job is requeued
+			n, err = tempDB.RequeueExpiredJobs(ctx, now, maxAttempts)
+			assert.Nil(t, err)
+			assert.Equal(t, 1, n)
+			got, err := tempDB.GetJob(ctx, job.ID)
+			assert.Nil(t, err)
+			assert.Equal(t, db.StatusPending, got.Status)
+			assert.Nil(t, got.Worker)
+			assert.Nil(t, got.LeaseExpiry)
+			_, err = tempDB.RenewLease(ctx, job.ID, "worker-0", now.Add(time.Minute))
+			assert.True(t, errors.Is(err, db.ErrLeaseExpired), "got error: %v", err)
+
+			// After too many attempts, the job fails
+			running, err = tempDB.DequeueJob(ctx, &db.Worker{Name: "worker-1"}, now.Add(-time.Second))
+			assert.Nil(t, err)
+			assert.Equal(t, job.ID, running.ID)
+			assert.Equal(t, 2, running.Attempts)
+			// The worker that lost the lease can't finish the job
+			err = tempDB.FinishJob(ctx, job.ID, "worker-0", db.StatusSucceeded, &db.JobResult{URL: "gs://bucket/result"})
+			assert.True(t, errors.Is(err, db.ErrLeaseExpired), "got error: %v", err)
+			n, err = tempDB.RequeueExpiredJobs(ctx, now, maxAttempts)
+			assert.Nil(t, err)
+			assert.Equal(t, 1, n)
+			got, err = tempDB.GetJob(ctx, job.ID)
+			assert.Nil(t, err)
+			assert.Equal(t, db.StatusFailed, got.Status)
+			assert.NotNil(t, got.ResultError)
+		})
+	}
+}
+
+func TestLeaseExpiryAfterRetry(t *testing.T) {
+	for _, tc := range backends {
+		t.Run(tc.desc, func(t *testing.T) {
+			tempDB, cleanup, err := tc.dbFactory(t)
+			if err != nil {
+				return
+			}
+			defer tempDB.Close()
+			defer cleanup()
+
+			ctx := context.Background()
+			now := time.Now().UTC().Truncate(time.Second)
+			const maxAttempts = 2
+
+			job := &db.QueryJob{
+				Repository:   "https://github.com/grpc/grpc",
+				CommitHash:   "foobar",
+				Query:        "deps(//...)",
+				QueryType:    db.QueryTypeQuery,
+				OutputFormat: db.OutputFormatProto,
+			}
+			assert.Nil(t, tempDB.EnqueueJob(ctx, job))
+			_, err = tempDB.DequeueJob(ctx, &db.Worker{Name: "worker-0"}, now.Add(time.Minute))
+			assert.Nil(t, err)
+			result := &db.JobResult{
+				Error:           "failed to fetch",
+				FailureCategory: db.FailureCategoryInfrastructure,
+			}
+			assert.Nil(t, tempDB.RetryJob(ctx, job.ID, "worker-0", now.Add(-time.Minute), result))
+
+			// The retried attempt doesn't count towards maxAttempts
+			running, err := tempDB.DequeueJob(ctx, &db.Worker{Name: "worker-0"}, now.Add(-time.Second))
+			assert.Nil(t, err)
+			assert.Equal(t, 2, running.Attempts)
+			assert.Equal(t, 1, running.Retries)
+			n, err := tempDB.RequeueExpiredJobs(ctx, now, maxAttempts)
+			assert.Nil(t, err)
+			assert.Equal(t, 1, n)
+			got, err := tempDB.GetJob(ctx, job.ID)
+			assert.Nil(t, err)
+			assert.Equal(t, db.StatusPending, got.Status)
+
+			// Abandoned attempts do
+			_, err = tempDB.DequeueJob(ctx, &db.Worker{Name: "worker-0"}, now.Add(-time.Second))
+			assert.Nil(t, err)
+			n, err = tempDB.RequeueExpiredJobs(ctx, now, maxAttempts)
+			assert.Nil(t, err)
+			assert.Equal(t, 1, n)
+			got, err = tempDB.GetJob(ctx, job.ID)
+			assert.Nil(t, err)
+			assert.Equal(t, db.StatusFailed, got.Status)
+			assert.Equal(t, 1, got.Retries)
+		})
+	}
+}
+
+func TestJobPhase(t *testing.T) {
+	for _, tc := range backends {
+		t.Run(tc.desc, func(t *testing.T) {
+			tempDB, cleanup, err := tc.dbFactory(t)
+			if err != nil {
+				return
+			}
+			defer tempDB.Close()
+			defer cleanup()
+
+			ctx := context.Background()
+			now := time.Now().UTC().Truncate(time.Second)
+
+			job := &db.QueryJob{
+				Repository:   "https://github.com/grpc/grpc",
+				CommitHash:   "foobar",
+				Query:        "deps(//...)",
+				QueryType:    db.QueryTypeQuery,
+				OutputFormat: db.OutputFormatProto,
+			}
+			assert.Nil(t, tempDB.EnqueueJob(ctx, job))
+
+			// Pending jobs have no phase
+			err = tempDB.SetJobPhase(ctx, job.ID, "worker-0", db.PhaseFetch)
+			assert.True(t, errors.Is(err, db.ErrLeaseExpired), "got error: %v", err)
+
+			_, err = tempDB.DequeueJob(ctx, &db.Worker{Name: "worker-0"}, now.Add(time.Minute))
+			assert.Nil(t, err)
+			assert.Nil(t, tempDB.SetJobPhase(ctx, job.ID, "worker-0", db.PhaseQuery))
+			got, err := tempDB.GetJob(ctx, job.ID)
+			assert.Nil(t, err)
+			assert.Equal(t, db.PhaseQuery, got.Phase)
+
+			// Only the worker running the job can set its phase
+			err = tempDB.SetJobPhase(ctx, job.ID, "worker-1", db.PhaseUpload)
+			assert.True(t, errors.Is(err, db.ErrLeaseExpired), "got error: %v", err)
+
+			// The phase is reset when the job is dequeued again
+			_, err = tempDB.RenewLease(ctx, job.ID, "worker-0", now.Add(-time.Second))
+			assert.Nil(t, err)
+			n, err := tempDB.RequeueExpiredJobs(ctx, now, 2)
+			assert.Nil(t, err)
+			assert.Equal(t, 1, n)
+			running, err := tempDB.DequeueJob(ctx, &db.Worker{Name: "worker-1"}, now.Add(time.Minute))
+			assert.Nil(t, err)
+			assert.Equal(t, "", running.Phase)
+			got, err = tempDB.GetJob(ctx, job.ID)
+			assert.Nil(t, err)
+			assert.Equal(t, "", got.Phase)
+
+			_, err = tempDB.CancelJob(ctx, job.ID)
+			assert.Nil(t, err)
+			err = tempDB.SetJobPhase(ctx, job.ID, "worker-1", db.PhaseUpload)
+			assert.True(t, errors.Is(err, db.ErrJobCancelled), "got error: %v", err)
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/minorhacks/bazel_remote_query/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListJobs(t *testing.T) {
+	for _, tc := range backends {
+		t.Run(tc.desc, func(t *testing.T) {
+			tempDB, cleanup, err := tc.dbFactory(t)
+			if err != nil {
+				return
+			}
+			defer tempDB.Close()
+			defer cleanup()
+
+			ctx := context.Background()
+			start := time.Now().Add(-time.Second)
+			for i := 0; i < 25; i++ {
+				repo := "https://github.com/grpc/grpc"
+				if i%10 == 0 {
+					repo = "https://github.com/bazelbuild/bazel"
+				}
+				err := tempDB.EnqueueJob(ctx, &db.QueryJob{
+					Repository: repo,
+					CommitHash: fmt.Sprintf("%d", i),
+					Query:      "deps(//...)",
+				})
+				assert.Nil(t, err)
+			}
+			running, err := tempDB.DequeueJob(ctx, &db.Worker{Name: "worker-0"}, time.Now().Add(time.Minute))
+			assert.Nil(t, err)
+
+			// Page through all jobs
+			seen := map[string]bool{}
+			pageToken := ""
+			numPages := 0
+			for {
+				jobs, next, err := tempDB.ListJobs(ctx, &db.ListJobsFilter{}, 10, pageToken)
+				assert.Nil(t, err)
+				for _, j := range jobs {
+					assert.Falsef(t, seen[j.ID], "job %s listed twice", j.ID)
+					seen[j.ID] = true
+				}
+				numPages++
+				if next == "" {
+					break
+				}
+				pageToken = next
+			}
+			assert.Equal(t, 25, len(seen))
+			assert.Equal(t, 3, numPages)
+
+			filterCases := []struct {
+				desc    string
+				filter  *db.ListJobsFilter
+				wantLen int
+			}{
+				{
+					desc:    "by repository",
+					filter:  &db.ListJobsFilter{Repository: "https://github.com/bazelbuild/bazel"},
+					wantLen: 3,
+				},
+				{
+					desc: "by commit",
+					filter: &db.ListJobsFilter{
+						Repository: "https://github.com/grpc/grpc",
+						CommitHash: "1",
+					},
+					wantLen: 1,
+				},
+				{
+					desc:    "by status",
+					filter:  &db.ListJobsFilter{Status: db.StatusRunning},
+					wantLen: 1,
+				},
+				{
+					desc:    "by worker",
+					filter:  &db.ListJobsFilter{Worker: "worker-0"},
+					wantLen: 1,
+				},
+				{
+					desc:    "queued before start",
+					filter:  &db.ListJobsFilter{QueuedBefore: start},
+					wantLen: 0,
+				},
+				{
+					desc:    "queued after start",
+					filter:  &db.ListJobsFilter{QueuedAfter: start},
+					wantLen: 25,
+				},
+			}
+			for _, fc := range filterCases {
+				jobs, next, err := tempDB.ListJobs(ctx, fc.filter, 100, "")
+				assert.Nilf(t, err, "filter %s", fc.desc)
+				assert.Lenf(t, jobs, fc.wantLen, "filter %s", fc.desc)
+				assert.Emptyf(t, next, "filter %s", fc.desc)
+			}
+			jobs, _, err := tempDB.ListJobs(ctx, &db.ListJobsFilter{Worker: "worker-0"}, 100, "")
+			assert.Nil(t, err)
+			if assert.Len(t, jobs, 1) {
+				assert.Equal(t, running.ID, jobs[0].ID)
+			}
+
+			// A job queued by branch is also listed by the commit it resolved to
+			resolved := "0123456789abcdef0123456789abcdef01234567"
+			err = tempDB.FinishJob(ctx, running.ID, "worker-0", db.StatusSucceeded, &db.JobResult{ResolvedCommitHash: resolved})
+			assert.Nil(t, err)
+			jobs, _, err = tempDB.ListJobs(ctx, &db.ListJobsFilter{CommitHash: resolved}, 100, "")
+			assert.Nil(t, err)
+			if assert.Len(t, jobs, 1) {
+				assert.Equal(t, running.ID, jobs[0].ID)
+			}
+
+			_, _, err = tempDB.ListJobs(ctx, &db.ListJobsFilter{}, 10, "not a page token")
+			assert.ErrorIs(t, err, db.ErrInvalidPageToken)
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/minorhacks/bazel_remote_query/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInlineResult(t *testing.T) {
+	for _, tc := range backends {
+		t.Run(tc.desc, func(t *testing.T) {
+			tempDB, cleanup, err := tc.dbFactory(t)
+			if err != nil {
+				return
+			}
+			defer tempDB.Close()
+			defer cleanup()
+
+			ctx := context.Background()
+			enqueue := func(query string) string {
+				t.Helper()
+				job := &db.QueryJob{
+					Repository:   "https://github.com/grpc/grpc",
+					CommitHash:   "main",
+					Query:        query,
+					QueryType:    db.QueryTypeQuery,
+					OutputFormat: db.OutputFormatLabel,
+				}
+				assert.Nil(t, tempDB.EnqueueJob(ctx, job))
+				return job.ID
+			}
+			finish := func(result *db.JobResult) *db.QueryJob {
+				t.Helper()
+				job, err := tempDB.DequeueJob(ctx, &db.Worker{Name: "worker"}, time.Now().Add(time.Minute))
+				assert.Nil(t, err)
+				assert.Nil(t, tempDB.FinishJob(ctx, job.ID, "worker", db.StatusSucceeded, result))
+				job, err = tempDB.GetJob(ctx, job.ID)
+				assert.Nil(t, err)
+				return job
+			}
+
+			enqueue("kind(rule, //foo:*)")
+			metadata := db.ResultMetadata{
+				BazelVersion:     "bazel 5.1.1",
+				BazelFlags:       []string{"--output=label"},
+				TargetCount:      1,
+				Size:             10,
+				FetchDuration:    2 * time.Second,
+				CheckoutDuration: time.Second,
+				QueryDuration:    30 * time.Second,
+			}
+			job := finish(&db.JobResult{
+				SHA256:   "0123abcd",
+				Size:     9,
+				Inline:   []byte("//foo:bar"),
+				Metadata: metadata,
+			})
+			assert.Nil(t, job.ResultURL)
+			assert.Equal(t, []byte("//foo:bar"), job.ResultInline)
+			assert.Equal(t, "0123abcd", job.ResultSHA256)
+			assert.Equal(t, metadata, job.ResultMetadata)
+
+			enqueue("deps(//...)")
+			job = finish(&db.JobResult{
+				URL:    "gs://bucket/result",
+				SHA256: "4567cdef",
+				Size:   1 << 20,
+			})
+			if assert.NotNil(t, job.ResultURL) {
+				assert.Equal(t, "gs://bucket/result", *job.ResultURL)
+			}
+			assert.Empty(t, job.ResultInline)
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/minorhacks/bazel_remote_query/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryJob(t *testing.T) {
+	for _, tc := range backends {
+		t.Run(tc.desc, func(t *testing.T) {
+			tempDB, cleanup, err := tc.dbFactory(t)
+			if err != nil {
+				return
+			}
+			defer tempDB.Close()
+			defer cleanup()
+
+			ctx := context.Background()
+			now := time.Now().UTC().Truncate(time.Second)
+			job := &db.QueryJob{
+				Repository:   "https://github.com/grpc/grpc",
+				CommitHash:   "foobar",
+				Query:        "deps(//...)",
+				QueryType:    db.QueryTypeQuery,
+				OutputFormat: db.OutputFormatProto,
+			}
+			assert.Nil(t, tempDB.EnqueueJob(ctx, job))
+			_, err = tempDB.DequeueJob(ctx, &db.Worker{Name: "worker-0"}, now.Add(time.Minute))
+			assert.Nil(t, err)
+
+			result := &db.JobResult{
+				Error:           "bazel query failed",
+				FailureCategory: db.FailureCategoryInfrastructure,
+				ExitCode:        37,
+				Stderr:          "internal error",
+			}
+			assert.Nil(t, tempDB.RetryJob(ctx, job.ID, "worker-0", now.Add(time.Hour), result))
+			got, err := tempDB.GetJob(ctx, job.ID)
+			assert.Nil(t, err)
+			assert.Equal(t, db.StatusPending, got.Status)
+			assert.Equal(t, db.FailureCategoryInfrastructure, got.FailureCategory)
+			assert.Equal(t, 37, got.ExitCode)
+			assert.Equal(t, "internal error", got.Stderr)
+			assert.Equal(t, 1, got.Retries)
+
+			// The job can't be retried again until it is running
+			err = tempDB.RetryJob(ctx, job.ID, "worker-0", now, result)
+			assert.True(t, errors.Is(err, db.ErrLeaseExpired), "got error: %v", err)
+
+			// The job isn't dequeued before its retry time
+			_, err = tempDB.DequeueJob(ctx, &db.Worker{Name: "worker-0"}, now.Add(time.Minute))
+			assert.True(t, errors.Is(err, db.ErrNoOutstandingJobs), "got error: %v", err)
+
+			// Enqueuing the same query again deduplicates to the retried job
+			dup := *job
+			dup.ID = ""
+			assert.Nil(t, tempDB.EnqueueJob(ctx, &dup))
+			assert.Equal(t, job.ID, dup.ID)
+		})
+	}
+}
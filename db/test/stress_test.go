@@ -2,50 +2,124 @@ package test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/minorhacks/bazel_remote_query/db"
 	"github.com/minorhacks/bazel_remote_query/db/datastore"
+	"github.com/minorhacks/bazel_remote_query/db/memory"
+	"github.com/minorhacks/bazel_remote_query/db/mysql"
+	"github.com/minorhacks/bazel_remote_query/db/postgres"
 	"github.com/minorhacks/bazel_remote_query/db/sqlite"
 	"github.com/minorhacks/bazel_remote_query/testdatastore"
+	"github.com/minorhacks/bazel_remote_query/testmysql"
+	"github.com/minorhacks/bazel_remote_query/testpostgres"
 
 	"github.com/stretchr/testify/assert"
 )
 
-func TestStressEnqueueDequeue(t *testing.T) {
-	testCases := []struct {
-		desc      string
-		dbFactory func(t *testing.T) (db.DB, func(), error)
-	}{
-		{
-			desc: "sqlite",
-			dbFactory: func(t *testing.T) (db.DB, func(), error) {
-				tempFile, err := os.CreateTemp(os.Getenv("TEST_TMPDIR"), "stress_enqueue_dequeue_*.sqlite")
-				assert.Nil(t, err)
-				assert.Nil(t, tempFile.Close())
-				tempDB, err := sqlite.New(context.Background(), tempFile.Name())
-				assert.Nil(t, err)
-				return tempDB, func() {}, err
-			},
+// backends lists the DB implementations that tests in this package run
+// against.
+var backends = []struct {
+	desc      string
+	dbFactory func(t *testing.T) (db.DB, func(), error)
+}{
+	{
+		desc: "sqlite",
+		dbFactory: func(t *testing.T) (db.DB, func(), error) {
+			tempFile, err := os.CreateTemp(os.Getenv("TEST_TMPDIR"), "bazel_query_jobs_*.sqlite")
+			assert.Nil(t, err)
+			assert.Nil(t, tempFile.Close())
+			tempDB, err := sqlite.New(context.Background(), tempFile.Name())
+			assert.Nil(t, err)
+			return tempDB, func() {}, err
+		},
+	},
+	{
+		desc: "memory",
+		dbFactory: func(t *testing.T) (db.DB, func(), error) {
+			return memory.New(), func() {}, nil
+		},
+	},
+	{
+		desc: "datastore",
+		dbFactory: func(t *testing.T) (db.DB, func(), error) {
+			ctx := context.Background()
+			tds, err := testdatastore.New(ctx, os.Getenv("TEST_TMPDIR"), false)
+			assert.Nil(t, err)
+			d, err := datastore.New(ctx, "")
+			assert.Nil(t, err)
+			return d, func() {
+				tds.Close()
+			}, err
+		},
+	},
+	{
+		desc: "postgres",
+		dbFactory: func(t *testing.T) (db.DB, func(), error) {
+			ctx := context.Background()
+			tpg, err := testpostgres.New(ctx, os.Getenv("TEST_TMPDIR"))
+			skipIfNotFound(t, "postgres", err)
+			assert.Nil(t, err)
+			if err != nil {
+				return nil, nil, err
+			}
+			d, err := postgres.New(ctx, tpg.DSN)
+			assert.Nil(t, err)
+			return d, func() {
+				tpg.Close()
+			}, err
 		},
-		{
-			desc: "datastore",
-			dbFactory: func(t *testing.T) (db.DB, func(), error) {
-				ctx := context.Background()
-				tds, err := testdatastore.New(ctx, os.Getenv("TEST_TMPDIR"), false)
-				assert.Nil(t, err)
-				d, err := datastore.New(ctx, "")
-				assert.Nil(t, err)
-				return d, func() {
-					tds.Close()
-				}, err
-			},
+	},
+	{
+		desc: "mysql",
+		dbFactory: func(t *testing.T) (db.DB, func(), error) {
+			ctx := context.Background()
+			tm, err := testmysql.New(ctx, os.Getenv("TEST_TMPDIR"))
+			skipIfNotFound(t, "mysql", err)
+			assert.Nil(t, err)
+			if err != nil {
+				return nil, nil, err
+			}
+			d, err := mysql.New(ctx, tm.DSN)
+			assert.Nil(t, err)
+			return d, func() {
+				tm.Close()
+			}, err
 		},
+	},
+}
+
+// requiredBackendsEnv names the environment variable listing the backends,
+// separated by commas, that must be tested even though they need servers
+// that may not be installed, e.g. `postgres,mysql` in CI. With Bazel, pass it
+// with --test_env.
+const requiredBackendsEnv = "TEST_REQUIRED_DB_BACKENDS"
+
+// skipIfNotFound skips t if err shows that the server binaries for backend
+// aren't on the PATH, unless backend is listed in requiredBackendsEnv, in
+// which case t fails.
+func skipIfNotFound(t *testing.T, backend string, err error) {
+	t.Helper()
+	if !errors.Is(err, exec.ErrNotFound) {
+		return
+	}
+	for _, b := range strings.Split(os.Getenv(requiredBackendsEnv), ",") {
+		if strings.TrimSpace(b) == backend {
+			t.Fatalf("%s is listed in %s, but its binaries weren't found: %v", backend, requiredBackendsEnv, err)
+		}
 	}
-	for _, tc := range testCases {
+	t.Skipf("%s binaries not found on PATH; set %s to fail instead", backend, requiredBackendsEnv)
+}
+
+func TestStressEnqueueDequeue(t *testing.T) {
+	for _, tc := range backends {
 		t.Run(tc.desc, func(t *testing.T) {
 			tempDB, cleanup, err := tc.dbFactory(t)
 			if err != nil {
@@ -92,7 +166,7 @@ func TestStressEnqueueDequeue(t *testing.T) {
 				defer t.Logf("Worker %d done dequeuing", worker)
 				defer wg.Done()
 				for i := 0; i < numJobs; i++ {
-					_, err := d.DequeueJob(context.Background(), fmt.Sprint("worker-%d", worker))
+					_, err := d.DequeueJob(context.Background(), &db.Worker{Name: fmt.Sprint("worker-%d", worker)}, time.Now().Add(time.Minute))
 					assert.Nilf(t, err, "during dequeue: worker %d job %d: %v", worker, i, err)
 				}
 			}
@@ -106,7 +180,7 @@ func TestStressEnqueueDequeue(t *testing.T) {
 			// All jobs should be dequeued; additional dequeues should result in no jobs
 			// available
 			t.Log("Checking for extra jobs...")
-			_, err = tempDB.DequeueJob(context.Background(), "worker-0")
+			_, err = tempDB.DequeueJob(context.Background(), &db.Worker{Name: "worker-0"}, time.Now().Add(time.Minute))
 			assert.ErrorIs(t, err, db.ErrNoOutstandingJobs)
 		})
 	}
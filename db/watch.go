@@ -0,0 +1,56 @@
+package db
+
+import (
+	"sync"
+)
+
+// Watchers fans out job changes to subscribers in the same process. DB
+// implementations embed a Watchers and call Notify after committing a change
+// to a job, which allows WatchJob to push updates without polling. The zero
+// value is ready to use.
+type Watchers struct {
+	mu   sync.Mutex
+	subs map[string]map[chan *QueryJob]struct{}
+}
+
+// Watch subscribes to changes of the job with the given ID. The returned
+// channel holds at most one pending update; if the subscriber falls behind,
+// older updates are replaced by newer ones, since only the latest state of the
+// job is interesting. The returned function must be called to unsubscribe.
+func (w *Watchers) Watch(id string) (<-chan *QueryJob, func()) {
+	ch := make(chan *QueryJob, 1)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.subs == nil {
+		w.subs = map[string]map[chan *QueryJob]struct{}{}
+	}
+	if w.subs[id] == nil {
+		w.subs[id] = map[chan *QueryJob]struct{}{}
+	}
+	w.subs[id][ch] = struct{}{}
+
+	return ch, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		delete(w.subs[id], ch)
+		if len(w.subs[id]) == 0 {
+			delete(w.subs, id)
+		}
+	}
+}
+
+// Notify sends a copy of job to all subscribers watching job.ID.
+func (w *Watchers) Notify(job *QueryJob) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ch := range w.subs[job.ID] {
+		j := *job
+		// Drop the stale update, if any, so that the send below never blocks.
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- &j
+	}
+}
@@ -3,35 +3,160 @@ package dispatch
 import (
 	"context"
 	"errors"
+	"io"
 	"time"
 
 	"github.com/minorhacks/bazel_remote_query/db"
+	"github.com/minorhacks/bazel_remote_query/joblog"
+	"github.com/minorhacks/bazel_remote_query/notify"
 	pb "github.com/minorhacks/bazel_remote_query/proto"
 
+	"github.com/golang/glog"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
-var timeNow = time.Now
+var (
+	timeNow = time.Now
+
+	// heartbeatInterval is how often workers are asked to send heartbeats for
+	// the job they are running.
+	heartbeatInterval = 10 * time.Second
+
+	// leaseDuration is how long a worker may go without sending a heartbeat
+	// before its job is considered abandoned. It allows for a few missed
+	// heartbeats.
+	leaseDuration = 3 * heartbeatInterval
+
+	// maxPollWait caps how long GetQueryJob waits for a job to be queued.
+	maxPollWait = time.Minute
+
+	// requeueInterval is how often RequeueExpiredJobs checks for abandoned
+	// jobs.
+	requeueInterval = 10 * time.Second
+
+	// Jobs that fail because of infrastructure failures are retried after
+	// retryBaseDelay, doubling after each attempt up to maxRetryDelay.
+	retryBaseDelay = 30 * time.Second
+	maxRetryDelay  = 10 * time.Minute
+)
+
+const (
+	defaultMaxAttempts = 3
+	defaultMaxRetries  = 3
+)
+
+var queryTypes = map[string]pb.QueryType{
+	db.QueryTypeQuery:  pb.QueryType_QUERY_TYPE_QUERY,
+	db.QueryTypeCquery: pb.QueryType_QUERY_TYPE_CQUERY,
+	db.QueryTypeAquery: pb.QueryType_QUERY_TYPE_AQUERY,
+}
+
+var outputFormats = map[string]pb.OutputFormat{
+	db.OutputFormatProto:             pb.OutputFormat_OUTPUT_FORMAT_PROTO,
+	db.OutputFormatLabel:             pb.OutputFormat_OUTPUT_FORMAT_LABEL,
+	db.OutputFormatLabelKind:         pb.OutputFormat_OUTPUT_FORMAT_LABEL_KIND,
+	db.OutputFormatXML:               pb.OutputFormat_OUTPUT_FORMAT_XML,
+	db.OutputFormatGraph:             pb.OutputFormat_OUTPUT_FORMAT_GRAPH,
+	db.OutputFormatStreamedJSONProto: pb.OutputFormat_OUTPUT_FORMAT_STREAMED_JSONPROTO,
+}
 
 type DatabaseDispatch struct {
 	DB db.DB
+
+	// MaxAttempts is the number of times a job is dequeued before it is
+	// marked as failed, if its lease keeps expiring. Attempts retried after an
+	// infrastructure failure don't count. Defaults to defaultMaxAttempts if
+	// not set.
+	MaxAttempts int
+
+	// MaxRetries is the number of times a job that failed because of an
+	// infrastructure failure is retried. Attempts abandoned by their worker
+	// count towards MaxAttempts instead. Defaults to defaultMaxRetries if not
+	// set.
+	MaxRetries int
+
+	// Notifier is notified when jobs may have become available. GetQueryJob
+	// waits on it when asked to wait for a job. The same Notifier should be
+	// passed to the DatabaseQueue sharing the DB.
+	Notifier *notify.Notifier
+
+	// Logs stores the logs that workers stream for their jobs. The same Store
+	// should be passed to the DatabaseQueue that serves them to clients.
+	Logs *joblog.Store
+}
+
+var failureCategories = map[pb.FailureCategory]string{
+	pb.FailureCategory_FAILURE_CATEGORY_QUERY:          db.FailureCategoryQuery,
+	pb.FailureCategory_FAILURE_CATEGORY_INFRASTRUCTURE: db.FailureCategoryInfrastructure,
+}
+
+var contentEncodings = map[pb.ContentEncoding]string{
+	pb.ContentEncoding_CONTENT_ENCODING_IDENTITY: "",
+	pb.ContentEncoding_CONTENT_ENCODING_GZIP:     db.EncodingGzip,
+	pb.ContentEncoding_CONTENT_ENCODING_ZSTD:     db.EncodingZstd,
+}
+
+var jobPhases = map[pb.JobPhase]string{
+	pb.JobPhase_JOB_PHASE_FETCH:    db.PhaseFetch,
+	pb.JobPhase_JOB_PHASE_CHECKOUT: db.PhaseCheckout,
+	pb.JobPhase_JOB_PHASE_QUERY:    db.PhaseQuery,
+	pb.JobPhase_JOB_PHASE_UPLOAD:   db.PhaseUpload,
 }
 
 func (d *DatabaseDispatch) GetQueryJob(ctx context.Context, req *pb.GetQueryJobRequest) (*pb.GetQueryJobResponse, error) {
 	res := &pb.GetQueryJobResponse{
 		NextPollTime: timestamppb.New(timeNow().Add(10 * time.Second)), // TODO: parameterize
 	}
-	job, err := d.DB.DequeueJob(ctx, req.GetWorkerName())
-	if err != nil && errors.Is(err, db.ErrNoOutstandingJobs) {
-		return res, nil
-	} else if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to dequeue next job: %v", err)
+	worker := &db.Worker{
+		Name:         req.GetWorkerName(),
+		Repositories: req.GetRepositories(),
+		Labels:       req.GetLabels(),
+	}
+
+	maxWait := req.GetMaxWait().AsDuration()
+	if maxWait > maxPollWait {
+		maxWait = maxPollWait
+	}
+	var deadline <-chan time.Time
+	if maxWait > 0 {
+		// The worker has already waited for a job, so it can poll again
+		// straight away
+		res.NextPollTime = timestamppb.New(timeNow())
+		timer := time.NewTimer(maxWait)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	var job *db.QueryJob
+	for {
+		// Start waiting before dequeueing, so that a job queued in between
+		// isn't missed
+		queued := d.Notifier.Wait()
+		var err error
+		job, err = d.DB.DequeueJob(ctx, worker, timeNow().Add(leaseDuration))
+		if err == nil {
+			break
+		} else if !errors.Is(err, db.ErrNoOutstandingJobs) {
+			return nil, status.Errorf(codes.Internal, "failed to dequeue next job: %v", err)
+		} else if deadline == nil {
+			return res, nil
+		}
+		select {
+		case <-queued:
+		case <-deadline:
+			return res, nil
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
 	}
 	res.Job = &pb.QueryJob{
-		Id:    job.ID,
-		Query: job.Query,
+		Id:           job.ID,
+		QueryType:    queryTypes[job.QueryType],
+		Query:        job.Query,
+		BazelFlags:   job.BazelFlags,
+		OutputFormat: outputFormats[job.OutputFormat],
 		Source: &pb.GitCommit{
 			Repo:       job.Repository,
 			Committish: job.CommitHash,
@@ -41,15 +166,209 @@ func (d *DatabaseDispatch) GetQueryJob(ctx context.Context, req *pb.GetQueryJobR
 }
 
 func (d *DatabaseDispatch) FinishQueryJob(ctx context.Context, req *pb.FinishQueryJobRequest) (*pb.FinishQueryJobResponse, error) {
+	encoding, ok := contentEncodings[req.GetResultEncoding()]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown result encoding %v", req.GetResultEncoding())
+	}
 	var err error
+	result := &db.JobResult{
+		ResolvedCommitHash: req.GetResolvedCommitHash(),
+		SHA256:             req.GetResultDigest().GetSha256(),
+		Size:               req.GetResultDigest().GetSizeBytes(),
+		Encoding:           encoding,
+		Metadata:           resultMetadata(req.GetResultMetadata()),
+	}
+	if result.ResolvedCommitHash == "" {
+		result.ResolvedCommitHash = req.GetResultMetadata().GetResolvedCommitHash()
+	}
 	switch r := req.Result.(type) {
+	case *pb.FinishQueryJobRequest_QueryResultUrl:
+		result.URL = r.QueryResultUrl
+		err = d.DB.FinishJob(ctx, req.GetQueryJobId(), req.GetWorkerName(), db.StatusSucceeded, result)
 	case *pb.FinishQueryJobRequest_QueryResultGcsLocation:
-		err = d.DB.FinishJob(ctx, req.GetQueryJobId(), db.StatusSucceeded, r.QueryResultGcsLocation)
+		result.URL = r.QueryResultGcsLocation
+		err = d.DB.FinishJob(ctx, req.GetQueryJobId(), req.GetWorkerName(), db.StatusSucceeded, result)
+	case *pb.FinishQueryJobRequest_QueryResultInline:
+		if len(r.QueryResultInline) > db.MaxInlineResultSize {
+			return nil, status.Errorf(codes.InvalidArgument, "inline result is %d bytes; must be at most %d", len(r.QueryResultInline), db.MaxInlineResultSize)
+		}
+		result.Inline = r.QueryResultInline
+		err = d.DB.FinishJob(ctx, req.GetQueryJobId(), req.GetWorkerName(), db.StatusSucceeded, result)
 	case *pb.FinishQueryJobRequest_FailureMessage:
-		err = d.DB.FinishJob(ctx, req.GetQueryJobId(), db.StatusFailed, r.FailureMessage)
+		details := req.GetFailureDetails()
+		result.Error = r.FailureMessage
+		result.FailureCategory = failureCategories[details.GetCategory()]
+		result.ExitCode = int(details.GetExitCode())
+		result.Stderr = details.GetStderr()
+		if result.FailureCategory == db.FailureCategoryInfrastructure {
+			return d.retryJob(ctx, req.GetQueryJobId(), req.GetWorkerName(), result)
+		}
+		err = d.DB.FinishJob(ctx, req.GetQueryJobId(), req.GetWorkerName(), db.StatusFailed, result)
 	}
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to mark job %s as finished: %v", req.GetQueryJobId(), err)
+		c := codes.Internal
+		if errors.Is(err, db.ErrJobCancelled) || errors.Is(err, db.ErrLeaseExpired) {
+			c = codes.FailedPrecondition
+		} else if errors.Is(err, db.ErrJobNotFound) {
+			c = codes.NotFound
+		}
+		return nil, status.Errorf(c, "failed to mark job %s as finished: %v", req.GetQueryJobId(), err)
 	}
 	return &pb.FinishQueryJobResponse{}, nil
 }
+
+// resultMetadata converts the result metadata reported by a worker to its DB
+// representation.
+func resultMetadata(m *pb.ResultMetadata) db.ResultMetadata {
+	return db.ResultMetadata{
+		BazelVersion:     m.GetBazelVersion(),
+		BazelFlags:       m.GetBazelFlags(),
+		TargetCount:      m.GetTargetCount(),
+		Size:             m.GetSizeBytes(),
+		FetchDuration:    m.GetFetchDuration().AsDuration(),
+		CheckoutDuration: m.GetCheckoutDuration().AsDuration(),
+		QueryDuration:    m.GetQueryDuration().AsDuration(),
+		UploadDuration:   m.GetUploadDuration().AsDuration(),
+	}
+}
+
+// retryJob requeues a job that workerName failed to run because of an
+// infrastructure failure, or marks it as failed if it has been retried too
+// many times already.
+func (d *DatabaseDispatch) retryJob(ctx context.Context, id string, workerName string, result *db.JobResult) (*pb.FinishQueryJobResponse, error) {
+	maxRetries := d.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = defaultMaxRetries
+	}
+	job, err := d.DB.GetJob(ctx, id)
+	if err != nil {
+		c := codes.Internal
+		if errors.Is(err, db.ErrJobNotFound) {
+			c = codes.NotFound
+		}
+		return nil, status.Errorf(c, "failed to get job %s: %v", id, err)
+	}
+	// Only RetryJob changes job.Retries, and only while workerName holds the
+	// job's lease, so the count can't change before RetryJob or FinishJob
+	// below succeeds. Attempts abandoned by their worker don't count.
+	if job.Retries >= maxRetries {
+		err = d.DB.FinishJob(ctx, id, workerName, db.StatusFailed, result)
+	} else {
+		delay := retryDelay(job.Retries + 1)
+		glog.Infof("Retrying job %s in %v after infrastructure failure: %s", id, delay, result.Error)
+		err = d.DB.RetryJob(ctx, id, workerName, timeNow().Add(delay), result)
+		if err == nil {
+			// Nothing is queued when the job's retry time passes, so wake up
+			// waiting workers then
+			d.Notifier.NotifyAfter(delay)
+		}
+	}
+	if err != nil {
+		c := codes.Internal
+		if errors.Is(err, db.ErrJobCancelled) || errors.Is(err, db.ErrLeaseExpired) {
+			c = codes.FailedPrecondition
+		}
+		return nil, status.Errorf(c, "failed to mark job %s as finished: %v", id, err)
+	}
+	return &pb.FinishQueryJobResponse{}, nil
+}
+
+// retryDelay returns how long to wait before the given retry of a job, counting
+// from 1.
+func retryDelay(retry int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < retry && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+func (d *DatabaseDispatch) Heartbeat(ctx context.Context, req *pb.HeartbeatRequest) (*pb.HeartbeatResponse, error) {
+	_, err := d.DB.RenewLease(ctx, req.GetQueryJobId(), req.GetWorkerName(), timeNow().Add(leaseDuration))
+	switch {
+	case errors.Is(err, db.ErrJobCancelled):
+		return &pb.HeartbeatResponse{Cancelled: true}, nil
+	case errors.Is(err, db.ErrLeaseExpired):
+		return &pb.HeartbeatResponse{LeaseExpired: true}, nil
+	case errors.Is(err, db.ErrJobNotFound):
+		return nil, status.Errorf(codes.NotFound, "failed to renew lease on job %s: %v", req.GetQueryJobId(), err)
+	case err != nil:
+		return nil, status.Errorf(codes.Internal, "failed to renew lease on job %s: %v", req.GetQueryJobId(), err)
+	}
+	return &pb.HeartbeatResponse{
+		NextHeartbeatTime: timestamppb.New(timeNow().Add(heartbeatInterval)),
+	}, nil
+}
+
+func (d *DatabaseDispatch) ReportProgress(ctx context.Context, req *pb.ReportProgressRequest) (*pb.ReportProgressResponse, error) {
+	phase, ok := jobPhases[req.GetPhase()]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown phase %v", req.GetPhase())
+	}
+	err := d.DB.SetJobPhase(ctx, req.GetQueryJobId(), req.GetWorkerName(), phase)
+	switch {
+	case errors.Is(err, db.ErrJobCancelled):
+		return &pb.ReportProgressResponse{Cancelled: true}, nil
+	case errors.Is(err, db.ErrLeaseExpired):
+		return &pb.ReportProgressResponse{LeaseExpired: true}, nil
+	case errors.Is(err, db.ErrJobNotFound):
+		return nil, status.Errorf(codes.NotFound, "failed to set phase of job %s: %v", req.GetQueryJobId(), err)
+	case err != nil:
+		return nil, status.Errorf(codes.Internal, "failed to set phase of job %s: %v", req.GetQueryJobId(), err)
+	}
+	return &pb.ReportProgressResponse{}, nil
+}
+
+func (d *DatabaseDispatch) StreamLogs(stream pb.QueryDispatch_StreamLogsServer) error {
+	ctx := stream.Context()
+	var id string
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(&pb.StreamLogsResponse{})
+		} else if err != nil {
+			return err
+		}
+		if id == "" {
+			id = req.GetQueryJobId()
+			job, err := d.DB.GetJob(ctx, id)
+			if errors.Is(err, db.ErrJobNotFound) {
+				return status.Errorf(codes.NotFound, "failed to get job %s: %v", id, err)
+			} else if err != nil {
+				return status.Errorf(codes.Internal, "failed to get job %s: %v", id, err)
+			}
+			if job.Status != db.StatusRunning || job.Worker == nil || *job.Worker != req.GetWorkerName() {
+				return status.Errorf(codes.FailedPrecondition, "job %s is not running on worker %q", id, req.GetWorkerName())
+			}
+		}
+		d.Logs.Append(id, req.GetData())
+	}
+}
+
+// RequeueExpiredJobs periodically requeues jobs that were abandoned by their
+// worker, until ctx is done.
+func (d *DatabaseDispatch) RequeueExpiredJobs(ctx context.Context) {
+	maxAttempts := d.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+	ticker := time.NewTicker(requeueInterval)
+	defer ticker.Stop()
+	for {
+		n, err := d.DB.RequeueExpiredJobs(ctx, timeNow(), maxAttempts)
+		if err != nil {
+			glog.Errorf("Failed to requeue expired jobs: %v", err)
+		} else if n > 0 {
+			glog.Infof("Requeued %d jobs with expired leases", n)
+			d.Notifier.Notify()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
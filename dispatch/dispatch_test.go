@@ -3,14 +3,22 @@ package dispatch
 import (
 	"context"
 	"errors"
+	"io"
 	"testing"
 	"time"
 
 	"github.com/minorhacks/bazel_remote_query/db"
+	"github.com/minorhacks/bazel_remote_query/db/memory"
+	"github.com/minorhacks/bazel_remote_query/joblog"
+	"github.com/minorhacks/bazel_remote_query/notify"
 	pb "github.com/minorhacks/bazel_remote_query/proto"
 	"github.com/minorhacks/bazel_remote_query/testutil"
 
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/prashantv/gostub"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
@@ -32,18 +40,24 @@ func TestGetQueryJob(t *testing.T) {
 			queue: []db.FakeQueueEntry{
 				{
 					Job: &db.QueryJob{
-						Repository: "https://github.com/grpc/grpc",
-						CommitHash: "foobar",
-						Query:      "deps(//...)",
-						ID:         "abcd",
-						Status:     db.StatusPending,
+						Repository:   "https://github.com/grpc/grpc",
+						CommitHash:   "foobar",
+						Query:        "deps(//...)",
+						QueryType:    db.QueryTypeCquery,
+						BazelFlags:   []string{"--keep_going"},
+						OutputFormat: db.OutputFormatXML,
+						ID:           "abcd",
+						Status:       db.StatusPending,
 					},
 				},
 			},
 			want: &pb.GetQueryJobResponse{
 				Job: &pb.QueryJob{
-					Id:    "abcd",
-					Query: "deps(//...)",
+					Id:           "abcd",
+					QueryType:    pb.QueryType_QUERY_TYPE_CQUERY,
+					Query:        "deps(//...)",
+					BazelFlags:   []string{"--keep_going"},
+					OutputFormat: pb.OutputFormat_OUTPUT_FORMAT_XML,
 					Source: &pb.GitCommit{
 						Repo:       "https://github.com/grpc/grpc",
 						Committish: "foobar",
@@ -99,3 +113,750 @@ func TestGetQueryJob(t *testing.T) {
 		})
 	}
 }
+
+// enqueueJob enqueues a job running query, and returns its ID.
+func enqueueJob(t *testing.T, d db.DB, query string) string {
+	t.Helper()
+	job := &db.QueryJob{
+		Repository:   "https://github.com/grpc/grpc",
+		CommitHash:   "main",
+		Query:        query,
+		QueryType:    db.QueryTypeQuery,
+		OutputFormat: db.OutputFormatProto,
+	}
+	if err := d.EnqueueJob(context.Background(), job); err != nil {
+		t.Fatalf("EnqueueJob() failed: %v", err)
+	}
+	return job.ID
+}
+
+// dequeueJob dequeues the job with the given ID on workerName, which must be
+// the oldest pending job.
+func dequeueJob(t *testing.T, d db.DB, id string, workerName string) {
+	t.Helper()
+	job, err := d.DequeueJob(context.Background(), &db.Worker{Name: workerName}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("DequeueJob() failed: %v", err)
+	}
+	if job.ID != id {
+		t.Fatalf("DequeueJob() returned job %s; want %s", job.ID, id)
+	}
+}
+
+// startJob enqueues a job running query and dequeues it on workerName, and
+// returns its ID.
+func startJob(t *testing.T, d db.DB, query string, workerName string) string {
+	t.Helper()
+	id := enqueueJob(t, d, query)
+	dequeueJob(t, d, id, workerName)
+	return id
+}
+
+// expireLease expires workerName's lease on the job with the given ID, and
+// moves the job back to pending.
+func expireLease(t *testing.T, d db.DB, id string, workerName string) {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := d.RenewLease(ctx, id, workerName, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("RenewLease() failed: %v", err)
+	}
+	if _, err := d.RequeueExpiredJobs(ctx, time.Now(), 100); err != nil {
+		t.Fatalf("RequeueExpiredJobs() failed: %v", err)
+	}
+}
+
+// testJobs creates jobs in the states that the worker RPCs distinguish, and
+// returns their IDs by name.
+func testJobs(t *testing.T, d db.DB) map[string]string {
+	t.Helper()
+	ids := map[string]string{
+		"running":     startJob(t, d, "deps(//running/...)", "worker-1"),
+		"cancelled":   startJob(t, d, "deps(//cancelled/...)", "worker-1"),
+		"finished":    startJob(t, d, "deps(//finished/...)", "worker-1"),
+		"requeued":    startJob(t, d, "deps(//requeued/...)", "worker-1"),
+		"nonexistent": "00000000-0000-0000-0000-000000000000",
+	}
+	ctx := context.Background()
+	if _, err := d.CancelJob(ctx, ids["cancelled"]); err != nil {
+		t.Fatalf("CancelJob() failed: %v", err)
+	}
+	if err := d.FinishJob(ctx, ids["finished"], "worker-1", db.StatusSucceeded, &db.JobResult{URL: "gs://bucket/result"}); err != nil {
+		t.Fatalf("FinishJob() failed: %v", err)
+	}
+	expireLease(t, d, ids["requeued"], "worker-1")
+	return ids
+}
+
+func TestHeartbeat(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		job        string
+		workerName string
+		want       *pb.HeartbeatResponse
+		wantErr    string
+	}{
+		{
+			desc:       "running job",
+			job:        "running",
+			workerName: "worker-1",
+			want: &pb.HeartbeatResponse{
+				NextHeartbeatTime: timestamppb.New(testutil.StaticTimeRFC3339("2022-05-01T12:20:10-08:00")),
+			},
+		},
+		{
+			desc:       "cancelled job",
+			job:        "cancelled",
+			workerName: "worker-1",
+			want: &pb.HeartbeatResponse{
+				Cancelled: true,
+			},
+		},
+		{
+			desc:       "job requeued after lease expired",
+			job:        "requeued",
+			workerName: "worker-1",
+			want: &pb.HeartbeatResponse{
+				LeaseExpired: true,
+			},
+		},
+		{
+			desc:       "job running on another worker",
+			job:        "running",
+			workerName: "worker-2",
+			want: &pb.HeartbeatResponse{
+				LeaseExpired: true,
+			},
+		},
+		{
+			desc:       "nonexistent job",
+			job:        "nonexistent",
+			workerName: "worker-1",
+			wantErr:    "job not found",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			stubs := gostub.Stub(&timeNow, func() time.Time {
+				return testutil.StaticTimeRFC3339("2022-05-01T12:20:00-08:00")
+			})
+			defer stubs.Reset()
+
+			ctx := context.Background()
+			d := &DatabaseDispatch{DB: memory.New()}
+			ids := testJobs(t, d.DB)
+			res, gotErr := d.Heartbeat(ctx, &pb.HeartbeatRequest{
+				QueryJobId: ids[tc.job],
+				WorkerName: tc.workerName,
+			})
+			if diff := testutil.ErrSubstring(gotErr, tc.wantErr); diff != "" {
+				t.Error(diff)
+			}
+			if gotErr != nil {
+				return
+			}
+			testutil.AssertProtoEqual(t, res, tc.want)
+		})
+	}
+}
+
+func TestReportProgress(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		job        string
+		workerName string
+		phase      pb.JobPhase
+		want       *pb.ReportProgressResponse
+		wantPhase  string
+		wantErr    string
+	}{
+		{
+			desc:       "running job",
+			job:        "running",
+			workerName: "worker-1",
+			phase:      pb.JobPhase_JOB_PHASE_QUERY,
+			want:       &pb.ReportProgressResponse{},
+			wantPhase:  db.PhaseQuery,
+		},
+		{
+			desc:       "cancelled job",
+			job:        "cancelled",
+			workerName: "worker-1",
+			phase:      pb.JobPhase_JOB_PHASE_QUERY,
+			want: &pb.ReportProgressResponse{
+				Cancelled: true,
+			},
+		},
+		{
+			desc:       "job requeued after lease expired",
+			job:        "requeued",
+			workerName: "worker-1",
+			phase:      pb.JobPhase_JOB_PHASE_QUERY,
+			want: &pb.ReportProgressResponse{
+				LeaseExpired: true,
+			},
+		},
+		{
+			desc:       "job running on another worker",
+			job:        "running",
+			workerName: "worker-2",
+			phase:      pb.JobPhase_JOB_PHASE_QUERY,
+			want: &pb.ReportProgressResponse{
+				LeaseExpired: true,
+			},
+		},
+		{
+			desc:       "nonexistent job",
+			job:        "nonexistent",
+			workerName: "worker-1",
+			phase:      pb.JobPhase_JOB_PHASE_QUERY,
+			wantErr:    "job not found",
+		},
+		{
+			desc:       "unknown phase",
+			job:        "running",
+			workerName: "worker-1",
+			wantErr:    "unknown phase",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctx := context.Background()
+			d := &DatabaseDispatch{DB: memory.New()}
+			ids := testJobs(t, d.DB)
+			res, gotErr := d.ReportProgress(ctx, &pb.ReportProgressRequest{
+				QueryJobId: ids[tc.job],
+				WorkerName: tc.workerName,
+				Phase:      tc.phase,
+			})
+			if diff := testutil.ErrSubstring(gotErr, tc.wantErr); diff != "" {
+				t.Error(diff)
+			}
+			if gotErr != nil {
+				return
+			}
+			testutil.AssertProtoEqual(t, res, tc.want)
+			if tc.wantPhase != "" {
+				job, err := d.DB.GetJob(ctx, ids[tc.job])
+				if err != nil {
+					t.Fatalf("GetJob() failed: %v", err)
+				}
+				if job.Phase != tc.wantPhase {
+					t.Errorf("got phase %q; want %q", job.Phase, tc.wantPhase)
+				}
+			}
+		})
+	}
+}
+
+type fakeStreamLogsServer struct {
+	grpc.ServerStream
+
+	reqs   []*pb.StreamLogsRequest
+	closed bool
+}
+
+func (f *fakeStreamLogsServer) Context() context.Context { return context.Background() }
+
+func (f *fakeStreamLogsServer) Recv() (*pb.StreamLogsRequest, error) {
+	if len(f.reqs) == 0 {
+		return nil, io.EOF
+	}
+	req := f.reqs[0]
+	f.reqs = f.reqs[1:]
+	return req, nil
+}
+
+func (f *fakeStreamLogsServer) SendAndClose(*pb.StreamLogsResponse) error {
+	f.closed = true
+	return nil
+}
+
+func TestStreamLogs(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		job     string
+		reqs    []*pb.StreamLogsRequest
+		wantLog string
+		wantErr string
+	}{
+		{
+			desc: "running job",
+			job:  "running",
+			reqs: []*pb.StreamLogsRequest{
+				{WorkerName: "worker-1", Data: []byte("hello ")},
+				{Data: []byte("world")},
+			},
+			wantLog: "hello world",
+		},
+		{
+			desc: "job running on another worker",
+			job:  "running",
+			reqs: []*pb.StreamLogsRequest{
+				{WorkerName: "worker-2", Data: []byte("hello")},
+			},
+			wantErr: "not running on worker",
+		},
+		{
+			desc: "job requeued after lease expired",
+			job:  "requeued",
+			reqs: []*pb.StreamLogsRequest{
+				{WorkerName: "worker-1", Data: []byte("hello")},
+			},
+			wantErr: "not running on worker",
+		},
+		{
+			desc: "finished job",
+			job:  "finished",
+			reqs: []*pb.StreamLogsRequest{
+				{WorkerName: "worker-1", Data: []byte("hello")},
+			},
+			wantErr: "not running on worker",
+		},
+		{
+			desc: "nonexistent job",
+			job:  "nonexistent",
+			reqs: []*pb.StreamLogsRequest{
+				{WorkerName: "worker-1", Data: []byte("hello")},
+			},
+			wantErr: "job not found",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			logs := &joblog.Store{}
+			d := &DatabaseDispatch{
+				DB:   memory.New(),
+				Logs: logs,
+			}
+			ids := testJobs(t, d.DB)
+			tc.reqs[0].QueryJobId = ids[tc.job]
+			stream := &fakeStreamLogsServer{reqs: tc.reqs}
+			gotErr := d.StreamLogs(stream)
+			if diff := testutil.ErrSubstring(gotErr, tc.wantErr); diff != "" {
+				t.Error(diff)
+			}
+			if gotErr != nil {
+				return
+			}
+			if !stream.closed {
+				t.Error("StreamLogs() didn't close the stream")
+			}
+			if got, _ := logs.Read(ids[tc.job], 0); string(got) != tc.wantLog {
+				t.Errorf("got log %q; want %q", got, tc.wantLog)
+			}
+		})
+	}
+}
+
+func TestFinishQueryJob(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		req           *pb.FinishQueryJobRequest
+		attempts      int
+		retries       int
+		wantStatus    string
+		wantRetryTime *time.Time
+		wantSHA256    string
+		wantEncoding  string
+		wantInline    string
+		wantMetadata  db.ResultMetadata
+		wantResolved  string
+		wantErr       string
+	}{
+		{
+			desc: "success",
+			req: &pb.FinishQueryJobRequest{
+				WorkerName: "worker-1",
+				Result: &pb.FinishQueryJobRequest_QueryResultUrl{
+					QueryResultUrl: "s3://bucket/0123abcd.pb",
+				},
+				ResultDigest: &pb.Digest{
+					Sha256:    "0123abcd",
+					SizeBytes: 42,
+				},
+				ResultEncoding: pb.ContentEncoding_CONTENT_ENCODING_GZIP,
+				ResultMetadata: &pb.ResultMetadata{
+					ResolvedCommitHash: "0123456789abcdef0123456789abcdef01234567",
+					BazelVersion:       "bazel 5.1.1",
+					BazelFlags:         []string{"--keep_going", "--output=proto"},
+					TargetCount:        3,
+					SizeBytes:          128,
+					FetchDuration:      durationpb.New(2 * time.Second),
+					CheckoutDuration:   durationpb.New(time.Second),
+					QueryDuration:      durationpb.New(30 * time.Second),
+					UploadDuration:     durationpb.New(500 * time.Millisecond),
+				},
+			},
+			attempts:     1,
+			wantStatus:   db.StatusSucceeded,
+			wantSHA256:   "0123abcd",
+			wantEncoding: db.EncodingGzip,
+			wantMetadata: db.ResultMetadata{
+				BazelVersion:     "bazel 5.1.1",
+				BazelFlags:       []string{"--keep_going", "--output=proto"},
+				TargetCount:      3,
+				Size:             128,
+				FetchDuration:    2 * time.Second,
+				CheckoutDuration: time.Second,
+				QueryDuration:    30 * time.Second,
+				UploadDuration:   500 * time.Millisecond,
+			},
+			wantResolved: "0123456789abcdef0123456789abcdef01234567",
+		},
+		{
+			desc: "success with deprecated GCS location",
+			req: &pb.FinishQueryJobRequest{
+				WorkerName: "worker-1",
+				Result: &pb.FinishQueryJobRequest_QueryResultGcsLocation{
+					QueryResultGcsLocation: "gs://bucket/1.pb",
+				},
+			},
+			attempts:   1,
+			wantStatus: db.StatusSucceeded,
+		},
+		{
+			desc: "success with inline result",
+			req: &pb.FinishQueryJobRequest{
+				WorkerName: "worker-1",
+				Result: &pb.FinishQueryJobRequest_QueryResultInline{
+					QueryResultInline: []byte("//foo:bar"),
+				},
+				ResultDigest: &pb.Digest{
+					Sha256:    "0123abcd",
+					SizeBytes: 9,
+				},
+			},
+			attempts:   1,
+			wantStatus: db.StatusSucceeded,
+			wantSHA256: "0123abcd",
+			wantInline: "//foo:bar",
+		},
+		{
+			desc: "inline result too large",
+			req: &pb.FinishQueryJobRequest{
+				WorkerName: "worker-1",
+				Result: &pb.FinishQueryJobRequest_QueryResultInline{
+					QueryResultInline: make([]byte, db.MaxInlineResultSize+1),
+				},
+			},
+			attempts: 1,
+			wantErr:  "must be at most",
+		},
+		{
+			desc: "query failure is not retried",
+			req: &pb.FinishQueryJobRequest{
+				WorkerName: "worker-1",
+				Result: &pb.FinishQueryJobRequest_FailureMessage{
+					FailureMessage: "syntax error",
+				},
+				FailureDetails: &pb.FailureDetails{
+					Category: pb.FailureCategory_FAILURE_CATEGORY_QUERY,
+					ExitCode: 2,
+				},
+			},
+			attempts:   1,
+			wantStatus: db.StatusFailed,
+		},
+		{
+			desc: "unclassified failure is not retried",
+			req: &pb.FinishQueryJobRequest{
+				WorkerName: "worker-1",
+				Result: &pb.FinishQueryJobRequest_FailureMessage{
+					FailureMessage: "something went wrong",
+				},
+			},
+			attempts:   1,
+			wantStatus: db.StatusFailed,
+		},
+		{
+			desc: "infrastructure failure is retried with backoff",
+			req: &pb.FinishQueryJobRequest{
+				WorkerName: "worker-1",
+				Result: &pb.FinishQueryJobRequest_FailureMessage{
+					FailureMessage: "failed to fetch",
+				},
+				FailureDetails: &pb.FailureDetails{
+					Category: pb.FailureCategory_FAILURE_CATEGORY_INFRASTRUCTURE,
+				},
+			},
+			attempts:      1,
+			retries:       1,
+			wantStatus:    db.StatusPending,
+			wantRetryTime: timePtr(testutil.StaticTimeRFC3339("2022-05-01T12:21:00-08:00")),
+		},
+		{
+			desc: "abandoned attempts don't count as retries",
+			req: &pb.FinishQueryJobRequest{
+				WorkerName: "worker-1",
+				Result: &pb.FinishQueryJobRequest_FailureMessage{
+					FailureMessage: "failed to fetch",
+				},
+				FailureDetails: &pb.FailureDetails{
+					Category: pb.FailureCategory_FAILURE_CATEGORY_INFRASTRUCTURE,
+				},
+			},
+			attempts:      4,
+			wantStatus:    db.StatusPending,
+			wantRetryTime: timePtr(testutil.StaticTimeRFC3339("2022-05-01T12:20:30-08:00")),
+		},
+		{
+			desc: "job running on another worker",
+			req: &pb.FinishQueryJobRequest{
+				WorkerName: "worker-2",
+				Result: &pb.FinishQueryJobRequest_QueryResultUrl{
+					QueryResultUrl: "s3://bucket/0123abcd.pb",
+				},
+			},
+			attempts: 1,
+			wantErr:  "lease expired",
+		},
+		{
+			desc: "infrastructure failure fails after too many retries",
+			req: &pb.FinishQueryJobRequest{
+				WorkerName: "worker-1",
+				Result: &pb.FinishQueryJobRequest_FailureMessage{
+					FailureMessage: "failed to fetch",
+				},
+				FailureDetails: &pb.FailureDetails{
+					Category: pb.FailureCategory_FAILURE_CATEGORY_INFRASTRUCTURE,
+				},
+			},
+			attempts:   1,
+			retries:    3,
+			wantStatus: db.StatusFailed,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			stubs := gostub.Stub(&timeNow, func() time.Time {
+				return testutil.StaticTimeRFC3339("2022-05-01T12:20:00-08:00")
+			})
+			defer stubs.Reset()
+
+			ctx := context.Background()
+			d := &DatabaseDispatch{
+				DB:         memory.New(),
+				MaxRetries: 3,
+			}
+			// Earlier attempts were abandoned by the worker, or failed and
+			// were retried
+			id := startJob(t, d.DB, "deps(//...)", "worker-1")
+			for i := 1; i < tc.attempts; i++ {
+				expireLease(t, d.DB, id, "worker-1")
+				dequeueJob(t, d.DB, id, "worker-1")
+			}
+			for i := 0; i < tc.retries; i++ {
+				if err := d.DB.RetryJob(ctx, id, "worker-1", time.Now().Add(-time.Hour), &db.JobResult{Error: "failed to fetch"}); err != nil {
+					t.Fatalf("RetryJob() failed: %v", err)
+				}
+				dequeueJob(t, d.DB, id, "worker-1")
+			}
+			tc.req.QueryJobId = id
+			_, err := d.FinishQueryJob(ctx, tc.req)
+			if diff := testutil.ErrSubstring(err, tc.wantErr); diff != "" {
+				t.Fatal(diff)
+			}
+			if err != nil {
+				return
+			}
+			job, err := d.DB.GetJob(ctx, id)
+			if err != nil {
+				t.Fatalf("GetJob() failed: %v", err)
+			}
+			if job.Status != tc.wantStatus {
+				t.Errorf("got status %q; want %q", job.Status, tc.wantStatus)
+			}
+			if (job.RetryTime == nil) != (tc.wantRetryTime == nil) || (job.RetryTime != nil && !job.RetryTime.Equal(*tc.wantRetryTime)) {
+				t.Errorf("got retry time %v; want %v", job.RetryTime, tc.wantRetryTime)
+			}
+			if job.ResultSHA256 != tc.wantSHA256 {
+				t.Errorf("got result digest %q; want %q", job.ResultSHA256, tc.wantSHA256)
+			}
+			if job.ResultEncoding != tc.wantEncoding {
+				t.Errorf("got result encoding %q; want %q", job.ResultEncoding, tc.wantEncoding)
+			}
+			if string(job.ResultInline) != tc.wantInline {
+				t.Errorf("got inline result %q; want %q", job.ResultInline, tc.wantInline)
+			}
+			if diff := cmp.Diff(tc.wantMetadata, job.ResultMetadata, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("got unexpected result metadata (-want +got):\n%s", diff)
+			}
+			if got := job.ResolvedCommitHash; tc.wantResolved != "" && (got == nil || *got != tc.wantResolved) {
+				t.Errorf("got resolved commit hash %v; want %q", got, tc.wantResolved)
+			}
+		})
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+// dequeueSignallingDB signals each time DequeueJob is called.
+type dequeueSignallingDB struct {
+	*db.Fake
+	dequeued chan struct{}
+}
+
+func (d *dequeueSignallingDB) DequeueJob(ctx context.Context, worker *db.Worker, leaseExpiry time.Time) (*db.QueryJob, error) {
+	job, err := d.Fake.DequeueJob(ctx, worker, leaseExpiry)
+	d.dequeued <- struct{}{}
+	return job, err
+}
+
+func TestGetQueryJobWait(t *testing.T) {
+	stubs := gostub.Stub(&timeNow, func() time.Time {
+		return testutil.StaticTimeRFC3339("2022-05-01T12:20:00-08:00")
+	})
+	defer stubs.Reset()
+	ctx := context.Background()
+
+	t.Run("times out", func(t *testing.T) {
+		d := &DatabaseDispatch{
+			DB:       &db.Fake{},
+			Notifier: &notify.Notifier{},
+		}
+		res, err := d.GetQueryJob(ctx, &pb.GetQueryJobRequest{
+			WorkerName: "worker-1",
+			MaxWait:    durationpb.New(10 * time.Millisecond),
+		})
+		if err != nil {
+			t.Fatalf("GetQueryJob() returned error: %v", err)
+		}
+		testutil.AssertProtoEqual(t, res, &pb.GetQueryJobResponse{
+			NextPollTime: timestamppb.New(testutil.StaticTimeRFC3339("2022-05-01T12:20:00-08:00")),
+		})
+	})
+
+	t.Run("wakes up when job is queued", func(t *testing.T) {
+		fake := &db.Fake{}
+		database := &dequeueSignallingDB{Fake: fake, dequeued: make(chan struct{}, 2)}
+		d := &DatabaseDispatch{
+			DB:       database,
+			Notifier: &notify.Notifier{},
+		}
+		type result struct {
+			res *pb.GetQueryJobResponse
+			err error
+		}
+		done := make(chan result)
+		go func() {
+			res, err := d.GetQueryJob(ctx, &pb.GetQueryJobRequest{
+				WorkerName: "worker-1",
+				MaxWait:    durationpb.New(time.Minute),
+			})
+			done <- result{res, err}
+		}()
+
+		<-database.dequeued
+		fake.Queue = append(fake.Queue, db.FakeQueueEntry{Job: &db.QueryJob{ID: "abcd"}})
+		d.Notifier.Notify()
+
+		select {
+		case r := <-done:
+			if r.err != nil {
+				t.Fatalf("GetQueryJob() returned error: %v", r.err)
+			}
+			if got := r.res.GetJob().GetId(); got != "abcd" {
+				t.Errorf("got job %q; want %q", got, "abcd")
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("GetQueryJob() didn't return after job was queued")
+		}
+	})
+}
+
+func TestGetQueryJobWaitForRetry(t *testing.T) {
+	stubs := gostub.Stub(&retryBaseDelay, 50*time.Millisecond)
+	defer stubs.Reset()
+	ctx := context.Background()
+
+	d := &DatabaseDispatch{
+		DB:       memory.New(),
+		Notifier: &notify.Notifier{},
+	}
+	id := enqueueJob(t, d.DB, "deps(//...)")
+	res, err := d.GetQueryJob(ctx, &pb.GetQueryJobRequest{WorkerName: "worker-1"})
+	if err != nil || res.GetJob().GetId() != id {
+		t.Fatalf("GetQueryJob() = %v, %v; want job %s", res, err, id)
+	}
+	_, err = d.FinishQueryJob(ctx, &pb.FinishQueryJobRequest{
+		QueryJobId: id,
+		WorkerName: "worker-1",
+		Result: &pb.FinishQueryJobRequest_FailureMessage{
+			FailureMessage: "failed to fetch",
+		},
+		FailureDetails: &pb.FailureDetails{
+			Category: pb.FailureCategory_FAILURE_CATEGORY_INFRASTRUCTURE,
+		},
+	})
+	if err != nil {
+		t.Fatalf("FinishQueryJob() failed: %v", err)
+	}
+
+	// The waiting worker is woken up once the job's retry time passes, well
+	// before max_wait runs out
+	start := time.Now()
+	res, err = d.GetQueryJob(ctx, &pb.GetQueryJobRequest{
+		WorkerName: "worker-2",
+		MaxWait:    durationpb.New(time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("GetQueryJob() returned error: %v", err)
+	}
+	if got := res.GetJob().GetId(); got != id {
+		t.Errorf("got job %q; want %q", got, id)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("GetQueryJob() returned after %v; want shortly after the retry delay", elapsed)
+	}
+}
+
+func TestRequeueExpiredJobs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := &DatabaseDispatch{
+		DB:       memory.New(),
+		Notifier: &notify.Notifier{},
+	}
+	id := enqueueJob(t, d.DB, "deps(//...)")
+	if _, err := d.DB.DequeueJob(ctx, &db.Worker{Name: "worker-1"}, time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("DequeueJob() failed: %v", err)
+	}
+
+	// Workers waiting for a job are woken up once the abandoned job is
+	// requeued
+	requeued := d.Notifier.Wait()
+	done := make(chan struct{})
+	go func() {
+		d.RequeueExpiredJobs(ctx)
+		close(done)
+	}()
+	select {
+	case <-requeued:
+	case <-time.After(10 * time.Second):
+		t.Fatal("RequeueExpiredJobs() didn't requeue job with expired lease")
+	}
+	cancel()
+	<-done
+
+	// The job is given to another worker, and the worker that abandoned it is
+	// told to stop running it
+	res, err := d.GetQueryJob(context.Background(), &pb.GetQueryJobRequest{WorkerName: "worker-2"})
+	if err != nil {
+		t.Fatalf("GetQueryJob() returned error: %v", err)
+	}
+	if got := res.GetJob().GetId(); got != id {
+		t.Errorf("got job %q; want %q", got, id)
+	}
+	heartbeat, err := d.Heartbeat(context.Background(), &pb.HeartbeatRequest{
+		QueryJobId: id,
+		WorkerName: "worker-1",
+	})
+	if err != nil {
+		t.Fatalf("Heartbeat() returned error: %v", err)
+	}
+	if !heartbeat.GetLeaseExpired() {
+		t.Errorf("got heartbeat response %v; want lease expired", heartbeat)
+	}
+}
@@ -0,0 +1,140 @@
+// Package joblog keeps the output that workers stream while running jobs, so
+// that clients can tail it.
+package joblog
+
+import (
+	"sync"
+)
+
+const (
+	// DefaultMaxBytes is the default limit on the size of a job's log.
+	DefaultMaxBytes = 1 << 20
+
+	// DefaultMaxJobs is the default limit on the number of logs kept.
+	DefaultMaxJobs = 1000
+)
+
+// truncatedMarker is appended to logs that exceed the size limit.
+const truncatedMarker = "\n[log truncated]\n"
+
+// Store keeps the logs of recent jobs in memory. The zero value is ready to
+// use, and a nil Store discards all logs. Logs aren't shared between
+// processes, so only the dispatcher that a worker streams a log to can serve
+// it.
+type Store struct {
+	// MaxBytes limits the size of each job's log; output beyond it is
+	// dropped. Defaults to DefaultMaxBytes if not set.
+	MaxBytes int
+
+	// MaxJobs limits the number of logs kept. Once it is reached, the least
+	// recently written log is dropped to make room for a new one. Defaults to
+	// DefaultMaxJobs if not set.
+	MaxJobs int
+
+	mu   sync.Mutex
+	logs map[string]*jobLog
+	seq  uint64
+
+	// created is closed and replaced each time a log is created, to wake up
+	// readers of logs that don't exist yet
+	created chan struct{}
+}
+
+type jobLog struct {
+	data      []byte
+	truncated bool
+
+	// seq orders logs by when they were last written
+	seq uint64
+
+	// ch is closed and replaced each time the log is written
+	ch chan struct{}
+}
+
+// Append adds p to the end of the log of the job with the given ID.
+func (s *Store) Append(id string, p []byte) {
+	if s == nil || len(p) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.get(id)
+	if l.truncated {
+		return
+	}
+	maxBytes := s.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	if room := maxBytes - len(l.data); len(p) > room {
+		l.data = append(l.data, p[:room]...)
+		l.data = append(l.data, truncatedMarker...)
+		l.truncated = true
+	} else {
+		l.data = append(l.data, p...)
+	}
+	s.seq++
+	l.seq = s.seq
+	close(l.ch)
+	l.ch = make(chan struct{})
+}
+
+// Read returns the contents of the log of the job with the given ID, starting
+// at offset bytes into it, along with a channel that is closed the next time
+// the log is written. Reading a log that doesn't exist doesn't create it, so
+// that readers can't cause logs that are being written to be dropped.
+func (s *Store) Read(id string, offset int) ([]byte, <-chan struct{}) {
+	if s == nil {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.logs[id]
+	if !ok {
+		if s.created == nil {
+			s.created = make(chan struct{})
+		}
+		return nil, s.created
+	}
+	if offset >= len(l.data) {
+		return nil, l.ch
+	}
+	data := make([]byte, len(l.data)-offset)
+	copy(data, l.data[offset:])
+	return data, l.ch
+}
+
+// get returns the log of the job with the given ID, creating it if needed.
+// s.mu must be held.
+func (s *Store) get(id string) *jobLog {
+	if l, ok := s.logs[id]; ok {
+		return l
+	}
+	if s.logs == nil {
+		s.logs = map[string]*jobLog{}
+	}
+	maxJobs := s.MaxJobs
+	if maxJobs <= 0 {
+		maxJobs = DefaultMaxJobs
+	}
+	if len(s.logs) >= maxJobs {
+		var oldest string
+		for id, l := range s.logs {
+			if oldest == "" || l.seq < s.logs[oldest].seq {
+				oldest = id
+			}
+		}
+		// Wake up readers of the dropped log, so that they don't wait for
+		// writes that will never be seen
+		close(s.logs[oldest].ch)
+		delete(s.logs, oldest)
+	}
+	s.seq++
+	l := &jobLog{seq: s.seq, ch: make(chan struct{})}
+	s.logs[id] = l
+	if s.created != nil {
+		close(s.created)
+		s.created = nil
+	}
+	return l
+}
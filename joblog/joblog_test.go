@@ -0,0 +1,95 @@
+package joblog
+
+import (
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	s := &Store{MaxBytes: 10}
+	data, changed := s.Read("1", 0)
+	if len(data) != 0 {
+		t.Errorf("Read() of new log = %q; want empty", data)
+	}
+
+	s.Append("1", []byte("hello "))
+	select {
+	case <-changed:
+	default:
+		t.Error("Read() channel not closed after Append()")
+	}
+	data, changed = s.Read("1", 0)
+	if got, want := string(data), "hello "; got != want {
+		t.Errorf("Read() = %q; want %q", got, want)
+	}
+
+	// Output beyond MaxBytes is dropped
+	s.Append("1", []byte("world!"))
+	s.Append("1", []byte("more"))
+	data, _ = s.Read("1", 6)
+	if got, want := string(data), "worl"+truncatedMarker; got != want {
+		t.Errorf("Read() = %q; want %q", got, want)
+	}
+	data, _ = s.Read("1", 100)
+	if len(data) != 0 {
+		t.Errorf("Read() past end of log = %q; want empty", data)
+	}
+
+	// Logs of other jobs are separate
+	data, _ = s.Read("2", 0)
+	if len(data) != 0 {
+		t.Errorf("Read() of other log = %q; want empty", data)
+	}
+}
+
+func TestStoreEviction(t *testing.T) {
+	s := &Store{MaxJobs: 2}
+	s.Append("1", []byte("one"))
+	s.Append("2", []byte("two"))
+	s.Append("1", []byte("one"))
+	_, changed := s.Read("2", 0)
+
+	// Job 2 was written least recently, so it is dropped
+	s.Append("3", []byte("three"))
+	select {
+	case <-changed:
+	default:
+		t.Error("Read() channel not closed after log was dropped")
+	}
+	if data, _ := s.Read("1", 0); string(data) != "oneone" {
+		t.Errorf("Read() = %q; want %q", data, "oneone")
+	}
+}
+
+func TestStoreReadDoesNotEvict(t *testing.T) {
+	s := &Store{MaxJobs: 2}
+	s.Append("1", []byte("one"))
+	s.Append("2", []byte("two"))
+
+	// Reading logs that don't exist doesn't make room for them
+	_, changed := s.Read("3", 0)
+	s.Read("4", 0)
+	for id, want := range map[string]string{"1": "one", "2": "two"} {
+		if data, _ := s.Read(id, 0); string(data) != want {
+			t.Errorf("Read(%q) = %q; want %q", id, data, want)
+		}
+	}
+
+	// Readers of a log are woken up once it is created
+	s.Append("3", []byte("three"))
+	select {
+	case <-changed:
+	default:
+		t.Error("Read() channel not closed after log was created")
+	}
+	if data, _ := s.Read("3", 0); string(data) != "three" {
+		t.Errorf("Read() = %q; want %q", data, "three")
+	}
+}
+
+func TestNilStore(t *testing.T) {
+	var s *Store
+	s.Append("1", []byte("hello"))
+	if data, _ := s.Read("1", 0); len(data) != 0 {
+		t.Errorf("Read() = %q; want empty", data)
+	}
+}
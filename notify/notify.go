@@ -0,0 +1,54 @@
+// Package notify wakes up goroutines waiting for new jobs to be enqueued in the
+// same process.
+package notify
+
+import (
+	"sync"
+	"time"
+)
+
+// Notifier broadcasts that new jobs may be available. The zero value is ready
+// to use, and a nil Notifier never notifies. Notifications aren't shared
+// between processes, so waiters should still time out and check for jobs
+// periodically.
+type Notifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// Wait returns a channel that is closed the next time Notify is called. To
+// avoid missing notifications, callers should call Wait before checking
+// whether a job is available.
+func (n *Notifier) Wait() <-chan struct{} {
+	if n == nil {
+		return nil
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	return n.ch
+}
+
+// Notify wakes up all current waiters.
+func (n *Notifier) Notify() {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+}
+
+// NotifyAfter calls Notify once d has elapsed, e.g. when a job that is waiting
+// to be retried becomes available.
+func (n *Notifier) NotifyAfter(d time.Duration) {
+	if n == nil {
+		return
+	}
+	time.AfterFunc(d, n.Notify)
+}
@@ -0,0 +1,48 @@
+package notify
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNotifier(t *testing.T) {
+	var n Notifier
+	first := n.Wait()
+	second := n.Wait()
+	select {
+	case <-first:
+		t.Fatal("Wait() channel closed before Notify()")
+	default:
+	}
+
+	n.Notify()
+	for _, ch := range []<-chan struct{}{first, second} {
+		select {
+		case <-ch:
+		default:
+			t.Error("Wait() channel not closed after Notify()")
+		}
+	}
+
+	// Waiters after a notification wait for the next one
+	select {
+	case <-n.Wait():
+		t.Error("Wait() channel closed by previous Notify()")
+	default:
+	}
+}
+
+func TestNotifyAfter(t *testing.T) {
+	var n Notifier
+	ch := n.Wait()
+	n.NotifyAfter(10 * time.Millisecond)
+	select {
+	case <-ch:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Wait() channel not closed after NotifyAfter() delay")
+	}
+
+	// A nil Notifier never notifies
+	var nilNotifier *Notifier
+	nilNotifier.NotifyAfter(0)
+}
@@ -3,42 +3,188 @@ package queue
 import (
 	"context"
 	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/minorhacks/bazel_remote_query/db"
+	"github.com/minorhacks/bazel_remote_query/joblog"
+	"github.com/minorhacks/bazel_remote_query/notify"
 	pb "github.com/minorhacks/bazel_remote_query/proto"
+	"github.com/minorhacks/bazel_remote_query/resultstore"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
-var timeNow = time.Now
+var (
+	timeNow = time.Now
+
+	// watchPollInterval is how often WatchJob re-reads a job from the DB, to
+	// pick up changes made by other dispatcher processes that aren't reported
+	// through DB.WatchJob.
+	watchPollInterval = 5 * time.Second
+
+	// Poll asks clients to poll again around when their job is estimated to
+	// finish, bounded by these intervals. defaultPollInterval is used when
+	// there is no estimate.
+	minPollInterval     = 1 * time.Second
+	maxPollInterval     = 30 * time.Second
+	defaultPollInterval = 5 * time.Second
+
+	// getResultChunkSize is the maximum size of each message streamed by
+	// GetResult.
+	getResultChunkSize = 1 << 20
+
+	// durationEstimateTTL is how long job duration estimates are cached for,
+	// so that polling doesn't list a repository's job history on every call.
+	durationEstimateTTL = time.Minute
+)
+
+const (
+	defaultListPageSize = 50
+	maxListPageSize     = 1000
+
+	// durationHistorySize is the number of recent jobs that job durations are
+	// estimated from.
+	durationHistorySize = 20
+)
+
+var jobStatuses = map[string]pb.JobStatus{
+	db.StatusPending:   pb.JobStatus_JOB_STATUS_PENDING,
+	db.StatusRunning:   pb.JobStatus_JOB_STATUS_RUNNING,
+	db.StatusSucceeded: pb.JobStatus_JOB_STATUS_SUCCEEDED,
+	db.StatusFailed:    pb.JobStatus_JOB_STATUS_FAILED,
+	db.StatusCancelled: pb.JobStatus_JOB_STATUS_CANCELLED,
+}
+
+var queryTypes = map[string]pb.QueryType{
+	db.QueryTypeQuery:  pb.QueryType_QUERY_TYPE_QUERY,
+	db.QueryTypeCquery: pb.QueryType_QUERY_TYPE_CQUERY,
+	db.QueryTypeAquery: pb.QueryType_QUERY_TYPE_AQUERY,
+}
+
+var outputFormats = map[string]pb.OutputFormat{
+	db.OutputFormatProto:             pb.OutputFormat_OUTPUT_FORMAT_PROTO,
+	db.OutputFormatLabel:             pb.OutputFormat_OUTPUT_FORMAT_LABEL,
+	db.OutputFormatLabelKind:         pb.OutputFormat_OUTPUT_FORMAT_LABEL_KIND,
+	db.OutputFormatXML:               pb.OutputFormat_OUTPUT_FORMAT_XML,
+	db.OutputFormatGraph:             pb.OutputFormat_OUTPUT_FORMAT_GRAPH,
+	db.OutputFormatStreamedJSONProto: pb.OutputFormat_OUTPUT_FORMAT_STREAMED_JSONPROTO,
+}
+
+var failureCategories = map[string]pb.FailureCategory{
+	db.FailureCategoryQuery:          pb.FailureCategory_FAILURE_CATEGORY_QUERY,
+	db.FailureCategoryInfrastructure: pb.FailureCategory_FAILURE_CATEGORY_INFRASTRUCTURE,
+}
+
+var contentEncodings = map[string]pb.ContentEncoding{
+	db.EncodingGzip: pb.ContentEncoding_CONTENT_ENCODING_GZIP,
+	db.EncodingZstd: pb.ContentEncoding_CONTENT_ENCODING_ZSTD,
+}
+
+var jobPhases = map[string]pb.JobPhase{
+	db.PhaseFetch:    pb.JobPhase_JOB_PHASE_FETCH,
+	db.PhaseCheckout: pb.JobPhase_JOB_PHASE_CHECKOUT,
+	db.PhaseQuery:    pb.JobPhase_JOB_PHASE_QUERY,
+	db.PhaseUpload:   pb.JobPhase_JOB_PHASE_UPLOAD,
+}
 
 type DatabaseQueue struct {
 	DB db.DB
+
+	// Notifier is notified when a new job is queued, to wake up workers
+	// waiting for a job in GetQueryJob.
+	Notifier *notify.Notifier
+
+	// AllowedBazelFlags lists the names of Bazel flags that clients may pass
+	// with a query, e.g. `--keep_going`.
+	AllowedBazelFlags []string
+
+	// Logs holds the logs that workers stream to the DatabaseDispatch sharing
+	// the DB, which are served by StreamJobLogs.
+	Logs *joblog.Store
+
+	// Results is the store that workers upload results to, from which
+	// GetResult serves them. If nil, GetResult is unavailable.
+	Results resultstore.Store
+
+	// estimates caches job duration estimates by repository
+	estimatesMu sync.Mutex
+	estimates   map[string]durationEstimate
+}
+
+type durationEstimate struct {
+	duration time.Duration
+	expiry   time.Time
 }
 
 func (q *DatabaseQueue) Queue(ctx context.Context, req *pb.QueueRequest) (*pb.QueueResponse, error) {
+	queryType, err := dbQueryType(req.GetQueryType())
+	if err != nil {
+		return nil, err
+	}
+	outputFormat, err := dbOutputFormat(req.GetOutputFormat())
+	if err != nil {
+		return nil, err
+	}
+	if err := q.checkBazelFlags(req.GetBazelFlags()); err != nil {
+		return nil, err
+	}
+	// Workers pass the query to bazel as an argument, where a leading - would
+	// make it a flag that bypasses AllowedBazelFlags.
+	if strings.HasPrefix(req.GetQueryString(), "-") {
+		return nil, status.Errorf(codes.InvalidArgument, "query %q must not start with -", req.GetQueryString())
+	}
 	job := &db.QueryJob{
-		Repository: req.GetRepository(),
-		CommitHash: req.GetCommitHash(),
-		Query:      req.GetQueryString(),
+		Repository:     req.GetRepository(),
+		CommitHash:     req.GetCommitHash(),
+		Query:          req.GetQueryString(),
+		QueryType:      queryType,
+		BazelFlags:     req.GetBazelFlags(),
+		OutputFormat:   outputFormat,
+		RequiredLabels: db.LabelList(req.GetRequiredLabels()),
 	}
 	if err := q.DB.EnqueueJob(ctx, job); err != nil {
 		return nil, status.Errorf(codes.Internal, "db.EnqueueJob() failed: %v", err)
 	}
+	if job.Status == db.StatusPending {
+		q.Notifier.Notify()
+	}
 	return &pb.QueueResponse{Id: job.ID}, nil
 }
 
+// checkBazelFlags returns an error if any of the flags isn't allowed. Flags are
+// matched by name, so that allowing `--order_output` also allows
+// `--order_output=no`.
+func (q *DatabaseQueue) checkBazelFlags(flags []string) error {
+	for _, flag := range flags {
+		if !strings.HasPrefix(flag, "--") {
+			return status.Errorf(codes.InvalidArgument, "bazel flag %q must start with --", flag)
+		}
+		name := strings.SplitN(flag, "=", 2)[0]
+		allowed := false
+		for _, a := range q.AllowedBazelFlags {
+			if name == a {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return status.Errorf(codes.PermissionDenied, "bazel flag %q is not allowed", name)
+		}
+	}
+	return nil
+}
+
 func (q *DatabaseQueue) Poll(ctx context.Context, req *pb.PollRequest) (*pb.PollResponse, error) {
 	job, err := q.DB.GetJob(ctx, req.GetId())
 	if err != nil {
-		c := codes.Internal
-		if errors.Is(err, db.ErrJobNotFound) {
-			c = codes.NotFound
-		}
-		return nil, status.Errorf(c, err.Error())
+		return nil, getJobError(err)
 	}
 
 	res := &pb.PollResponse{
@@ -48,31 +194,508 @@ func (q *DatabaseQueue) Poll(ctx context.Context, req *pb.PollRequest) (*pb.Poll
 	case db.StatusPending:
 		fallthrough
 	case db.StatusRunning:
-		res.Status = &pb.PollResponse_InProgress{
-			InProgress: &pb.PollResponse_QueryInProgress{
-				NextPollTime: timestamppb.New(timeNow().Add(5 * time.Second)), // TODO: parameterize
-			},
+		inProgress, err := q.queryInProgress(ctx, job)
+		if err != nil {
+			return nil, err
 		}
+		res.Status = &pb.PollResponse_InProgress{InProgress: inProgress}
 	case db.StatusSucceeded:
-		if job.ResultURL == nil {
-			return nil, status.Error(codes.FailedPrecondition, "query succeeded but ResultURL is not set")
-		}
-		res.Status = &pb.PollResponse_Success{
-			Success: &pb.PollResponse_QuerySuccess{
-				ResultsGcsUrl: *job.ResultURL,
-			},
+		success, err := querySuccess(job)
+		if err != nil {
+			return nil, err
 		}
+		res.Status = &pb.PollResponse_Success{Success: success}
 	case db.StatusFailed:
-		if job.ResultError == nil {
-			return nil, status.Error(codes.FailedPrecondition, "query failed but ResultError is not set")
+		failure, err := queryFailure(job)
+		if err != nil {
+			return nil, err
 		}
-		res.Status = &pb.PollResponse_Failure{
-			Failure: &pb.PollResponse_QueryFailure{
-				FailureMessage: *job.ResultError,
-			},
+		res.Status = &pb.PollResponse_Failure{Failure: failure}
+	case db.StatusCancelled:
+		res.Status = &pb.PollResponse_Cancelled{
+			Cancelled: &pb.PollResponse_QueryCancelled{},
 		}
 	default:
 		return nil, status.Errorf(codes.FailedPrecondition, "can't poll job with status: %q", job.Status)
 	}
 	return res, nil
 }
+
+func (q *DatabaseQueue) WatchJob(req *pb.WatchJobRequest, stream pb.QueryQueue_WatchJobServer) error {
+	ctx := stream.Context()
+
+	// Subscribe before fetching the job, so that no change can slip in between
+	// the two.
+	changes, unsubscribe := q.DB.WatchJob(req.GetId())
+	defer unsubscribe()
+
+	job, err := q.DB.GetJob(ctx, req.GetId())
+	if err != nil {
+		return getJobError(err)
+	}
+
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+
+	var lastStatus string
+	for {
+		if job.Status != lastStatus {
+			res, err := watchJobResponse(job)
+			if err != nil {
+				return err
+			}
+			if err := stream.Send(res); err != nil {
+				return err
+			}
+			lastStatus = job.Status
+		}
+		if job.Status == db.StatusSucceeded || job.Status == db.StatusFailed || job.Status == db.StatusCancelled {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case job = <-changes:
+		case <-ticker.C:
+			job, err = q.DB.GetJob(ctx, req.GetId())
+			if err != nil {
+				return getJobError(err)
+			}
+		}
+	}
+}
+
+func (q *DatabaseQueue) StreamJobLogs(req *pb.StreamJobLogsRequest, stream pb.QueryQueue_StreamJobLogsServer) error {
+	ctx := stream.Context()
+	if req.GetOffset() < 0 {
+		return status.Errorf(codes.InvalidArgument, "offset must not be negative")
+	}
+
+	changes, unsubscribe := q.DB.WatchJob(req.GetId())
+	defer unsubscribe()
+
+	job, err := q.DB.GetJob(ctx, req.GetId())
+	if err != nil {
+		return getJobError(err)
+	}
+
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+
+	offset := int(req.GetOffset())
+	for {
+		// Workers stop streaming logs before finishing a job, so once the job
+		// has finished, the rest of its log can be read at once.
+		finished := job.Status == db.StatusSucceeded || job.Status == db.StatusFailed || job.Status == db.StatusCancelled
+		data, written := q.Logs.Read(req.GetId(), offset)
+		if len(data) > 0 {
+			if err := stream.Send(&pb.StreamJobLogsResponse{
+				Data:   data,
+				Offset: int64(offset),
+			}); err != nil {
+				return err
+			}
+			offset += len(data)
+		}
+		if finished {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-written:
+		case job = <-changes:
+		case <-ticker.C:
+			job, err = q.DB.GetJob(ctx, req.GetId())
+			if err != nil {
+				return getJobError(err)
+			}
+		}
+	}
+}
+
+func (q *DatabaseQueue) GetResult(req *pb.GetResultRequest, stream pb.QueryQueue_GetResultServer) error {
+	ctx := stream.Context()
+	if req.GetOffset() < 0 {
+		return status.Errorf(codes.InvalidArgument, "offset must not be negative")
+	}
+
+	job, err := q.DB.GetJob(ctx, req.GetId())
+	if err != nil {
+		return getJobError(err)
+	}
+	if job.Status != db.StatusSucceeded {
+		return status.Errorf(codes.FailedPrecondition, "job %q has status %q; want %q", job.ID, job.Status, db.StatusSucceeded)
+	}
+	if job.ResultURL == nil {
+		return sendInlineResult(job.ResultInline, req.GetOffset(), stream)
+	}
+	if q.Results == nil {
+		return status.Errorf(codes.Unimplemented, "no result store is configured")
+	}
+	// Results of jobs finished before digests were recorded have no known
+	// size, so their offset is only checked by the store.
+	if job.ResultSHA256 != "" && req.GetOffset() > job.ResultSize {
+		return status.Errorf(codes.OutOfRange, "offset %d is past the end of the %d byte result", req.GetOffset(), job.ResultSize)
+	}
+
+	r, err := q.Results.Get(ctx, *job.ResultURL, req.GetOffset())
+	if errors.Is(err, resultstore.ErrNotFound) {
+		return status.Errorf(codes.NotFound, "result of job %q not found at %q", job.ID, *job.ResultURL)
+	} else if err != nil {
+		return status.Errorf(codes.Internal, "failed to read result of job %q: %v", job.ID, err)
+	}
+	defer r.Close()
+
+	offset := req.GetOffset()
+	buf := make([]byte, getResultChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := stream.Send(&pb.GetResultResponse{
+				Data:   buf[:n],
+				Offset: offset,
+			}); err != nil {
+				return err
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return status.Errorf(codes.Internal, "failed to read result of job %q: %v", job.ID, err)
+		}
+	}
+}
+
+// sendInlineResult streams a result stored inline in the DB, starting offset
+// bytes into it.
+func sendInlineResult(result []byte, offset int64, stream pb.QueryQueue_GetResultServer) error {
+	if offset > int64(len(result)) {
+		return status.Errorf(codes.OutOfRange, "offset %d is past the end of the %d byte result", offset, len(result))
+	}
+	for offset < int64(len(result)) {
+		end := offset + int64(getResultChunkSize)
+		if end > int64(len(result)) {
+			end = int64(len(result))
+		}
+		if err := stream.Send(&pb.GetResultResponse{
+			Data:   result[offset:end],
+			Offset: offset,
+		}); err != nil {
+			return err
+		}
+		offset = end
+	}
+	return nil
+}
+
+func (q *DatabaseQueue) CancelJob(ctx context.Context, req *pb.CancelJobRequest) (*pb.CancelJobResponse, error) {
+	if _, err := q.DB.CancelJob(ctx, req.GetId()); err != nil {
+		c := codes.Internal
+		switch {
+		case errors.Is(err, db.ErrJobNotFound):
+			c = codes.NotFound
+		case errors.Is(err, db.ErrJobFinished):
+			c = codes.FailedPrecondition
+		}
+		return nil, status.Errorf(c, "db.CancelJob() failed: %v", err)
+	}
+	return &pb.CancelJobResponse{}, nil
+}
+
+func (q *DatabaseQueue) ListJobs(ctx context.Context, req *pb.ListJobsRequest) (*pb.ListJobsResponse, error) {
+	filter := &db.ListJobsFilter{
+		Repository: req.GetRepository(),
+		CommitHash: req.GetCommitHash(),
+		Worker:     req.GetWorkerName(),
+	}
+	if req.GetStatus() != pb.JobStatus_JOB_STATUS_UNKNOWN {
+		for s, st := range jobStatuses {
+			if st == req.GetStatus() {
+				filter.Status = s
+			}
+		}
+		if filter.Status == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "can't list jobs with status %v", req.GetStatus())
+		}
+	}
+	if req.QueuedAfter != nil {
+		filter.QueuedAfter = req.GetQueuedAfter().AsTime()
+	}
+	if req.QueuedBefore != nil {
+		filter.QueuedBefore = req.GetQueuedBefore().AsTime()
+	}
+	pageSize := int(req.GetPageSize())
+	if pageSize < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "page_size must not be negative; got %d", pageSize)
+	} else if pageSize == 0 {
+		pageSize = defaultListPageSize
+	} else if pageSize > maxListPageSize {
+		pageSize = maxListPageSize
+	}
+
+	jobs, nextPageToken, err := q.DB.ListJobs(ctx, filter, pageSize, req.GetPageToken())
+	if err != nil {
+		c := codes.Internal
+		if errors.Is(err, db.ErrInvalidPageToken) {
+			c = codes.InvalidArgument
+		}
+		return nil, status.Errorf(c, "db.ListJobs() failed: %v", err)
+	}
+	res := &pb.ListJobsResponse{
+		NextPageToken: nextPageToken,
+	}
+	for _, job := range jobs {
+		res.Jobs = append(res.Jobs, jobInfo(job))
+	}
+	return res, nil
+}
+
+func jobInfo(job *db.QueryJob) *pb.JobInfo {
+	info := &pb.JobInfo{
+		Id:           job.ID,
+		Repository:   job.Repository,
+		CommitHash:   job.CommitHash,
+		QueryString:  job.Query,
+		QueryType:    queryTypes[job.QueryType],
+		BazelFlags:   job.BazelFlags,
+		OutputFormat: outputFormats[job.OutputFormat],
+		Status:       jobStatuses[job.Status],
+		Attempts:     int32(job.Attempts),
+		QueueTime:    timestamppb.New(job.QueueTime),
+	}
+	if job.ResolvedCommitHash != nil {
+		info.ResolvedCommitHash = *job.ResolvedCommitHash
+	}
+	if len(job.RequiredLabels) > 0 {
+		info.RequiredLabels = db.LabelMap(job.RequiredLabels)
+	}
+	if job.Worker != nil {
+		info.WorkerName = *job.Worker
+	}
+	if job.Status == db.StatusRunning {
+		info.Phase = jobPhases[job.Phase]
+	}
+	if job.StartTime != nil {
+		info.StartTime = timestamppb.New(*job.StartTime)
+	}
+	if job.FinishTime != nil {
+		info.FinishTime = timestamppb.New(*job.FinishTime)
+	}
+	return info
+}
+
+func dbQueryType(t pb.QueryType) (string, error) {
+	for s, qt := range queryTypes {
+		if qt == t {
+			return s, nil
+		}
+	}
+	return "", status.Errorf(codes.InvalidArgument, "unsupported query type %v", t)
+}
+
+func dbOutputFormat(f pb.OutputFormat) (string, error) {
+	for s, of := range outputFormats {
+		if of == f {
+			return s, nil
+		}
+	}
+	return "", status.Errorf(codes.InvalidArgument, "unsupported output format %v", f)
+}
+
+func watchJobResponse(job *db.QueryJob) (*pb.WatchJobResponse, error) {
+	res := &pb.WatchJobResponse{
+		Id:     job.ID,
+		Status: jobStatuses[job.Status],
+	}
+	switch job.Status {
+	case db.StatusPending, db.StatusRunning, db.StatusCancelled:
+	case db.StatusSucceeded:
+		success, err := querySuccess(job)
+		if err != nil {
+			return nil, err
+		}
+		res.Result = &pb.WatchJobResponse_Success{Success: success}
+	case db.StatusFailed:
+		failure, err := queryFailure(job)
+		if err != nil {
+			return nil, err
+		}
+		res.Result = &pb.WatchJobResponse_Failure{Failure: failure}
+	default:
+		return nil, status.Errorf(codes.FailedPrecondition, "can't watch job with status: %q", job.Status)
+	}
+	return res, nil
+}
+
+// queryInProgress describes the progress of a pending or running job.
+func (q *DatabaseQueue) queryInProgress(ctx context.Context, job *db.QueryJob) (*pb.PollResponse_QueryInProgress, error) {
+	now := timeNow()
+	inProgress := &pb.PollResponse_QueryInProgress{
+		Status: jobStatuses[job.Status],
+	}
+	duration, err := q.estimateDuration(ctx, job.Repository)
+	if err != nil {
+		return nil, err
+	}
+
+	var finish time.Time
+	switch job.Status {
+	case db.StatusPending:
+		pos, err := q.DB.QueuePosition(ctx, job)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get queue position of job %s: %v", job.ID, err)
+		}
+		inProgress.QueuePosition = int32(pos)
+		if duration > 0 {
+			// This assumes that the jobs ahead run one after another, so it
+			// overestimates when there are several workers.
+			finish = now.Add(time.Duration(pos+1) * duration)
+		}
+	case db.StatusRunning:
+		if job.Worker != nil {
+			inProgress.WorkerName = *job.Worker
+		}
+		inProgress.Phase = jobPhases[job.Phase]
+		if job.StartTime != nil {
+			inProgress.StartTime = timestamppb.New(*job.StartTime)
+			if duration > 0 {
+				finish = job.StartTime.Add(duration)
+			}
+		}
+	}
+
+	wait := defaultPollInterval
+	if !finish.IsZero() {
+		inProgress.EstimatedFinishTime = timestamppb.New(finish)
+		wait = finish.Sub(now)
+		if wait < minPollInterval {
+			wait = minPollInterval
+		} else if wait > maxPollInterval {
+			wait = maxPollInterval
+		}
+	}
+	inProgress.NextPollTime = timestamppb.New(now.Add(wait))
+	return inProgress, nil
+}
+
+// estimateDuration returns the median duration of recently succeeded jobs in
+// repository, or 0 if there are none. Estimates are cached for
+// durationEstimateTTL.
+func (q *DatabaseQueue) estimateDuration(ctx context.Context, repository string) (time.Duration, error) {
+	now := timeNow()
+	q.estimatesMu.Lock()
+	e, ok := q.estimates[repository]
+	q.estimatesMu.Unlock()
+	if ok && now.Before(e.expiry) {
+		return e.duration, nil
+	}
+
+	duration, err := q.medianDuration(ctx, repository)
+	if err != nil {
+		return 0, err
+	}
+	q.estimatesMu.Lock()
+	defer q.estimatesMu.Unlock()
+	if q.estimates == nil {
+		q.estimates = map[string]durationEstimate{}
+	}
+	q.estimates[repository] = durationEstimate{duration: duration, expiry: now.Add(durationEstimateTTL)}
+	return duration, nil
+}
+
+// medianDuration returns the median duration of recently succeeded jobs in
+// repository, or 0 if there are none.
+func (q *DatabaseQueue) medianDuration(ctx context.Context, repository string) (time.Duration, error) {
+	filter := &db.ListJobsFilter{
+		Repository: repository,
+		Status:     db.StatusSucceeded,
+	}
+	jobs, _, err := q.DB.ListJobs(ctx, filter, durationHistorySize, "")
+	if err != nil {
+		return 0, status.Errorf(codes.Internal, "failed to list recent jobs in %q: %v", repository, err)
+	}
+	var durations []time.Duration
+	for _, j := range jobs {
+		if j.StartTime != nil && j.FinishTime != nil {
+			durations = append(durations, j.FinishTime.Sub(*j.StartTime))
+		}
+	}
+	if len(durations) == 0 {
+		return 0, nil
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[len(durations)/2], nil
+}
+
+func querySuccess(job *db.QueryJob) (*pb.PollResponse_QuerySuccess, error) {
+	success := &pb.PollResponse_QuerySuccess{
+		ResultEncoding: contentEncodings[job.ResultEncoding],
+		Metadata:       resultMetadata(job),
+	}
+	// Jobs without a result URL have their result stored inline
+	if job.ResultURL != nil {
+		success.ResultsGcsUrl = *job.ResultURL
+		success.ResultUrl = *job.ResultURL
+	} else {
+		success.ResultInline = job.ResultInline
+	}
+	if job.ResultSHA256 != "" {
+		success.ResultDigest = &pb.Digest{
+			Sha256:    job.ResultSHA256,
+			SizeBytes: job.ResultSize,
+		}
+	}
+	return success, nil
+}
+
+// resultMetadata returns the metadata of a succeeded job's result.
+func resultMetadata(job *db.QueryJob) *pb.ResultMetadata {
+	m := job.ResultMetadata
+	metadata := &pb.ResultMetadata{
+		BazelVersion: m.BazelVersion,
+		BazelFlags:   m.BazelFlags,
+		TargetCount:  m.TargetCount,
+		SizeBytes:    m.Size,
+	}
+	if job.ResolvedCommitHash != nil {
+		metadata.ResolvedCommitHash = *job.ResolvedCommitHash
+	}
+	// Durations are left unset for jobs finished by workers that didn't
+	// report them
+	if m.FetchDuration != 0 || m.CheckoutDuration != 0 || m.QueryDuration != 0 || m.UploadDuration != 0 {
+		metadata.FetchDuration = durationpb.New(m.FetchDuration)
+		metadata.CheckoutDuration = durationpb.New(m.CheckoutDuration)
+		metadata.QueryDuration = durationpb.New(m.QueryDuration)
+		metadata.UploadDuration = durationpb.New(m.UploadDuration)
+	}
+	return metadata
+}
+
+func queryFailure(job *db.QueryJob) (*pb.PollResponse_QueryFailure, error) {
+	if job.ResultError == nil {
+		return nil, status.Error(codes.FailedPrecondition, "query failed but ResultError is not set")
+	}
+	failure := &pb.PollResponse_QueryFailure{
+		FailureMessage: *job.ResultError,
+	}
+	if job.FailureCategory != "" {
+		failure.Details = &pb.FailureDetails{
+			Category: failureCategories[job.FailureCategory],
+			ExitCode: int32(job.ExitCode),
+			Stderr:   job.Stderr,
+		}
+	}
+	return failure, nil
+}
+
+func getJobError(err error) error {
+	c := codes.Internal
+	if errors.Is(err, db.ErrJobNotFound) {
+		c = codes.NotFound
+	}
+	return status.Error(c, err.Error())
+}
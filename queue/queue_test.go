@@ -3,29 +3,45 @@ package queue
 import (
 	"context"
 	"errors"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/minorhacks/bazel_remote_query/db"
+	"github.com/minorhacks/bazel_remote_query/db/memory"
+	"github.com/minorhacks/bazel_remote_query/joblog"
 	pb "github.com/minorhacks/bazel_remote_query/proto"
+	"github.com/minorhacks/bazel_remote_query/resultstore"
 	"github.com/minorhacks/bazel_remote_query/testutil"
 
 	"github.com/prashantv/gostub"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func TestQueue(t *testing.T) {
 	testCases := []struct {
-		desc       string
-		req        *pb.QueueRequest
-		enqueueErr error
-		want       *pb.QueueResponse
-		wantErr    string
+		desc         string
+		req          *pb.QueueRequest
+		allowedFlags []string
+		enqueueErr   error
+		want         *pb.QueueResponse
+		wantErr      string
 	}{
 		{
 			desc: "successful queue",
 			req:  &pb.QueueRequest{},
-			want: &pb.QueueResponse{},
+			want: &pb.QueueResponse{Id: "fake-1"},
+		},
+		{
+			desc: "successful cquery",
+			req: &pb.QueueRequest{
+				QueryType: pb.QueryType_QUERY_TYPE_CQUERY,
+			},
+			want: &pb.QueueResponse{Id: "fake-1"},
 		},
 		{
 			desc:       "propagates enqueue failure",
@@ -33,6 +49,66 @@ func TestQueue(t *testing.T) {
 			enqueueErr: errors.New("some enqueue error"),
 			wantErr:    "some enqueue error",
 		},
+		{
+			desc: "allowed bazel flags",
+			req: &pb.QueueRequest{
+				BazelFlags: []string{"--keep_going", "--order_output=no"},
+			},
+			allowedFlags: []string{"--keep_going", "--order_output"},
+			want:         &pb.QueueResponse{Id: "fake-1"},
+		},
+		{
+			desc: "rejects disallowed bazel flag",
+			req: &pb.QueueRequest{
+				BazelFlags: []string{"--keep_going", "--output_base=/tmp"},
+			},
+			allowedFlags: []string{"--keep_going"},
+			wantErr:      `bazel flag "--output_base" is not allowed`,
+		},
+		{
+			desc: "rejects bazel flags when none are allowed",
+			req: &pb.QueueRequest{
+				BazelFlags: []string{"--keep_going"},
+			},
+			wantErr: `bazel flag "--keep_going" is not allowed`,
+		},
+		{
+			desc: "rejects arguments that aren't flags",
+			req: &pb.QueueRequest{
+				BazelFlags: []string{"//foo:bar"},
+			},
+			allowedFlags: []string{"--keep_going"},
+			wantErr:      "must start with --",
+		},
+		{
+			desc: "rejects query that looks like a flag",
+			req: &pb.QueueRequest{
+				QueryString: "--override_repository=foo=/etc",
+			},
+			allowedFlags: []string{"--keep_going"},
+			wantErr:      "must not start with -",
+		},
+		{
+			desc: "successful label_kind query",
+			req: &pb.QueueRequest{
+				OutputFormat: pb.OutputFormat_OUTPUT_FORMAT_LABEL_KIND,
+			},
+			want: &pb.QueueResponse{Id: "fake-1"},
+		},
+		{
+			desc: "rejects unsupported output format",
+			req: &pb.QueueRequest{
+				OutputFormat: pb.OutputFormat(42),
+			},
+			wantErr: "unsupported output format",
+		},
+		{
+			desc: "rejects unsupported query type",
+			req: &pb.QueueRequest{
+				QueryType: pb.QueryType(42),
+			},
+			wantErr: "unsupported query type",
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.desc, func(t *testing.T) {
@@ -41,6 +117,7 @@ func TestQueue(t *testing.T) {
 				DB: &db.Fake{
 					EnqueueJobErr: tc.enqueueErr,
 				},
+				AllowedBazelFlags: tc.allowedFlags,
 			}
 
 			got, gotErr := d.Queue(ctx, tc.req)
@@ -72,6 +149,7 @@ func TestPoll(t *testing.T) {
 				Status: &pb.PollResponse_InProgress{
 					InProgress: &pb.PollResponse_QueryInProgress{
 						NextPollTime: timestamppb.New(testutil.StaticTimeRFC3339("2022-05-01T12:20:05-08:00")),
+						Status:       pb.JobStatus_JOB_STATUS_PENDING,
 					},
 				},
 			},
@@ -86,6 +164,44 @@ func TestPoll(t *testing.T) {
 				Status: &pb.PollResponse_InProgress{
 					InProgress: &pb.PollResponse_QueryInProgress{
 						NextPollTime: timestamppb.New(testutil.StaticTimeRFC3339("2022-05-01T12:20:05-08:00")),
+						Status:       pb.JobStatus_JOB_STATUS_RUNNING,
+						WorkerName:   "worker-1",
+					},
+				},
+			},
+		},
+		{
+			desc: "pending job with history",
+			req: &pb.PollRequest{
+				Id: "7",
+			},
+			want: &pb.PollResponse{
+				Id: "7",
+				Status: &pb.PollResponse_InProgress{
+					InProgress: &pb.PollResponse_QueryInProgress{
+						NextPollTime:        timestamppb.New(testutil.StaticTimeRFC3339("2022-05-01T12:20:30-08:00")),
+						Status:              pb.JobStatus_JOB_STATUS_PENDING,
+						QueuePosition:       1,
+						EstimatedFinishTime: timestamppb.New(testutil.StaticTimeRFC3339("2022-05-01T12:24:00-08:00")),
+					},
+				},
+			},
+		},
+		{
+			desc: "running job with history",
+			req: &pb.PollRequest{
+				Id: "8",
+			},
+			want: &pb.PollResponse{
+				Id: "8",
+				Status: &pb.PollResponse_InProgress{
+					InProgress: &pb.PollResponse_QueryInProgress{
+						NextPollTime:        timestamppb.New(testutil.StaticTimeRFC3339("2022-05-01T12:20:10-08:00")),
+						Status:              pb.JobStatus_JOB_STATUS_RUNNING,
+						WorkerName:          "worker-1",
+						Phase:               pb.JobPhase_JOB_PHASE_QUERY,
+						StartTime:           timestamppb.New(testutil.StaticTimeRFC3339("2022-05-01T12:18:10-08:00")),
+						EstimatedFinishTime: timestamppb.New(testutil.StaticTimeRFC3339("2022-05-01T12:20:10-08:00")),
 					},
 				},
 			},
@@ -114,10 +230,58 @@ func TestPoll(t *testing.T) {
 				Status: &pb.PollResponse_Success{
 					Success: &pb.PollResponse_QuerySuccess{
 						ResultsGcsUrl: "gs://bucket/result.pb",
+						ResultUrl:     "gs://bucket/result.pb",
+						ResultDigest: &pb.Digest{
+							Sha256:    "0123abcd",
+							SizeBytes: 42,
+						},
+						ResultEncoding: pb.ContentEncoding_CONTENT_ENCODING_ZSTD,
+						Metadata: &pb.ResultMetadata{
+							ResolvedCommitHash: "0123456789abcdef0123456789abcdef01234567",
+							BazelVersion:       "bazel 5.1.1",
+							BazelFlags:         []string{"--output=proto"},
+							TargetCount:        3,
+							SizeBytes:          128,
+							FetchDuration:      durationpb.New(2 * time.Second),
+							CheckoutDuration:   durationpb.New(time.Second),
+							QueryDuration:      durationpb.New(30 * time.Second),
+							UploadDuration:     durationpb.New(500 * time.Millisecond),
+						},
+					},
+				},
+			},
+		},
+		{
+			desc: "successful job with inline result",
+			req: &pb.PollRequest{
+				Id: "9",
+			},
+			want: &pb.PollResponse{
+				Id: "9",
+				Status: &pb.PollResponse_Success{
+					Success: &pb.PollResponse_QuerySuccess{
+						ResultDigest: &pb.Digest{
+							Sha256:    "4567cdef",
+							SizeBytes: 9,
+						},
+						ResultInline: []byte("//foo:bar"),
+						Metadata:     &pb.ResultMetadata{},
 					},
 				},
 			},
 		},
+		{
+			desc: "cancelled job",
+			req: &pb.PollRequest{
+				Id: "6",
+			},
+			want: &pb.PollResponse{
+				Id: "6",
+				Status: &pb.PollResponse_Cancelled{
+					Cancelled: &pb.PollResponse_QueryCancelled{},
+				},
+			},
+		},
 		{
 			desc: "nonexistent job",
 			req: &pb.PollRequest{
@@ -135,22 +299,64 @@ func TestPoll(t *testing.T) {
 			defer stubs.Reset()
 			ctx := context.Background()
 			var (
-				queryFailure = "some query failure"
-				resultURL    = "gs://bucket/result.pb"
+				queryFailure   = "some query failure"
+				resultURL      = "gs://bucket/result.pb"
+				resolvedCommit = "0123456789abcdef0123456789abcdef01234567"
+				worker         = "worker-1"
+				grpcRepo       = "https://github.com/grpc/grpc"
+				abseilRepo     = "https://github.com/abseil/abseil-cpp"
 			)
+			// Succeeded jobs in grpcRepo, with a median duration of 2m
+			var history []db.FakeQueueEntry
+			for i, d := range []time.Duration{time.Minute, 3 * time.Minute, 2 * time.Minute} {
+				start := testutil.StaticTimeRFC3339("2022-05-01T10:00:00-08:00")
+				finish := start.Add(d)
+				history = append(history, db.FakeQueueEntry{
+					Job: &db.QueryJob{
+						ID:         fmt.Sprintf("history-%d", i),
+						Repository: grpcRepo,
+						Status:     db.StatusSucceeded,
+						ResultURL:  &resultURL,
+						StartTime:  &start,
+						FinishTime: &finish,
+					},
+				})
+			}
+			startTime := testutil.StaticTimeRFC3339("2022-05-01T12:18:10-08:00")
 			d := &DatabaseQueue{
 				DB: &db.Fake{
 					Queue: []db.FakeQueueEntry{
 						{
 							Job: &db.QueryJob{
-								ID:     "1",
-								Status: db.StatusPending,
+								ID:         "1",
+								Repository: abseilRepo,
+								Status:     db.StatusPending,
+							},
+						},
+						{
+							Job: &db.QueryJob{
+								ID:         "2",
+								Repository: abseilRepo,
+								Status:     db.StatusRunning,
+								Worker:     &worker,
+							},
+						},
+						{
+							Job: &db.QueryJob{
+								ID:         "7",
+								Repository: grpcRepo,
+								Status:     db.StatusPending,
+								QueueTime:  testutil.StaticTimeRFC3339("2022-05-01T12:19:00-08:00"),
 							},
 						},
 						{
 							Job: &db.QueryJob{
-								ID:     "2",
-								Status: db.StatusRunning,
+								ID:         "8",
+								Repository: grpcRepo,
+								Status:     db.StatusRunning,
+								Worker:     &worker,
+								StartTime:  &startTime,
+								Phase:      db.PhaseQuery,
 							},
 						},
 						{
@@ -162,14 +368,45 @@ func TestPoll(t *testing.T) {
 						},
 						{
 							Job: &db.QueryJob{
-								ID:        "4",
-								Status:    db.StatusSucceeded,
-								ResultURL: &resultURL,
+								ID:                 "4",
+								Status:             db.StatusSucceeded,
+								ResultURL:          &resultURL,
+								ResultSHA256:       "0123abcd",
+								ResultSize:         42,
+								ResultEncoding:     db.EncodingZstd,
+								ResolvedCommitHash: &resolvedCommit,
+								ResultMetadata: db.ResultMetadata{
+									BazelVersion:     "bazel 5.1.1",
+									BazelFlags:       []string{"--output=proto"},
+									TargetCount:      3,
+									Size:             128,
+									FetchDuration:    2 * time.Second,
+									CheckoutDuration: time.Second,
+									QueryDuration:    30 * time.Second,
+									UploadDuration:   500 * time.Millisecond,
+								},
+							},
+						},
+						{
+							Job: &db.QueryJob{
+								ID:     "6",
+								Status: db.StatusCancelled,
+							},
+						},
+						{
+							Job: &db.QueryJob{
+								ID:           "9",
+								Status:       db.StatusSucceeded,
+								ResultSHA256: "4567cdef",
+								ResultSize:   9,
+								ResultInline: []byte("//foo:bar"),
 							},
 						},
 					},
 				},
 			}
+			fake := d.DB.(*db.Fake)
+			fake.Queue = append(fake.Queue, history...)
 
 			got, gotErr := d.Poll(ctx, tc.req)
 			if diff := testutil.ErrSubstring(gotErr, tc.wantErr); diff != "" {
@@ -182,3 +419,695 @@ func TestPoll(t *testing.T) {
 		})
 	}
 }
+
+// listCountingDB counts calls to ListJobs.
+type listCountingDB struct {
+	db.DB
+	lists int
+}
+
+func (d *listCountingDB) ListJobs(ctx context.Context, filter *db.ListJobsFilter, pageSize int, pageToken string) ([]*db.QueryJob, string, error) {
+	d.lists++
+	return d.DB.ListJobs(ctx, filter, pageSize, pageToken)
+}
+
+func TestPollCachesDurationEstimate(t *testing.T) {
+	now := testutil.StaticTimeRFC3339("2022-05-01T12:20:00-08:00")
+	stubs := gostub.Stub(&timeNow, func() time.Time { return now })
+	defer stubs.Reset()
+	ctx := context.Background()
+
+	database := &listCountingDB{DB: memory.New()}
+	d := &DatabaseQueue{DB: database}
+	res, err := d.Queue(ctx, &pb.QueueRequest{
+		Repository:  "https://github.com/grpc/grpc",
+		CommitHash:  "main",
+		QueryString: "deps(//...)",
+	})
+	if err != nil {
+		t.Fatalf("Queue() failed: %v", err)
+	}
+	poll := func() {
+		t.Helper()
+		if _, err := d.Poll(ctx, &pb.PollRequest{Id: res.GetId()}); err != nil {
+			t.Fatalf("Poll() failed: %v", err)
+		}
+	}
+
+	poll()
+	poll()
+	if database.lists != 1 {
+		t.Errorf("got %d ListJobs() calls for polls within the TTL; want 1", database.lists)
+	}
+	now = now.Add(durationEstimateTTL)
+	poll()
+	if database.lists != 2 {
+		t.Errorf("got %d ListJobs() calls after the TTL; want 2", database.lists)
+	}
+}
+
+type fakeWatchJobServer struct {
+	grpc.ServerStream
+
+	ctx  context.Context
+	sent chan *pb.WatchJobResponse
+}
+
+func (f *fakeWatchJobServer) Context() context.Context { return f.ctx }
+
+func (f *fakeWatchJobServer) Send(res *pb.WatchJobResponse) error {
+	f.sent <- res
+	return nil
+}
+
+func TestWatchJob(t *testing.T) {
+	var (
+		queryFailure = "some query failure"
+		resultURL    = "gs://bucket/result.pb"
+	)
+	testCases := []struct {
+		desc    string
+		job     *db.QueryJob
+		updates []*db.QueryJob
+		want    []*pb.WatchJobResponse
+		wantErr string
+	}{
+		{
+			desc: "already finished job",
+			job: &db.QueryJob{
+				ID:          "1",
+				Status:      db.StatusFailed,
+				ResultError: &queryFailure,
+			},
+			want: []*pb.WatchJobResponse{
+				{
+					Id:     "1",
+					Status: pb.JobStatus_JOB_STATUS_FAILED,
+					Result: &pb.WatchJobResponse_Failure{
+						Failure: &pb.PollResponse_QueryFailure{
+							FailureMessage: "some query failure",
+						},
+					},
+				},
+			},
+		},
+		{
+			desc: "pending job runs to completion",
+			job: &db.QueryJob{
+				ID:     "2",
+				Status: db.StatusPending,
+			},
+			updates: []*db.QueryJob{
+				{
+					ID:     "2",
+					Status: db.StatusRunning,
+				},
+				{
+					ID:        "2",
+					Status:    db.StatusSucceeded,
+					ResultURL: &resultURL,
+				},
+			},
+			want: []*pb.WatchJobResponse{
+				{
+					Id:     "2",
+					Status: pb.JobStatus_JOB_STATUS_PENDING,
+				},
+				{
+					Id:     "2",
+					Status: pb.JobStatus_JOB_STATUS_RUNNING,
+				},
+				{
+					Id:     "2",
+					Status: pb.JobStatus_JOB_STATUS_SUCCEEDED,
+					Result: &pb.WatchJobResponse_Success{
+						Success: &pb.PollResponse_QuerySuccess{
+							ResultsGcsUrl: "gs://bucket/result.pb",
+							ResultUrl:     "gs://bucket/result.pb",
+							Metadata:      &pb.ResultMetadata{},
+						},
+					},
+				},
+			},
+		},
+		{
+			desc: "running job is cancelled",
+			job: &db.QueryJob{
+				ID:     "3",
+				Status: db.StatusRunning,
+			},
+			updates: []*db.QueryJob{
+				{
+					ID:     "3",
+					Status: db.StatusCancelled,
+				},
+			},
+			want: []*pb.WatchJobResponse{
+				{
+					Id:     "3",
+					Status: pb.JobStatus_JOB_STATUS_RUNNING,
+				},
+				{
+					Id:     "3",
+					Status: pb.JobStatus_JOB_STATUS_CANCELLED,
+				},
+			},
+		},
+		{
+			desc: "nonexistent job",
+			job: &db.QueryJob{
+				ID:     "4",
+				Status: db.StatusPending,
+			},
+			wantErr: "job not found",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			fake := &db.Fake{
+				Queue: []db.FakeQueueEntry{{Job: tc.job}},
+			}
+			d := &DatabaseQueue{DB: fake}
+			stream := &fakeWatchJobServer{
+				ctx:  ctx,
+				sent: make(chan *pb.WatchJobResponse, len(tc.want)),
+			}
+
+			id := tc.job.ID
+			if tc.wantErr != "" {
+				id = "nonexistent"
+			}
+			errCh := make(chan error)
+			go func() {
+				errCh <- d.WatchJob(&pb.WatchJobRequest{Id: id}, stream)
+			}()
+
+			var got []*pb.WatchJobResponse
+			for i := range tc.want {
+				select {
+				case res := <-stream.sent:
+					got = append(got, res)
+				case <-ctx.Done():
+					t.Fatalf("timed out waiting for response %d", i)
+				}
+				if i < len(tc.updates) {
+					fake.Watchers.Notify(tc.updates[i])
+				}
+			}
+			gotErr := <-errCh
+			if diff := testutil.ErrSubstring(gotErr, tc.wantErr); diff != "" {
+				t.Error(diff)
+			}
+			if gotErr != nil {
+				return
+			}
+			testutil.AssertProtoEqual(t, got, tc.want)
+		})
+	}
+}
+
+type fakeStreamJobLogsServer struct {
+	grpc.ServerStream
+
+	ctx  context.Context
+	sent chan *pb.StreamJobLogsResponse
+}
+
+func (f *fakeStreamJobLogsServer) Context() context.Context { return f.ctx }
+
+func (f *fakeStreamJobLogsServer) Send(res *pb.StreamJobLogsResponse) error {
+	f.sent <- res
+	return nil
+}
+
+func TestStreamJobLogs(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		job     *db.QueryJob
+		log     string
+		offset  int64
+		appends []string
+		want    []*pb.StreamJobLogsResponse
+		wantErr string
+	}{
+		{
+			desc: "finished job",
+			job:  &db.QueryJob{ID: "1", Status: db.StatusSucceeded},
+			log:  "all output",
+			want: []*pb.StreamJobLogsResponse{
+				{Data: []byte("all output")},
+			},
+		},
+		{
+			desc:    "running job",
+			job:     &db.QueryJob{ID: "2", Status: db.StatusRunning},
+			log:     "hello ",
+			appends: []string{"world"},
+			want: []*pb.StreamJobLogsResponse{
+				{Data: []byte("hello ")},
+				{Data: []byte("world"), Offset: 6},
+			},
+		},
+		{
+			desc:   "resumes at offset",
+			job:    &db.QueryJob{ID: "3", Status: db.StatusFailed},
+			log:    "hello world",
+			offset: 6,
+			want: []*pb.StreamJobLogsResponse{
+				{Data: []byte("world"), Offset: 6},
+			},
+		},
+		{
+			desc:    "nonexistent job",
+			job:     &db.QueryJob{ID: "4", Status: db.StatusPending},
+			wantErr: "job not found",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			fake := &db.Fake{
+				Queue: []db.FakeQueueEntry{{Job: tc.job}},
+			}
+			logs := &joblog.Store{}
+			logs.Append(tc.job.ID, []byte(tc.log))
+			d := &DatabaseQueue{DB: fake, Logs: logs}
+			stream := &fakeStreamJobLogsServer{
+				ctx:  ctx,
+				sent: make(chan *pb.StreamJobLogsResponse, len(tc.want)),
+			}
+
+			id := tc.job.ID
+			if tc.wantErr != "" {
+				id = "nonexistent"
+			}
+			errCh := make(chan error)
+			go func() {
+				errCh <- d.StreamJobLogs(&pb.StreamJobLogsRequest{Id: id, Offset: tc.offset}, stream)
+			}()
+
+			var got []*pb.StreamJobLogsResponse
+			for i := range tc.want {
+				select {
+				case res := <-stream.sent:
+					got = append(got, res)
+				case <-ctx.Done():
+					t.Fatalf("timed out waiting for response %d", i)
+				}
+				if i < len(tc.appends) {
+					logs.Append(tc.job.ID, []byte(tc.appends[i]))
+				} else {
+					finished := *tc.job
+					finished.Status = db.StatusSucceeded
+					fake.Watchers.Notify(&finished)
+				}
+			}
+			gotErr := <-errCh
+			if diff := testutil.ErrSubstring(gotErr, tc.wantErr); diff != "" {
+				t.Error(diff)
+			}
+			if gotErr != nil {
+				return
+			}
+			testutil.AssertProtoEqual(t, got, tc.want)
+		})
+	}
+}
+
+type fakeGetResultServer struct {
+	grpc.ServerStream
+
+	ctx  context.Context
+	sent []*pb.GetResultResponse
+}
+
+func (f *fakeGetResultServer) Context() context.Context { return f.ctx }
+
+func (f *fakeGetResultServer) Send(res *pb.GetResultResponse) error {
+	// GetResult reuses its buffer between messages, like gRPC allows once Send
+	// returns.
+	f.sent = append(f.sent, proto.Clone(res).(*pb.GetResultResponse))
+	return nil
+}
+
+func TestGetResult(t *testing.T) {
+	ctx := context.Background()
+	results, err := resultstore.NewFile(t.TempDir())
+	if err != nil {
+		t.Fatalf("resultstore.NewFile() failed: %v", err)
+	}
+	url, err := results.Put(ctx, "result.pb", strings.NewReader("query output"))
+	if err != nil {
+		t.Fatalf("Put() failed: %v", err)
+	}
+	succeeded := &db.QueryJob{
+		ID:           "1",
+		Status:       db.StatusSucceeded,
+		ResultURL:    &url,
+		ResultSHA256: "0123abcd",
+		ResultSize:   12,
+	}
+	missingURL := "gs://bucket/result.pb"
+	stub := gostub.Stub(&getResultChunkSize, 5)
+	defer stub.Reset()
+
+	testCases := []struct {
+		desc    string
+		job     *db.QueryJob
+		req     *pb.GetResultRequest
+		results resultstore.Store
+		want    []*pb.GetResultResponse
+		wantErr string
+	}{
+		{
+			desc:    "whole result in chunks",
+			job:     succeeded,
+			req:     &pb.GetResultRequest{Id: "1"},
+			results: results,
+			want: []*pb.GetResultResponse{
+				{Data: []byte("query"), Offset: 0},
+				{Data: []byte(" outp"), Offset: 5},
+				{Data: []byte("ut"), Offset: 10},
+			},
+		},
+		{
+			desc:    "resumes from offset",
+			job:     succeeded,
+			req:     &pb.GetResultRequest{Id: "1", Offset: 6},
+			results: results,
+			want: []*pb.GetResultResponse{
+				{Data: []byte("outpu"), Offset: 6},
+				{Data: []byte("t"), Offset: 11},
+			},
+		},
+		{
+			desc:    "offset at end",
+			job:     succeeded,
+			req:     &pb.GetResultRequest{Id: "1", Offset: 12},
+			results: results,
+		},
+		{
+			desc:    "offset past end",
+			job:     succeeded,
+			req:     &pb.GetResultRequest{Id: "1", Offset: 13},
+			results: results,
+			wantErr: "past the end",
+		},
+		{
+			desc:    "negative offset",
+			job:     succeeded,
+			req:     &pb.GetResultRequest{Id: "1", Offset: -1},
+			results: results,
+			wantErr: "must not be negative",
+		},
+		{
+			desc:    "job not succeeded",
+			job:     &db.QueryJob{ID: "1", Status: db.StatusRunning},
+			req:     &pb.GetResultRequest{Id: "1"},
+			results: results,
+			wantErr: "has status",
+		},
+		{
+			desc:    "nonexistent job",
+			job:     succeeded,
+			req:     &pb.GetResultRequest{Id: "2"},
+			results: results,
+			wantErr: "job not found",
+		},
+		{
+			desc: "missing result",
+			job: &db.QueryJob{
+				ID:        "1",
+				Status:    db.StatusSucceeded,
+				ResultURL: &missingURL,
+			},
+			req:     &pb.GetResultRequest{Id: "1"},
+			results: results,
+			wantErr: "not found at",
+		},
+		{
+			desc: "inline result",
+			job: &db.QueryJob{
+				ID:           "1",
+				Status:       db.StatusSucceeded,
+				ResultInline: []byte("//foo:bar"),
+			},
+			req: &pb.GetResultRequest{Id: "1", Offset: 2},
+			want: []*pb.GetResultResponse{
+				{Data: []byte("foo:b"), Offset: 2},
+				{Data: []byte("ar"), Offset: 7},
+			},
+		},
+		{
+			desc: "inline result offset past end",
+			job: &db.QueryJob{
+				ID:           "1",
+				Status:       db.StatusSucceeded,
+				ResultInline: []byte("//foo:bar"),
+			},
+			req:     &pb.GetResultRequest{Id: "1", Offset: 10},
+			wantErr: "past the end",
+		},
+		{
+			desc:    "no result store",
+			job:     succeeded,
+			req:     &pb.GetResultRequest{Id: "1"},
+			wantErr: "no result store",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			fake := &db.Fake{
+				Queue: []db.FakeQueueEntry{{Job: tc.job}},
+			}
+			q := &DatabaseQueue{DB: fake, Results: tc.results}
+			stream := &fakeGetResultServer{ctx: ctx}
+
+			gotErr := q.GetResult(tc.req, stream)
+			if diff := testutil.ErrSubstring(gotErr, tc.wantErr); diff != "" {
+				t.Error(diff)
+			}
+			if gotErr != nil {
+				return
+			}
+			testutil.AssertProtoEqual(t, stream.sent, tc.want)
+		})
+	}
+}
+
+func TestQueueDedup(t *testing.T) {
+	ctx := context.Background()
+	d := &DatabaseQueue{DB: memory.New()}
+	req := &pb.QueueRequest{
+		Repository:  "https://github.com/minorhacks/bazel_remote_query",
+		CommitHash:  "main",
+		QueryString: "deps(//...)",
+	}
+
+	first, err := d.Queue(ctx, req)
+	if err != nil {
+		t.Fatalf("Queue() failed: %v", err)
+	}
+	second, err := d.Queue(ctx, req)
+	if err != nil {
+		t.Fatalf("Queue() failed: %v", err)
+	}
+	if second.GetId() != first.GetId() {
+		t.Errorf("got ID %q for duplicate of pending job, want %q", second.GetId(), first.GetId())
+	}
+
+	if _, err := d.CancelJob(ctx, &pb.CancelJobRequest{Id: first.GetId()}); err != nil {
+		t.Fatalf("CancelJob(%q) failed: %v", first.GetId(), err)
+	}
+	third, err := d.Queue(ctx, req)
+	if err != nil {
+		t.Fatalf("Queue() failed: %v", err)
+	}
+	if third.GetId() == first.GetId() {
+		t.Errorf("got ID %q of cancelled job, want new job", third.GetId())
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		req        *pb.CancelJobRequest
+		cancelErr  error
+		wantStatus string
+		wantErr    string
+	}{
+		{
+			desc:       "cancels pending job",
+			req:        &pb.CancelJobRequest{Id: "1"},
+			wantStatus: db.StatusCancelled,
+		},
+		{
+			desc:       "cancels running job",
+			req:        &pb.CancelJobRequest{Id: "2"},
+			wantStatus: db.StatusCancelled,
+		},
+		{
+			desc:       "can't cancel finished job",
+			req:        &pb.CancelJobRequest{Id: "3"},
+			wantStatus: db.StatusSucceeded,
+			wantErr:    "job already finished",
+		},
+		{
+			desc:    "nonexistent job",
+			req:     &pb.CancelJobRequest{Id: "4"},
+			wantErr: "job not found",
+		},
+		{
+			desc:       "propagates cancel failure",
+			req:        &pb.CancelJobRequest{Id: "1"},
+			cancelErr:  errors.New("some cancel error"),
+			wantStatus: db.StatusPending,
+			wantErr:    "some cancel error",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctx := context.Background()
+			fake := &db.Fake{
+				Queue: []db.FakeQueueEntry{
+					{Job: &db.QueryJob{ID: "1", Status: db.StatusPending}},
+					{Job: &db.QueryJob{ID: "2", Status: db.StatusRunning}},
+					{Job: &db.QueryJob{ID: "3", Status: db.StatusSucceeded}},
+				},
+				CancelJobErr: tc.cancelErr,
+			}
+			d := &DatabaseQueue{DB: fake}
+
+			got, gotErr := d.CancelJob(ctx, tc.req)
+			if diff := testutil.ErrSubstring(gotErr, tc.wantErr); diff != "" {
+				t.Error(diff)
+			}
+			if tc.wantStatus != "" {
+				job, err := fake.GetJob(ctx, tc.req.GetId())
+				if err != nil {
+					t.Fatalf("GetJob(%q) failed: %v", tc.req.GetId(), err)
+				}
+				if job.Status != tc.wantStatus {
+					t.Errorf("got job status %q, want %q", job.Status, tc.wantStatus)
+				}
+			}
+			if gotErr != nil {
+				return
+			}
+			testutil.AssertProtoEqual(t, got, &pb.CancelJobResponse{})
+		})
+	}
+}
+
+func TestListJobs(t *testing.T) {
+	var (
+		worker    = "worker-1"
+		startTime = testutil.StaticTimeRFC3339("2022-05-01T12:21:00-08:00")
+	)
+	jobs := []db.FakeQueueEntry{
+		{
+			Job: &db.QueryJob{
+				ID:         "1",
+				Repository: "https://github.com/grpc/grpc",
+				CommitHash: "foobar",
+				Query:      "deps(//...)",
+				Status:     db.StatusPending,
+				QueueTime:  testutil.StaticTimeRFC3339("2022-05-01T12:20:00-08:00"),
+			},
+		},
+		{
+			Job: &db.QueryJob{
+				ID:         "2",
+				Repository: "https://github.com/grpc/grpc",
+				CommitHash: "foobaz",
+				Query:      "deps(//...)",
+				Status:     db.StatusRunning,
+				Worker:     &worker,
+				QueueTime:  testutil.StaticTimeRFC3339("2022-05-01T12:20:30-08:00"),
+				StartTime:  &startTime,
+			},
+		},
+	}
+	testCases := []struct {
+		desc    string
+		req     *pb.ListJobsRequest
+		listErr error
+		want    *pb.ListJobsResponse
+		wantErr string
+	}{
+		{
+			desc: "filters by status",
+			req: &pb.ListJobsRequest{
+				Status: pb.JobStatus_JOB_STATUS_RUNNING,
+			},
+			want: &pb.ListJobsResponse{
+				Jobs: []*pb.JobInfo{
+					{
+						Id:          "2",
+						Repository:  "https://github.com/grpc/grpc",
+						CommitHash:  "foobaz",
+						QueryString: "deps(//...)",
+						Status:      pb.JobStatus_JOB_STATUS_RUNNING,
+						WorkerName:  "worker-1",
+						QueueTime:   timestamppb.New(testutil.StaticTimeRFC3339("2022-05-01T12:20:30-08:00")),
+						StartTime:   timestamppb.New(startTime),
+					},
+				},
+			},
+		},
+		{
+			desc: "filters by queue time",
+			req: &pb.ListJobsRequest{
+				QueuedBefore: timestamppb.New(testutil.StaticTimeRFC3339("2022-05-01T12:20:10-08:00")),
+			},
+			want: &pb.ListJobsResponse{
+				Jobs: []*pb.JobInfo{
+					{
+						Id:          "1",
+						Repository:  "https://github.com/grpc/grpc",
+						CommitHash:  "foobar",
+						QueryString: "deps(//...)",
+						Status:      pb.JobStatus_JOB_STATUS_PENDING,
+						QueueTime:   timestamppb.New(testutil.StaticTimeRFC3339("2022-05-01T12:20:00-08:00")),
+					},
+				},
+			},
+		},
+		{
+			desc: "rejects negative page size",
+			req: &pb.ListJobsRequest{
+				PageSize: -1,
+			},
+			wantErr: "page_size must not be negative",
+		},
+		{
+			desc:    "propagates list failure",
+			req:     &pb.ListJobsRequest{},
+			listErr: errors.New("some list error"),
+			wantErr: "some list error",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctx := context.Background()
+			d := &DatabaseQueue{
+				DB: &db.Fake{
+					Queue:       jobs,
+					ListJobsErr: tc.listErr,
+				},
+			}
+
+			got, gotErr := d.ListJobs(ctx, tc.req)
+			if diff := testutil.ErrSubstring(gotErr, tc.wantErr); diff != "" {
+				t.Error(diff)
+			}
+			if gotErr != nil {
+				return
+			}
+			testutil.AssertProtoEqual(t, got, tc.want)
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package resultstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// File stores results as files in a local directory, as `file://` URLs. The
+// directory may be on a network filesystem shared with clients.
+type File struct {
+	dir string
+}
+
+// NewFile returns a Store that stores results in dir, which must already
+// exist.
+func NewFile(dir string) (*File, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path of %q: %w", dir, err)
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("failed to stat results dir: %w", err)
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("results dir %q is not a directory", dir)
+	}
+	return &File{dir: dir}, nil
+}
+
+func (f *File) Put(ctx context.Context, name string, r io.Reader) (string, error) {
+	if name == "" || strings.ContainsRune(name, filepath.Separator) || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid result name %q", name)
+	}
+	// Write to a temporary file first, so that readers never see a partially
+	// written result
+	tmp, err := os.CreateTemp(f.dir, "."+name+".*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create results file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	// CreateTemp makes the file readable only by its owner, but results are
+	// meant to be read by clients
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to set permissions of results file: %w", err)
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to write results file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("failed to write results file: %w", err)
+	}
+	path := filepath.Join(f.dir, name)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("failed to move results file into place: %w", err)
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String(), nil
+}
+
+func (f *File) Get(ctx context.Context, rawURL string, offset int64) (io.ReadCloser, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "file" {
+		return nil, fmt.Errorf("%q is not a file URL: %w", rawURL, ErrNotFound)
+	}
+	path := filepath.FromSlash(u.Path)
+	if filepath.Dir(path) != f.dir {
+		return nil, fmt.Errorf("%q is not in %q: %w", rawURL, f.dir, ErrNotFound)
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%q: %w", rawURL, ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open results file: %w", err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to seek in results file: %w", err)
+	}
+	return file, nil
+}
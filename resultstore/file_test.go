@@ -0,0 +1,121 @@
+package resultstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFilePut(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFile(dir)
+	if err != nil {
+		t.Fatalf("NewFile() failed: %v", err)
+	}
+	ctx := context.Background()
+
+	got, err := f.Put(ctx, "abc.pb", strings.NewReader("query output"))
+	if err != nil {
+		t.Fatalf("Put() failed: %v", err)
+	}
+	if want := "file://" + filepath.ToSlash(filepath.Join(dir, "abc.pb")); got != want {
+		t.Errorf("Put() = %q; want %q", got, want)
+	}
+	contents, err := os.ReadFile(filepath.Join(dir, "abc.pb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "query output" {
+		t.Errorf("got contents %q; want %q", contents, "query output")
+	}
+
+	// Only the result is left in the directory
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d files in results dir; want 1", len(entries))
+	}
+
+	if _, err := f.Put(ctx, "../abc.pb", strings.NewReader("")); err == nil {
+		t.Error("Put() with name outside results dir succeeded; want error")
+	}
+}
+
+func TestNewFileMissingDir(t *testing.T) {
+	if _, err := NewFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("NewFile() with missing dir succeeded; want error")
+	}
+}
+
+func TestFileGet(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFile(dir)
+	if err != nil {
+		t.Fatalf("NewFile() failed: %v", err)
+	}
+	ctx := context.Background()
+	url, err := f.Put(ctx, "abc.pb", strings.NewReader("query output"))
+	if err != nil {
+		t.Fatalf("Put() failed: %v", err)
+	}
+
+	testCases := []struct {
+		desc    string
+		url     string
+		offset  int64
+		want    string
+		wantErr error
+	}{
+		{
+			desc: "whole result",
+			url:  url,
+			want: "query output",
+		},
+		{
+			desc:   "from offset",
+			url:    url,
+			offset: 6,
+			want:   "output",
+		},
+		{
+			desc:    "missing result",
+			url:     "file://" + filepath.ToSlash(filepath.Join(dir, "missing.pb")),
+			wantErr: ErrNotFound,
+		},
+		{
+			desc:    "outside results dir",
+			url:     "file:///etc/passwd",
+			wantErr: ErrNotFound,
+		},
+		{
+			desc:    "other store",
+			url:     "gs://bucket/abc.pb",
+			wantErr: ErrNotFound,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r, err := f.Get(ctx, tc.url, tc.offset)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Get() returned error %v; want %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("Get() = %q; want %q", got, tc.want)
+			}
+		})
+	}
+}
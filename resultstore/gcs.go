@@ -0,0 +1,54 @@
+package resultstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// GCS stores results in a Google Cloud Storage bucket, as `gs://` URLs.
+type GCS struct {
+	name   string
+	bucket *storage.BucketHandle
+}
+
+// NewGCS returns a Store that stores results in the named bucket, using the
+// default credentials.
+func NewGCS(ctx context.Context, bucket string) (*GCS, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCS client: %w", err)
+	}
+	return &GCS{name: bucket, bucket: client.Bucket(bucket)}, nil
+}
+
+func (g *GCS) Put(ctx context.Context, name string, r io.Reader) (string, error) {
+	obj := g.bucket.Object(name)
+	w := obj.NewWriter(ctx)
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return "", fmt.Errorf("failed to copy results to GCS: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("failed to flush results to GCS: %w", err)
+	}
+	return fmt.Sprintf("gs://%s/%s", obj.BucketName(), obj.ObjectName()), nil
+}
+
+func (g *GCS) Get(ctx context.Context, url string, offset int64) (io.ReadCloser, error) {
+	prefix := fmt.Sprintf("gs://%s/", g.name)
+	if !strings.HasPrefix(url, prefix) {
+		return nil, fmt.Errorf("%q is not in bucket %q: %w", url, g.name, ErrNotFound)
+	}
+	r, err := g.bucket.Object(strings.TrimPrefix(url, prefix)).NewRangeReader(ctx, offset, -1)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, fmt.Errorf("%q: %w", url, ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read %q from GCS: %w", url, err)
+	}
+	return r, nil
+}
@@ -0,0 +1,25 @@
+// Package resultstore uploads query results to a storage backend, from which
+// clients download them by URL.
+package resultstore
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrNotFound is returned by Get when there is no result at a URL in a Store.
+var ErrNotFound = errors.New("result not found")
+
+// Store stores query results.
+type Store interface {
+	// Put stores the contents of r as an object with the given name, and
+	// returns the URL of the stored object. Objects with the same name are
+	// overwritten.
+	Put(ctx context.Context, name string, r io.Reader) (string, error)
+
+	// Get returns the contents of the result at url, as returned by Put,
+	// starting offset bytes into it. Returns ErrNotFound if there is no such
+	// result, or if url refers to a different Store.
+	Get(ctx context.Context, url string, offset int64) (io.ReadCloser, error)
+}
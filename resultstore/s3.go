@@ -0,0 +1,237 @@
+package resultstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var timeNow = time.Now
+
+// S3 stores results in a bucket of an S3-compatible object store, such as AWS
+// S3 or MinIO, as `s3://` URLs. Requests are signed with AWS Signature Version
+// 4, and address the bucket path-style, i.e. as `$ENDPOINT/$BUCKET/$KEY`.
+type S3 struct {
+	// Endpoint is the base URL of the object store, e.g.
+	// `https://s3.us-east-1.amazonaws.com`.
+	Endpoint string
+
+	// Region the bucket is in, e.g. `us-east-1`.
+	Region string
+
+	Bucket string
+
+	// Credentials used to sign requests. SessionToken is only needed for
+	// temporary credentials.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// Client sends requests to the object store. Defaults to
+	// http.DefaultClient if not set.
+	Client *http.Client
+}
+
+// NewS3 returns a Store that stores results in bucket, with credentials taken
+// from the standard AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN environment variables.
+func NewS3(endpoint string, region string, bucket string) (*S3, error) {
+	s := &S3{
+		Endpoint:        strings.TrimSuffix(endpoint, "/"),
+		Region:          region,
+		Bucket:          bucket,
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.AccessKeyID == "" || s.SecretAccessKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to store results in S3")
+	}
+	if u, err := url.Parse(s.Endpoint); err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %q: %w", endpoint, err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q: must be an http or https URL", endpoint)
+	}
+	return s, nil
+}
+
+func (s *S3) Put(ctx context.Context, name string, r io.Reader) (string, error) {
+	// S3 needs the length of the object up front. Query results are usually
+	// files, whose size is known; anything else is buffered.
+	var (
+		body   io.Reader = r
+		length int64     = -1
+	)
+	if f, ok := r.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+			length = info.Size()
+		}
+	}
+	if length < 0 {
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, r); err != nil {
+			return "", fmt.Errorf("failed to read results: %w", err)
+		}
+		body = &buf
+		length = int64(buf.Len())
+	}
+
+	objectURL := fmt.Sprintf("%s/%s/%s", s.Endpoint, s.Bucket, escapePath(name))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, objectURL, body)
+	if err != nil {
+		return "", fmt.Errorf("failed to create S3 request: %w", err)
+	}
+	req.ContentLength = length
+	if length == 0 {
+		req.Body = http.NoBody
+	}
+	s.sign(req, "UNSIGNED-PAYLOAD", timeNow())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload results to S3: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return "", fmt.Errorf("failed to upload results to S3: %s: %s", res.Status, msg)
+	}
+	return fmt.Sprintf("s3://%s/%s", s.Bucket, name), nil
+}
+
+func (s *S3) Get(ctx context.Context, rawURL string, offset int64) (io.ReadCloser, error) {
+	prefix := fmt.Sprintf("s3://%s/", s.Bucket)
+	if !strings.HasPrefix(rawURL, prefix) {
+		return nil, fmt.Errorf("%q is not in bucket %q: %w", rawURL, s.Bucket, ErrNotFound)
+	}
+	objectURL := fmt.Sprintf("%s/%s/%s", s.Endpoint, s.Bucket, escapePath(strings.TrimPrefix(rawURL, prefix)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, objectURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 request: %w", err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	s.sign(req, hashHex(nil), timeNow())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %q from S3: %w", rawURL, err)
+	}
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return res.Body, nil
+	case http.StatusNotFound:
+		res.Body.Close()
+		return nil, fmt.Errorf("%q: %w", rawURL, ErrNotFound)
+	default:
+		defer res.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return nil, fmt.Errorf("failed to download %q from S3: %s: %s", rawURL, res.Status, msg)
+	}
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req, signing
+// its host and all headers set on it. payloadHash is the hex SHA-256 of the
+// body, or UNSIGNED-PAYLOAD.
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, headers[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.Region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format("20060102T150405Z"),
+		scope,
+		hashHex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		s.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// canonicalQuery encodes query parameters as required by Signature Version 4:
+// sorted by key, with spaces encoded as %20.
+func canonicalQuery(v url.Values) string {
+	return strings.ReplaceAll(v.Encode(), "+", "%20")
+}
+
+// escapePath escapes an object key for use in a URL path. Signature Version 4
+// requires every byte other than unreserved characters and slashes to be
+// percent-encoded.
+func escapePath(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hashHex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
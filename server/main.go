@@ -9,10 +9,16 @@ import (
 
 	"github.com/minorhacks/bazel_remote_query/db"
 	"github.com/minorhacks/bazel_remote_query/db/datastore"
+	"github.com/minorhacks/bazel_remote_query/db/memory"
+	"github.com/minorhacks/bazel_remote_query/db/mysql"
+	"github.com/minorhacks/bazel_remote_query/db/postgres"
 	"github.com/minorhacks/bazel_remote_query/db/sqlite"
 	"github.com/minorhacks/bazel_remote_query/dispatch"
+	"github.com/minorhacks/bazel_remote_query/joblog"
+	"github.com/minorhacks/bazel_remote_query/notify"
 	pb "github.com/minorhacks/bazel_remote_query/proto"
 	"github.com/minorhacks/bazel_remote_query/queue"
+	"github.com/minorhacks/bazel_remote_query/resultstore"
 
 	"github.com/golang/glog"
 	"google.golang.org/grpc"
@@ -39,16 +45,51 @@ func main() {
 		database, err = sqlite.New(ctx, dbConfig.Sqlite.GetDbPath())
 	case *pb.DispatcherConfig_Datastore:
 		database, err = datastore.New(ctx, dbConfig.Datastore.GetGcpProject())
+	case *pb.DispatcherConfig_Postgres:
+		database, err = postgres.New(ctx, dbConfig.Postgres.GetDsn())
+	case *pb.DispatcherConfig_Mysql:
+		database, err = mysql.New(ctx, dbConfig.Mysql.GetDsn())
+	case *pb.DispatcherConfig_Memory:
+		m := memory.New()
+		m.MaxFinishedJobs = int(dbConfig.Memory.GetMaxFinishedJobs())
+		database = m
 	}
 	exitIf(err)
 	defer database.Close()
 
+	// Serves results through GetResult, if configured
+	var results resultstore.Store
+	switch storeConfig := config.ResultStore.(type) {
+	case *pb.DispatcherConfig_GcsResultStore:
+		results, err = resultstore.NewGCS(ctx, storeConfig.GcsResultStore.GetBucket())
+	case *pb.DispatcherConfig_FileResultStore:
+		results, err = resultstore.NewFile(storeConfig.FileResultStore.GetDir())
+	case *pb.DispatcherConfig_S3ResultStore:
+		s3 := storeConfig.S3ResultStore
+		results, err = resultstore.NewS3(s3.GetEndpoint(), s3.GetRegion(), s3.GetBucket())
+	}
+	exitIf(err)
+
+	// Wakes up workers waiting for a job when one is queued
+	notifier := &notify.Notifier{}
+	// Holds the logs streamed by workers until clients read them
+	logs := &joblog.Store{}
+
 	dispatchService := &dispatch.DatabaseDispatch{
-		DB: database,
+		DB:          database,
+		Notifier:    notifier,
+		Logs:        logs,
+		MaxAttempts: int(config.GetMaxJobAttempts()),
+		MaxRetries:  int(config.GetMaxInfrastructureRetries()),
 	}
+	go dispatchService.RequeueExpiredJobs(ctx)
 
 	queueService := &queue.DatabaseQueue{
-		DB: database,
+		DB:                database,
+		AllowedBazelFlags: config.GetAllowedBazelFlags(),
+		Notifier:          notifier,
+		Logs:              logs,
+		Results:           results,
 	}
 
 	srv := grpc.NewServer()
@@ -0,0 +1,130 @@
+// Package testmysql runs a throwaway MySQL server for tests. The server's
+// `mysqld` binary must be on the PATH.
+package testmysql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// startTimeout is how long New waits for the server to accept connections.
+const startTimeout = 30 * time.Second
+
+// dbName is the database created for tests.
+const dbName = "bazel_remote_query_test"
+
+type Mysql struct {
+	// DSN connects to an empty database as a superuser
+	DSN string
+
+	cmd       *exec.Cmd
+	ctxCancel func()
+	dirs      []string
+}
+
+func (m *Mysql) Close() error {
+	m.ctxCancel()
+	err := m.cmd.Wait()
+	removeAll(m.dirs)
+	return err
+}
+
+// New initializes a data directory in a new directory under dataDir, and
+// starts a server for it that only listens on a Unix socket.
+func New(ctx context.Context, dataDir string) (ret *Mysql, retErr error) {
+	dir, err := os.MkdirTemp(dataDir, "mysql_*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mysql data dir: %w", err)
+	}
+	// Unix socket paths are limited to around 100 characters, which dataDir
+	// may already exceed
+	socketDir, err := os.MkdirTemp("", "mysql")
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to create mysql socket dir: %w", err)
+	}
+	dirs := []string{dir, socketDir}
+	socket := filepath.Join(socketDir, "mysqld.sock")
+	args := []string{
+		// Ignore any system-wide my.cnf
+		"--no-defaults",
+		"--datadir=" + filepath.Join(dir, "data"),
+	}
+
+	var stderr bytes.Buffer
+	initialize := exec.CommandContext(ctx, "mysqld", append(args, "--initialize-insecure")...)
+	initialize.Stderr = &stderr
+	if err := initialize.Run(); err != nil {
+		removeAll(dirs)
+		return nil, fmt.Errorf("mysqld --initialize-insecure failed: %w\nStderr: %s", err, stderr.String())
+	}
+
+	ctx, ctxCancel := context.WithCancel(ctx)
+	cmd := exec.CommandContext(ctx, "mysqld", append(args,
+		"--socket="+socket,
+		"--pid-file="+filepath.Join(dir, "mysqld.pid"),
+		"--skip-networking",
+		"--skip-mysqlx",
+		"--innodb-flush-log-at-trx-commit=0",
+	)...)
+	if err := cmd.Start(); err != nil {
+		ctxCancel()
+		removeAll(dirs)
+		return nil, fmt.Errorf("failed to start mysqld: %w", err)
+	}
+	ret = &Mysql{
+		DSN:       fmt.Sprintf("root@unix(%s)/%s", socket, dbName),
+		cmd:       cmd,
+		ctxCancel: ctxCancel,
+		dirs:      dirs,
+	}
+	defer func() {
+		if retErr != nil {
+			ret.Close()
+		}
+	}()
+
+	if err := createDatabase(ctx, fmt.Sprintf("root@unix(%s)/", socket)); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// createDatabase waits until the server at dsn accepts connections, and
+// creates the test database.
+func createDatabase(ctx context.Context, dsn string) error {
+	conn, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return fmt.Errorf("failed to open mysql database: %w", err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(startTimeout)
+	for {
+		err := conn.PingContext(ctx)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("mysqld didn't start within %v: %w", startTimeout, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if _, err := conn.ExecContext(ctx, "CREATE DATABASE "+dbName); err != nil {
+		return fmt.Errorf("failed to create database %s: %w", dbName, err)
+	}
+	return nil
+}
+
+func removeAll(dirs []string) {
+	for _, dir := range dirs {
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,116 @@
+// Package testpostgres runs a throwaway PostgreSQL server for tests. The
+// server's `initdb` and `postgres` binaries must be on the PATH.
+package testpostgres
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// startTimeout is how long New waits for the server to accept connections.
+const startTimeout = 30 * time.Second
+
+type Postgres struct {
+	// DSN connects to the server as a superuser
+	DSN string
+
+	cmd       *exec.Cmd
+	ctxCancel func()
+	dirs      []string
+}
+
+func (p *Postgres) Close() error {
+	p.ctxCancel()
+	err := p.cmd.Wait()
+	for _, dir := range p.dirs {
+		os.RemoveAll(dir)
+	}
+	return err
+}
+
+// New initializes a database cluster in a new directory under dataDir, and
+// starts a server for it that only listens on a Unix socket.
+func New(ctx context.Context, dataDir string) (ret *Postgres, retErr error) {
+	dir, err := os.MkdirTemp(dataDir, "postgres_*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create postgres data dir: %w", err)
+	}
+	// Unix socket paths are limited to around 100 characters, which dataDir
+	// may already exceed
+	socketDir, err := os.MkdirTemp("", "pg")
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to create postgres socket dir: %w", err)
+	}
+	dirs := []string{dir, socketDir}
+
+	var stderr bytes.Buffer
+	initdb := exec.CommandContext(ctx, "initdb", "--pgdata="+dir, "--username=postgres", "--auth=trust", "--no-sync")
+	initdb.Stderr = &stderr
+	if err := initdb.Run(); err != nil {
+		removeAll(dirs)
+		return nil, fmt.Errorf("initdb failed: %w\nStderr: %s", err, stderr.String())
+	}
+
+	ctx, ctxCancel := context.WithCancel(ctx)
+	cmd := exec.CommandContext(ctx, "postgres",
+		"-D", dir,
+		"-k", socketDir,
+		"-c", "listen_addresses=",
+		"-c", "fsync=off",
+	)
+	if err := cmd.Start(); err != nil {
+		ctxCancel()
+		removeAll(dirs)
+		return nil, fmt.Errorf("failed to start postgres: %w", err)
+	}
+	ret = &Postgres{
+		DSN:       fmt.Sprintf("host=%s user=postgres dbname=postgres sslmode=disable", socketDir),
+		cmd:       cmd,
+		ctxCancel: ctxCancel,
+		dirs:      dirs,
+	}
+	defer func() {
+		if retErr != nil {
+			ret.Close()
+		}
+	}()
+
+	if err := waitForServer(ctx, ret.DSN); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// waitForServer waits until the server at dsn accepts connections.
+func waitForServer(ctx context.Context, dsn string) error {
+	conn, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return fmt.Errorf("failed to open postgres database: %w", err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(startTimeout)
+	for {
+		err := conn.PingContext(ctx)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("postgres didn't start within %v: %w", startTimeout, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func removeAll(dirs []string) {
+	for _, dir := range dirs {
+		os.RemoveAll(dir)
+	}
+}
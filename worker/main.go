@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
@@ -10,77 +15,288 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/minorhacks/bazel_remote_query/db"
 	pb "github.com/minorhacks/bazel_remote_query/proto"
+	"github.com/minorhacks/bazel_remote_query/resultstore"
 
-	"cloud.google.com/go/storage"
 	"github.com/go-git/go-git/v5"
 	gitconfig "github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/golang/glog"
+	"github.com/klauspost/compress/zstd"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 var configPath = flag.String("config", "", "Path to textproto WorkerConfig")
 
+// pollWait is how long the dispatcher is asked to wait for a job to be queued
+// when none is available.
+const pollWait = 30 * time.Second
+
+// defaultHeartbeatInterval is used when the dispatcher can't be reached to
+// find out when the next heartbeat is due.
+const defaultHeartbeatInterval = 10 * time.Second
+
 type Worker struct {
 	workspaceMap map[string]*Workspace
-	gcsBucket    *storage.BucketHandle
+	results      resultstore.Store
+	encoding     pb.ContentEncoding
+
+	// Results of at most this many bytes are sent inline instead of being
+	// uploaded
+	maxInlineSize int64
+}
+
+// compressor compresses query output before it is stored.
+type compressor struct {
+	// extension is appended to the name of compressed results
+	extension string
+	newWriter func(io.Writer) (io.WriteCloser, error)
+}
+
+var compressors = map[pb.ContentEncoding]compressor{
+	pb.ContentEncoding_CONTENT_ENCODING_GZIP: {
+		extension: "gz",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+	},
+	pb.ContentEncoding_CONTENT_ENCODING_ZSTD: {
+		extension: "zst",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) },
+	},
+}
+
+// maxStderrBytes limits how much of Bazel's stderr is reported when a query
+// fails. The end of stderr is kept, since that's where errors are reported.
+const maxStderrBytes = 16 * 1024
+
+// infraExitCodes are Bazel exit codes that indicate a problem with the
+// environment Bazel runs in rather than with the query.
+var infraExitCodes = map[int]bool{
+	8:  true, // Interrupted
+	9:  true, // Server lock held
+	34: true, // Remote environmental issue
+	36: true, // Local environmental issue
+	37: true, // Internal Bazel error
+}
+
+// jobError is returned by HandleJob when a job fails, and describes the
+// failure to the dispatcher.
+type jobError struct {
+	err      error
+	category pb.FailureCategory
+	exitCode int
+	stderr   string
+}
+
+func (e *jobError) Error() string { return e.err.Error() }
+func (e *jobError) Unwrap() error { return e.err }
+
+func (e *jobError) details() *pb.FailureDetails {
+	return &pb.FailureDetails{
+		Category: e.category,
+		ExitCode: int32(e.exitCode),
+		Stderr:   e.stderr,
+	}
 }
 
-func (w *Worker) HandleJob(ctx context.Context, job *pb.QueryJob) (string, error) {
+// infraError marks err as a failure of the infrastructure running a job, which
+// may not occur if the job is retried.
+func infraError(err error) error {
+	return &jobError{err: err, category: pb.FailureCategory_FAILURE_CATEGORY_INFRASTRUCTURE}
+}
+
+// failureDetails returns the details of an error returned by HandleJob.
+func failureDetails(err error) *pb.FailureDetails {
+	var jobErr *jobError
+	if errors.As(err, &jobErr) {
+		return jobErr.details()
+	}
+	return &pb.FailureDetails{Category: pb.FailureCategory_FAILURE_CATEGORY_QUERY}
+}
+
+// jobResult describes the outcome of a job run by this worker.
+type jobResult struct {
+	// URL, digest and encoding of the uploaded query output, if the query
+	// succeeded. If url is empty, the output is small enough to be sent inline
+	// instead.
+	url      string
+	inline   []byte
+	digest   *pb.Digest
+	encoding pb.ContentEncoding
+	metadata *pb.ResultMetadata
+
+	// Full hash of the commit the query ran at
+	commitHash string
+}
+
+// HandleJob runs job and uploads its output, unless it is small enough to be
+// sent inline. A result is returned whenever the job's committish could be
+// resolved, even if the job failed afterwards. reportPhase is called each time
+// the job enters a new phase, and Bazel's stderr is copied to logs as it runs.
+func (w *Worker) HandleJob(ctx context.Context, job *pb.QueryJob, reportPhase func(pb.JobPhase), logs io.Writer) (*jobResult, error) {
 	repo := job.GetSource().GetRepo()
 	workspace, ok := w.workspaceMap[repo]
 	if !ok {
-		return "", fmt.Errorf("workspace for repo %q not found", repo)
+		return nil, infraError(fmt.Errorf("workspace for repo %q not found", repo))
+	}
+
+	// The time spent in each phase is recorded in the result metadata
+	phaseStart := time.Now()
+	endPhase := func() *durationpb.Duration {
+		now := time.Now()
+		d := now.Sub(phaseStart)
+		phaseStart = now
+		return durationpb.New(d)
 	}
 
+	reportPhase(pb.JobPhase_JOB_PHASE_FETCH)
 	ref := job.GetSource().GetCommittish()
-	if err := workspace.repo.FetchContext(context.TODO(), &git.FetchOptions{
-		RefSpecs: []gitconfig.RefSpec{gitconfig.RefSpec(fmt.Sprintf("+%s:%s", ref, ref))},
-		Force:    true,
-	}); err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
-		return "", fmt.Errorf("failed to fetch ref %q: %w", ref, err)
+	hash, err := workspace.Resolve(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	metadata := &pb.ResultMetadata{
+		ResolvedCommitHash: hash.String(),
+		FetchDuration:      endPhase(),
 	}
+	res := &jobResult{commitHash: hash.String()}
+	glog.V(1).Infof("Resolved %q to %s", ref, hash)
 
+	reportPhase(pb.JobPhase_JOB_PHASE_CHECKOUT)
 	wt, err := workspace.repo.Worktree()
 	if err != nil {
-		return "", fmt.Errorf("failed to get worktree for %q: %w", repo, err)
+		return res, infraError(fmt.Errorf("failed to get worktree for %q: %w", repo, err))
 	}
 	if err := wt.Checkout(&git.CheckoutOptions{
-		Hash:  plumbing.NewHash(ref), // TODO: doesn't work for branch names, etc.
+		Hash:  hash,
 		Force: true,
 	}); err != nil {
-		return "", fmt.Errorf("failed to checkout ref %q: %w", ref, err)
+		return res, infraError(fmt.Errorf("failed to checkout ref %q: %w", ref, err))
 	}
 	glog.V(1).Infof("Checkout successful")
+	metadata.CheckoutDuration = endPhase()
 
 	// Run query in bazel workspace
+	reportPhase(pb.JobPhase_JOB_PHASE_QUERY)
 	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
 	defer cancel()
-	res, err := workspace.Query(ctx, job.GetQuery())
+	// The version may differ between commits, e.g. through .bazelversion
+	version, err := workspace.BazelVersion(ctx)
+	logIfErr("getting bazel version", err)
+	metadata.BazelVersion = version
+	metadata.BazelFlags = append(append([]string{}, job.GetBazelFlags()...), "--output="+outputFormats[job.GetOutputFormat()].flag)
+	output, err := workspace.Query(ctx, job, logs)
 	if err != nil {
-		return "", err
+		return res, err
 	}
+	defer func() {
+		logIfErr("closing output file", output.Close())
+		logIfErr("deleting output file", os.Remove(output.Name()))
+	}()
+	// out is replaced by the compressed output, if results are compressed
+	var out io.ReadSeeker = output
 	glog.V(1).Infof("Query successful")
+	metadata.SizeBytes, metadata.TargetCount, err = outputStats(out, job)
+	if err != nil {
+		return res, infraError(fmt.Errorf("failed to read query output: %w", err))
+	}
+	metadata.QueryDuration = endPhase()
 
-	// If success, upload result to GCS
-	objName := fmt.Sprintf("%s.pb", job.GetId())
-	obj := w.gcsBucket.Object(objName)
-	objWriter := obj.NewWriter(ctx)
-	if _, err := io.Copy(objWriter, res); err != nil {
-		return "", fmt.Errorf("failed to copy results to GCS: %w", err)
+	// If success, upload result to the result store, named by its digest so
+	// that identical outputs are only stored once
+	reportPhase(pb.JobPhase_JOB_PHASE_UPLOAD)
+	ext := outputFormats[job.GetOutputFormat()].extension
+	if c, ok := compressors[w.encoding]; ok {
+		compressed, err := compress(out, c)
+		if err != nil {
+			return res, infraError(fmt.Errorf("failed to compress query output: %w", err))
+		}
+		defer compressed.Close()
+		out = compressed
+		ext += "." + c.extension
+	}
+	digest, err := digestOf(out)
+	if err != nil {
+		return res, infraError(fmt.Errorf("failed to compute digest of query output: %w", err))
 	}
-	if err := objWriter.Close(); err != nil {
-		return "", fmt.Errorf("failed to flush results to GCS: %w", err)
+	res.digest = digest
+	res.encoding = w.encoding
+	res.metadata = metadata
+	if digest.GetSizeBytes() <= w.maxInlineSize {
+		inline, err := io.ReadAll(out)
+		if err != nil {
+			return res, infraError(fmt.Errorf("failed to read query output: %w", err))
+		}
+		res.inline = inline
+		metadata.UploadDuration = endPhase()
+		return res, nil
+	}
+	objName := fmt.Sprintf("%s.%s", digest.GetSha256(), ext)
+	url, err := w.results.Put(ctx, objName, out)
+	if err != nil {
+		return res, infraError(err)
 	}
 	glog.V(1).Infof("Upload successful")
-	return fmt.Sprintf("gs://%s/%s", obj.BucketName(), obj.ObjectName()), nil
+	res.url = url
+	metadata.UploadDuration = endPhase()
+	return res, nil
+}
+
+// compress returns a temporary file containing the contents of r compressed
+// with c. The file is deleted when it is closed.
+func compress(r io.Reader, c compressor) (io.ReadSeekCloser, error) {
+	f, err := os.CreateTemp("", "bazel_remote_query_*."+c.extension)
+	if err != nil {
+		return nil, err
+	}
+	// Unlinking the file straight away means it is cleaned up once closed
+	if err := os.Remove(f.Name()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	cw, err := c.newWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := io.Copy(cw, r); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := cw.Close(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// digestOf returns the digest of the contents of r, and rewinds r.
+func digestOf(r io.ReadSeeker) (*pb.Digest, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return &pb.Digest{
+		Sha256:    hex.EncodeToString(h.Sum(nil)),
+		SizeBytes: n,
+	}, nil
 }
 
 type Workspace struct {
@@ -88,36 +304,259 @@ type Workspace struct {
 	repo *git.Repository
 }
 
-func (w *Workspace) Query(ctx context.Context, query string) (res io.ReadCloser, err error) {
-	cmd := exec.CommandContext(ctx, "bazel", "query", query, "--output=proto")
-	stdout, err := os.CreateTemp("", "bazel_remote_query_*.pb")
+// Resolve fetches committish from the remote and returns the full hash of the
+// commit it refers to. committish may be a full or abbreviated commit hash, a
+// branch or tag name, or a full ref name such as refs/pull/123/head.
+func (w *Workspace) Resolve(ctx context.Context, committish string) (plumbing.Hash, error) {
+	// Commits never change, so a full hash that is already known doesn't
+	// require a fetch
+	if plumbing.IsHash(committish) {
+		hash := plumbing.NewHash(committish)
+		if _, err := w.repo.CommitObject(hash); err == nil {
+			return hash, nil
+		}
+	}
+
+	refSpecs := []gitconfig.RefSpec{
+		"+refs/heads/*:refs/remotes/origin/*",
+		"+refs/tags/*:refs/tags/*",
+	}
+	isRef := strings.HasPrefix(committish, "refs/")
+	if isRef && !strings.HasPrefix(committish, "refs/heads/") && !strings.HasPrefix(committish, "refs/tags/") {
+		refSpecs = append(refSpecs, gitconfig.RefSpec(fmt.Sprintf("+%s:%s", committish, committish)))
+	}
+	if err := w.repo.FetchContext(ctx, &git.FetchOptions{
+		RefSpecs: refSpecs,
+		Force:    true,
+	}); err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return plumbing.ZeroHash, infraError(fmt.Errorf("failed to fetch %q: %w", committish, err))
+	}
+
+	// Branches are fetched as remote-tracking branches, which take precedence
+	// over local branches that may have been left behind by the initial clone.
+	var candidates []string
+	switch {
+	case strings.HasPrefix(committish, "refs/heads/"):
+		candidates = append(candidates, "refs/remotes/origin/"+strings.TrimPrefix(committish, "refs/heads/"))
+	case !isRef:
+		candidates = append(candidates, "refs/remotes/origin/"+committish)
+	}
+	candidates = append(candidates, committish)
+	for _, c := range candidates {
+		hash, err := w.repo.ResolveRevision(plumbing.Revision(c))
+		if err == nil {
+			return *hash, nil
+		}
+	}
+	return plumbing.ZeroHash, fmt.Errorf("failed to resolve %q to a commit", committish)
+}
+
+// bazelCommands maps query types to the bazel command that runs them.
+var bazelCommands = map[pb.QueryType]string{
+	pb.QueryType_QUERY_TYPE_QUERY:  "query",
+	pb.QueryType_QUERY_TYPE_CQUERY: "cquery",
+	pb.QueryType_QUERY_TYPE_AQUERY: "aquery",
+}
+
+type outputFormat struct {
+	// Value of bazel's --output flag
+	flag string
+
+	// Extension of files containing output in this format
+	extension string
+}
+
+var outputFormats = map[pb.OutputFormat]outputFormat{
+	pb.OutputFormat_OUTPUT_FORMAT_PROTO:              {flag: "proto", extension: "pb"},
+	pb.OutputFormat_OUTPUT_FORMAT_LABEL:              {flag: "label", extension: "txt"},
+	pb.OutputFormat_OUTPUT_FORMAT_LABEL_KIND:         {flag: "label_kind", extension: "txt"},
+	pb.OutputFormat_OUTPUT_FORMAT_XML:                {flag: "xml", extension: "xml"},
+	pb.OutputFormat_OUTPUT_FORMAT_GRAPH:              {flag: "graph", extension: "dot"},
+	pb.OutputFormat_OUTPUT_FORMAT_STREAMED_JSONPROTO: {flag: "streamed_jsonproto", extension: "jsonl"},
+}
+
+// Query runs job's query and returns a temporary file containing its output,
+// which the caller must close and delete. Bazel's stderr is copied to logs as
+// it runs.
+func (w *Workspace) Query(ctx context.Context, job *pb.QueryJob, logs io.Writer) (res *os.File, err error) {
+	bazelCmd, ok := bazelCommands[job.GetQueryType()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported query type %v", job.GetQueryType())
+	}
+	format, ok := outputFormats[job.GetOutputFormat()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported output format %v", job.GetOutputFormat())
+	}
+	query := job.GetQuery()
+	args := append([]string{bazelCmd}, job.GetBazelFlags()...)
+	// -- stops bazel from parsing a query that starts with - as a flag.
+	args = append(args, "--output="+format.flag, "--", query)
+	cmd := exec.CommandContext(ctx, "bazel", args...)
+	stdout, err := os.CreateTemp("", "bazel_remote_query_*."+format.extension)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create query output file: %w", err)
+		return nil, infraError(fmt.Errorf("failed to create query output file: %w", err))
 	}
 	defer func() {
 		if err != nil {
 			glog.V(1).Infof("Query failed in %q; deleting output file", w.path)
-			logIfErr("closing output file", res.Close())
-			logIfErr("deleting output file", os.Remove(res.(*os.File).Name()))
+			logIfErr("closing output file", stdout.Close())
+			logIfErr("deleting output file", os.Remove(stdout.Name()))
 			res = nil
 		}
 	}()
 	var stderr bytes.Buffer
 	cmd.Dir = w.path
 	cmd.Stdout = stdout
-	cmd.Stderr = &stderr
-	glog.V(1).Infof("Running query %q in %q to output %q...", query, w.path, stdout.Name())
+	cmd.Stderr = io.MultiWriter(&stderr, logs)
+	glog.V(1).Infof("Running %s %q with flags %q in %q to output %q...", bazelCmd, query, job.GetBazelFlags(), w.path, stdout.Name())
 	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("bazel query failed: %v\nStderr: %s", err, stderr.String())
+		return nil, bazelError(ctx, bazelCmd, err, stderr.Bytes())
 	}
 	if _, err := stdout.Seek(0, 0); err != nil {
-		return nil, fmt.Errorf("failed to reset file offset in %q: %w", stdout.Name(), err)
+		return nil, infraError(fmt.Errorf("failed to reset file offset in %q: %w", stdout.Name(), err))
 	}
 
 	glog.V(1).Infof("Query output successfully saved in %q", stdout.Name())
 	return stdout, nil
 }
 
+// BazelVersion returns the version of Bazel used in the workspace, as printed
+// by `bazel --version`.
+func (w *Workspace) BazelVersion(ctx context.Context) (string, error) {
+	cmd := exec.CommandContext(ctx, "bazel", "--version")
+	cmd.Dir = w.path
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("bazel --version failed in %q: %w", w.path, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// targetFields are the fields of the top-level message of each query type's
+// proto output that hold targets.
+var targetFields = map[pb.QueryType]protowire.Number{
+	pb.QueryType_QUERY_TYPE_QUERY:  1, // QueryResult.target
+	pb.QueryType_QUERY_TYPE_CQUERY: 1, // CqueryResult.results
+	pb.QueryType_QUERY_TYPE_AQUERY: 3, // ActionGraphContainer.targets
+}
+
+// outputStats returns the size of job's query output in r, and the number of
+// targets in it if they can be counted for job's output format. r is rewound
+// afterwards.
+func outputStats(r io.ReadSeeker, job *pb.QueryJob) (size, targets int64, err error) {
+	size, err = r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	switch job.GetOutputFormat() {
+	case pb.OutputFormat_OUTPUT_FORMAT_PROTO:
+		targets, err = countProtoFields(r, targetFields[job.GetQueryType()])
+	case pb.OutputFormat_OUTPUT_FORMAT_LABEL, pb.OutputFormat_OUTPUT_FORMAT_LABEL_KIND:
+		targets, err = countLines(r)
+	case pb.OutputFormat_OUTPUT_FORMAT_STREAMED_JSONPROTO:
+		// aquery streams actions and artifacts as well as targets
+		if job.GetQueryType() != pb.QueryType_QUERY_TYPE_AQUERY {
+			targets, err = countLines(r)
+		}
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	return size, targets, nil
+}
+
+// countLines returns the number of non-empty lines in r.
+func countLines(r io.Reader) (int64, error) {
+	var (
+		count  int64
+		inLine bool
+	)
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := r.Read(buf)
+		for _, b := range buf[:n] {
+			if b == '\n' {
+				inLine = false
+			} else if !inLine {
+				inLine = true
+				count++
+			}
+		}
+		if err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// countProtoFields returns the number of times the length-delimited field
+// appears at the top level of the serialized proto message in r, without
+// reading the whole message into memory.
+func countProtoFields(r io.Reader, field protowire.Number) (int64, error) {
+	br := bufio.NewReader(r)
+	var count int64
+	for {
+		tag, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return 0, err
+		}
+		num, typ := protowire.DecodeTag(tag)
+		var skip uint64
+		switch typ {
+		case protowire.VarintType:
+			_, err = binary.ReadUvarint(br)
+		case protowire.Fixed32Type:
+			skip = 4
+		case protowire.Fixed64Type:
+			skip = 8
+		case protowire.BytesType:
+			skip, err = binary.ReadUvarint(br)
+			if num == field {
+				count++
+			}
+		default:
+			return 0, fmt.Errorf("unsupported wire type %d in field %d", typ, num)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if _, err := io.CopyN(io.Discard, br, int64(skip)); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// bazelError classifies an error returned from running a bazel command.
+func bazelError(ctx context.Context, bazelCmd string, err error, stderr []byte) error {
+	if len(stderr) > maxStderrBytes {
+		stderr = stderr[len(stderr)-maxStderrBytes:]
+	}
+	jobErr := &jobError{
+		err:      fmt.Errorf("bazel %s failed: %v\nStderr: %s", bazelCmd, err, stderr),
+		category: pb.FailureCategory_FAILURE_CATEGORY_INFRASTRUCTURE,
+		stderr:   string(stderr),
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		jobErr.exitCode = exitErr.ExitCode()
+		// Bazel exiting on its own, rather than being killed (e.g. because the
+		// query timed out), means it ran the query and rejected it
+		if ctx.Err() == nil && jobErr.exitCode > 0 && !infraExitCodes[jobErr.exitCode] {
+			jobErr.category = pb.FailureCategory_FAILURE_CATEGORY_QUERY
+		}
+	}
+	return jobErr
+}
+
 func main() {
 	flag.Parse()
 
@@ -141,7 +580,10 @@ func main() {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute) // TODO: parameterize
 		defer cancel()
 		job, err := client.GetQueryJob(ctx, &pb.GetQueryJobRequest{
-			WorkerName: config.GetWorkerName(),
+			WorkerName:   config.GetWorkerName(),
+			Repositories: config.GetGitRepositoryUrls(),
+			Labels:       config.GetLabels(),
+			MaxWait:      durationpb.New(pollWait),
 		})
 		st, ok := status.FromError(err)
 		if !ok {
@@ -156,18 +598,65 @@ func main() {
 
 		nextPoll := job.GetNextPollTime().AsTime()
 		if j := job.GetJob(); j != nil {
-			url, err := worker.HandleJob(ctx, j)
+			jobCtx, cancelJob := context.WithCancel(ctx)
+			cancelled := make(chan bool, 1)
+			go func() {
+				cancelled <- heartbeat(jobCtx, client, &pb.HeartbeatRequest{
+					QueryJobId: j.GetId(),
+					WorkerName: config.GetWorkerName(),
+				}, cancelJob)
+			}()
+			logs := newLogWriter(jobCtx, client, &pb.StreamLogsRequest{
+				QueryJobId: j.GetId(),
+				WorkerName: config.GetWorkerName(),
+			})
+			// Progress reports are sent from this goroutine, so abandoned
+			// doesn't need to be synchronized
+			abandoned := false
+			res, err := worker.HandleJob(jobCtx, j, func(phase pb.JobPhase) {
+				if reportProgress(jobCtx, client, &pb.ReportProgressRequest{
+					QueryJobId: j.GetId(),
+					WorkerName: config.GetWorkerName(),
+					Phase:      phase,
+				}) {
+					abandoned = true
+					cancelJob()
+				}
+			}, logs)
+			// The log must be complete before the job is finished, since
+			// clients stop tailing it once the job has finished
+			logs.Close()
+			cancelJob()
+			if <-cancelled || abandoned {
+				glog.Infof("Abandoned job %s", j.GetId())
+				time.Sleep(time.Until(nextPoll))
+				continue
+			}
 			req := &pb.FinishQueryJobRequest{
 				QueryJobId: j.GetId(),
+				WorkerName: config.GetWorkerName(),
+			}
+			if res != nil {
+				req.ResolvedCommitHash = res.commitHash
 			}
 			if err != nil {
 				req.Result = &pb.FinishQueryJobRequest_FailureMessage{
 					FailureMessage: err.Error(),
 				}
+				req.FailureDetails = failureDetails(err)
 			} else {
-				req.Result = &pb.FinishQueryJobRequest_QueryResultGcsLocation{
-					QueryResultGcsLocation: url,
+				if res.url != "" {
+					req.Result = &pb.FinishQueryJobRequest_QueryResultUrl{
+						QueryResultUrl: res.url,
+					}
+				} else {
+					req.Result = &pb.FinishQueryJobRequest_QueryResultInline{
+						QueryResultInline: res.inline,
+					}
 				}
+				req.ResultDigest = res.digest
+				req.ResultEncoding = res.encoding
+				req.ResultMetadata = res.metadata
 			}
 			_, err = client.FinishQueryJob(ctx, req)
 			logIfErr("sending FinishQuery request", err)
@@ -179,6 +668,106 @@ func main() {
 	}
 }
 
+// heartbeat periodically sends heartbeats for a running job until ctx is done.
+// If the dispatcher reports that the job was cancelled or that the worker's
+// lease on it expired, cancel is called and heartbeat returns true.
+func heartbeat(ctx context.Context, client pb.QueryDispatchClient, req *pb.HeartbeatRequest, cancel func()) bool {
+	next := time.Now().Add(defaultHeartbeatInterval)
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(time.Until(next)):
+		}
+		res, err := client.Heartbeat(ctx, req)
+		if err != nil {
+			glog.Errorf("Failed to send heartbeat for job %s: %v", req.GetQueryJobId(), err)
+			next = time.Now().Add(defaultHeartbeatInterval)
+			continue
+		}
+		if res.GetCancelled() {
+			glog.Infof("Job %s was cancelled; stopping it", req.GetQueryJobId())
+			cancel()
+			return true
+		}
+		if res.GetLeaseExpired() {
+			glog.Warningf("Lease on job %s expired; stopping it", req.GetQueryJobId())
+			cancel()
+			return true
+		}
+		next = res.GetNextHeartbeatTime().AsTime()
+	}
+}
+
+// reportProgress tells the dispatcher that a job has entered a new phase.
+// Returns true if the dispatcher reports that the job was cancelled or that the
+// worker's lease on it expired. Failures to send the report are only logged,
+// since they don't affect the job.
+func reportProgress(ctx context.Context, client pb.QueryDispatchClient, req *pb.ReportProgressRequest) bool {
+	res, err := client.ReportProgress(ctx, req)
+	if err != nil {
+		glog.Errorf("Failed to report phase %v of job %s: %v", req.GetPhase(), req.GetQueryJobId(), err)
+		return false
+	}
+	if res.GetCancelled() {
+		glog.Infof("Job %s was cancelled; stopping it", req.GetQueryJobId())
+		return true
+	}
+	if res.GetLeaseExpired() {
+		glog.Warningf("Lease on job %s expired; stopping it", req.GetQueryJobId())
+		return true
+	}
+	return false
+}
+
+// logWriter streams everything written to it to the dispatcher as the log of a
+// job. Failures to stream the log are only logged, since they don't affect the
+// job.
+type logWriter struct {
+	stream pb.QueryDispatch_StreamLogsClient
+
+	// header identifies the job, and is sent with the first chunk of the log
+	header     *pb.StreamLogsRequest
+	sentHeader bool
+}
+
+func newLogWriter(ctx context.Context, client pb.QueryDispatchClient, header *pb.StreamLogsRequest) *logWriter {
+	stream, err := client.StreamLogs(ctx)
+	if err != nil {
+		glog.Errorf("Failed to stream logs of job %s: %v", header.GetQueryJobId(), err)
+		return &logWriter{header: header}
+	}
+	return &logWriter{stream: stream, header: header}
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	if w.stream == nil {
+		return len(p), nil
+	}
+	req := &pb.StreamLogsRequest{Data: p}
+	if !w.sentHeader {
+		req.QueryJobId = w.header.GetQueryJobId()
+		req.WorkerName = w.header.GetWorkerName()
+	}
+	if err := w.stream.Send(req); err != nil {
+		glog.Errorf("Failed to stream logs of job %s: %v", w.header.GetQueryJobId(), err)
+		w.stream = nil
+		return len(p), nil
+	}
+	w.sentHeader = true
+	return len(p), nil
+}
+
+// Close ends the stream, and waits for the dispatcher to receive the log.
+func (w *logWriter) Close() {
+	if w.stream == nil {
+		return
+	}
+	_, err := w.stream.CloseAndRecv()
+	logIfErr("streaming job logs", err)
+	w.stream = nil
+}
+
 func exitIf(err error) {
 	if err != nil {
 		glog.Exit(err)
@@ -226,12 +815,43 @@ func New(ctx context.Context, config *pb.WorkerConfig) (*Worker, error) {
 		}
 		workspaceMap[repo] = &Workspace{repo: r, path: targetDir}
 	}
-	gcsClient, err := storage.NewClient(context.Background())
+	results, err := newResultStore(context.Background(), config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create GCS client: %w", err)
+		return nil, err
+	}
+	if e := config.GetResultEncoding(); e != pb.ContentEncoding_CONTENT_ENCODING_IDENTITY {
+		if _, ok := compressors[e]; !ok {
+			return nil, fmt.Errorf("unsupported result encoding %v", e)
+		}
+	}
+	// The dispatcher rejects larger inline results, which would leave the job
+	// to be retried until it is abandoned
+	maxInlineSize := config.GetMaxInlineResultBytes()
+	if maxInlineSize > db.MaxInlineResultSize {
+		glog.Warningf("max_inline_result_bytes %d is larger than the dispatcher allows; using %d", maxInlineSize, db.MaxInlineResultSize)
+		maxInlineSize = db.MaxInlineResultSize
 	}
 	return &Worker{
-		workspaceMap: workspaceMap,
-		gcsBucket:    gcsClient.Bucket(config.GetResultsGcsBucket()),
+		workspaceMap:  workspaceMap,
+		results:       results,
+		encoding:      config.GetResultEncoding(),
+		maxInlineSize: maxInlineSize,
 	}, nil
 }
+
+// newResultStore returns the result store selected in config.
+func newResultStore(ctx context.Context, config *pb.WorkerConfig) (resultstore.Store, error) {
+	switch storeConfig := config.ResultStore.(type) {
+	case *pb.WorkerConfig_GcsResultStore:
+		return resultstore.NewGCS(ctx, storeConfig.GcsResultStore.GetBucket())
+	case *pb.WorkerConfig_FileResultStore:
+		return resultstore.NewFile(storeConfig.FileResultStore.GetDir())
+	case *pb.WorkerConfig_S3ResultStore:
+		s3 := storeConfig.S3ResultStore
+		return resultstore.NewS3(s3.GetEndpoint(), s3.GetRegion(), s3.GetBucket())
+	}
+	if bucket := config.GetResultsGcsBucket(); bucket != "" {
+		return resultstore.NewGCS(ctx, bucket)
+	}
+	return nil, fmt.Errorf("no result store configured")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/minorhacks/bazel_remote_query/db"
+	pb "github.com/minorhacks/bazel_remote_query/proto"
+)
+
+func TestNewMaxInlineSize(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		configured int64
+		want       int64
+	}{
+		{
+			desc: "uploads all results by default",
+			want: 0,
+		},
+		{
+			desc:       "within the dispatcher's limit",
+			configured: 64 << 10,
+			want:       64 << 10,
+		},
+		{
+			desc:       "capped at the dispatcher's limit",
+			configured: 4 << 20,
+			want:       db.MaxInlineResultSize,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			w, err := New(context.Background(), &pb.WorkerConfig{
+				ResultStore: &pb.WorkerConfig_FileResultStore{
+					FileResultStore: &pb.FileResultStore{Dir: t.TempDir()},
+				},
+				MaxInlineResultBytes: tc.configured,
+			})
+			if err != nil {
+				t.Fatalf("New() failed: %v", err)
+			}
+			if w.maxInlineSize != tc.want {
+				t.Errorf("got max inline size %d; want %d", w.maxInlineSize, tc.want)
+			}
+		})
+	}
+}